@@ -2,7 +2,6 @@ package conntrack
 
 import (
 	"encoding/binary"
-	"log"
 	"net"
 	"time"
 
@@ -129,7 +128,7 @@ const (
 
 const nlafNested = (1 << 15)
 
-func extractSecCtx(v *SecCtx, logger *log.Logger, data []byte) error {
+func extractSecCtx(v *SecCtx, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -141,13 +140,14 @@ func extractSecCtx(v *SecCtx, logger *log.Logger, data []byte) error {
 			tmp := ad.String()
 			v.Name = &tmp
 		default:
-			logger.Printf("extractSecCtx(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func extractTimestamp(v *Timestamp, logger *log.Logger, data []byte) error {
+func extractTimestamp(v *Timestamp, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -164,13 +164,14 @@ func extractTimestamp(v *Timestamp, logger *log.Logger, data []byte) error {
 			ts := time.Unix(0, int64(tmp))
 			v.Stop = &ts
 		default:
-			logger.Printf("extractTimestamp(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func extractCounter(v *Counter, logger *log.Logger, data []byte) error {
+func extractCounter(v *Counter, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -191,13 +192,14 @@ func extractCounter(v *Counter, logger *log.Logger, data []byte) error {
 			tmp := ad.Uint32()
 			v.Bytes32 = &tmp
 		default:
-			logger.Printf("extractCounter(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func extractDCCPInfo(v *DCCPInfo, logger *log.Logger, data []byte) error {
+func extractDCCPInfo(v *DCCPInfo, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -215,13 +217,14 @@ func extractDCCPInfo(v *DCCPInfo, logger *log.Logger, data []byte) error {
 			tmp := ad.Uint64()
 			v.HandshakeSeq = &tmp
 		default:
-			logger.Printf("extractDCCPInfo(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func extractSCTPInfo(v *SCTPInfo, logger *log.Logger, data []byte) error {
+func extractSCTPInfo(v *SCTPInfo, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -239,13 +242,14 @@ func extractSCTPInfo(v *SCTPInfo, logger *log.Logger, data []byte) error {
 			tmp := ad.Uint32()
 			v.VTagReply = &tmp
 		default:
-			logger.Printf("extractSCTPInfo(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func extractSeqAdj(v *SeqAdj, logger *log.Logger, data []byte) error {
+func extractSeqAdj(v *SeqAdj, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -263,13 +267,14 @@ func extractSeqAdj(v *SeqAdj, logger *log.Logger, data []byte) error {
 			tmp := ad.Uint32()
 			v.OffsetAfter = &tmp
 		default:
-			logger.Printf("extractSeqAdj(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func extractNat(v *Nat, logger *log.Logger, data []byte) error {
+func extractNat(v *Nat, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -290,13 +295,14 @@ func extractNat(v *Nat, logger *log.Logger, data []byte) error {
 			tmp := net.IP(ad.Bytes())
 			v.IPMax = &tmp
 		default:
-			logger.Printf("extractNat(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func marshalNat(logger *log.Logger, v *Nat) ([]byte, error) {
+func marshalNat(logger LeveledLogger, v *Nat) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
 	if v.IPMin != nil {
@@ -318,7 +324,7 @@ func marshalNat(logger *log.Logger, v *Nat) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractTCPInfo(v *TCPInfo, logger *log.Logger, data []byte) error {
+func extractTCPInfo(v *TCPInfo, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -360,13 +366,14 @@ func extractTCPInfo(v *TCPInfo, logger *log.Logger, data []byte) error {
 			}
 			v.FlagsReply = flags
 		default:
-			logger.Printf("extractTCPInfo(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func marshalTCPInfo(logger *log.Logger, v *TCPInfo) ([]byte, error) {
+func marshalTCPInfo(logger LeveledLogger, v *TCPInfo) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
 	if v.State != nil {
@@ -408,7 +415,7 @@ func marshalTCPInfo(logger *log.Logger, v *TCPInfo) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractProtoInfo(v *ProtoInfo, logger *log.Logger, data []byte) error {
+func extractProtoInfo(v *ProtoInfo, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -418,30 +425,31 @@ func extractProtoInfo(v *ProtoInfo, logger *log.Logger, data []byte) error {
 		switch ad.Type() {
 		case ctaProtoinfoTCP:
 			tcp := &TCPInfo{}
-			if err := extractTCPInfo(tcp, logger, ad.Bytes()); err != nil {
+			if err := extractTCPInfo(tcp, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			v.TCP = tcp
 		case ctaProtoinfoDCCP:
 			dccp := &DCCPInfo{}
-			if err := extractDCCPInfo(dccp, logger, ad.Bytes()); err != nil {
+			if err := extractDCCPInfo(dccp, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			v.DCCP = dccp
 		case ctaProtoinfoSCTP:
 			sctp := &SCTPInfo{}
-			if err := extractSCTPInfo(sctp, logger, ad.Bytes()); err != nil {
+			if err := extractSCTPInfo(sctp, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			v.SCTP = sctp
 		default:
-			logger.Printf("extractProtoInfo(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func marshalProtoInfo(logger *log.Logger, v *ProtoInfo) ([]byte, error) {
+func marshalProtoInfo(logger LeveledLogger, v *ProtoInfo) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
 	if v.TCP != nil {
@@ -455,7 +463,7 @@ func marshalProtoInfo(logger *log.Logger, v *ProtoInfo) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractHelper(v *Helper, logger *log.Logger, data []byte) error {
+func extractHelper(v *Helper, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -470,13 +478,14 @@ func extractHelper(v *Helper, logger *log.Logger, data []byte) error {
 			tmp := ad.String()
 			v.Info = &tmp
 		default:
-			logger.Printf("extractHelper(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func marshalHelper(logger *log.Logger, v *Helper) ([]byte, error) {
+func marshalHelper(logger LeveledLogger, v *Helper) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
 	if v.Name != nil {
@@ -489,7 +498,7 @@ func marshalHelper(logger *log.Logger, v *Helper) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractProtoTuple(logger *log.Logger, data []byte) (ProtoTuple, error) {
+func extractProtoTuple(logger LeveledLogger, u unknown, data []byte) (ProtoTuple, error) {
 	var proto ProtoTuple
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
@@ -526,13 +535,14 @@ func extractProtoTuple(logger *log.Logger, data []byte) (ProtoTuple, error) {
 			tmp := ad.Uint8()
 			proto.Icmpv6Code = &tmp
 		default:
-			logger.Printf("extractProtoTuple(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return proto, ad.Err()
 }
 
-func marshalProtoTuple(logger *log.Logger, v *ProtoTuple) ([]byte, error) {
+func marshalProtoTuple(logger LeveledLogger, v *ProtoTuple) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 	ae.ByteOrder = binary.BigEndian
 	if v.Number != nil {
@@ -566,7 +576,7 @@ func marshalProtoTuple(logger *log.Logger, v *ProtoTuple) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractIP(logger *log.Logger, data []byte) (net.IP, net.IP, error) {
+func extractIP(logger LeveledLogger, u unknown, data []byte) (net.IP, net.IP, error) {
 	var src, dst net.IP
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
@@ -584,13 +594,14 @@ func extractIP(logger *log.Logger, data []byte) (net.IP, net.IP, error) {
 		case ctaIPv6Dst:
 			dst = net.IP(ad.Bytes())
 		default:
-			logger.Printf("extractIP(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return src, dst, ad.Err()
 }
 
-func marshalIP(logger *log.Logger, v *IPTuple) ([]byte, error) {
+func marshalIP(logger LeveledLogger, v *IPTuple) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
 	if v.Src != nil {
@@ -614,7 +625,7 @@ func marshalIP(logger *log.Logger, v *IPTuple) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractIPTuple(v *IPTuple, logger *log.Logger, data []byte) error {
+func extractIPTuple(v *IPTuple, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -623,14 +634,14 @@ func extractIPTuple(v *IPTuple, logger *log.Logger, data []byte) error {
 	for ad.Next() {
 		switch ad.Type() {
 		case ctaTupleIP:
-			src, dst, err := extractIP(logger, ad.Bytes())
+			src, dst, err := extractIP(logger, u.nested(ad.Type()), ad.Bytes())
 			if err != nil {
 				return err
 			}
 			v.Src = &src
 			v.Dst = &dst
 		case ctaTupleProto:
-			proto, err := extractProtoTuple(logger, ad.Bytes())
+			proto, err := extractProtoTuple(logger, u.nested(ad.Type()), ad.Bytes())
 			if err != nil {
 				return err
 			}
@@ -641,13 +652,14 @@ func extractIPTuple(v *IPTuple, logger *log.Logger, data []byte) error {
 			v.Zone = &zone
 			ad.ByteOrder = nativeEndian
 		default:
-			logger.Printf("extractIPTuple(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func marshalIPTuple(logger *log.Logger, v *IPTuple) ([]byte, error) {
+func marshalIPTuple(logger LeveledLogger, v *IPTuple) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
 	if v.Src != nil || v.Dst != nil {
@@ -669,34 +681,35 @@ func marshalIPTuple(logger *log.Logger, v *IPTuple) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractAttribute(c *Con, logger *log.Logger, data []byte) error {
+func extractAttribute(c *Con, logger LeveledLogger, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
 	}
+	u := unknown{attrs: &c.Unknown}
 	for ad.Next() {
 		switch ad.Type() {
 		case ctaTupleOrig:
 			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
+			if err := extractIPTuple(tuple, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.Origin = tuple
 		case ctaTupleReply:
 			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
+			if err := extractIPTuple(tuple, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.Reply = tuple
 		case ctaProtoinfo:
 			protoInfo := &ProtoInfo{}
-			if err := extractProtoInfo(protoInfo, logger, ad.Bytes()); err != nil {
+			if err := extractProtoInfo(protoInfo, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.ProtoInfo = protoInfo
 		case ctaHelp:
 			help := &Helper{}
-			if err := extractHelper(help, logger, ad.Bytes()); err != nil {
+			if err := extractHelper(help, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.Helper = help
@@ -732,25 +745,25 @@ func extractAttribute(c *Con, logger *log.Logger, data []byte) error {
 			ad.ByteOrder = nativeEndian
 		case ctaCountersOrig:
 			orig := &Counter{}
-			if err := extractCounter(orig, logger, ad.Bytes()); err != nil {
+			if err := extractCounter(orig, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.CounterOrigin = orig
 		case ctaCountersReply:
 			reply := &Counter{}
-			if err := extractCounter(reply, logger, ad.Bytes()); err != nil {
+			if err := extractCounter(reply, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.CounterReply = reply
 		case ctaSeqAdjOrig:
 			orig := &SeqAdj{}
-			if err := extractSeqAdj(orig, logger, ad.Bytes()); err != nil {
+			if err := extractSeqAdj(orig, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.SeqAdjOrig = orig
 		case ctaSeqAdjRepl:
 			reply := &SeqAdj{}
-			if err := extractSeqAdj(reply, logger, ad.Bytes()); err != nil {
+			if err := extractSeqAdj(reply, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.SeqAdjRepl = reply
@@ -761,19 +774,19 @@ func extractAttribute(c *Con, logger *log.Logger, data []byte) error {
 			ad.ByteOrder = nativeEndian
 		case ctaSecCtx:
 			secCtx := &SecCtx{}
-			if err := extractSecCtx(secCtx, logger, ad.Bytes()); err != nil {
+			if err := extractSecCtx(secCtx, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.SecCtx = secCtx
 		case ctaTimestamp:
 			ts := &Timestamp{}
-			if err := extractTimestamp(ts, logger, ad.Bytes()); err != nil {
+			if err := extractTimestamp(ts, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.Timestamp = ts
 		case ctaNatSrc:
 			nat := &Nat{}
-			if err := extractNat(nat, logger, ad.Bytes()); err != nil {
+			if err := extractNat(nat, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.NatSrc = nat
@@ -783,7 +796,8 @@ func extractAttribute(c *Con, logger *log.Logger, data []byte) error {
 			c.StatusMask = &tmp
 			ad.ByteOrder = nativeEndian
 		default:
-			logger.Printf("extractAttribute() - Unknown attribute: %d %d %v\n", ad.Type()&0xFF, ad.Type(), ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
@@ -796,7 +810,7 @@ func checkHeader(data []byte) int {
 	return 0
 }
 
-func extractAttributes(logger *log.Logger, c *Con, msg []byte) error {
+func extractAttributes(logger LeveledLogger, c *Con, msg []byte) error {
 	offset := checkHeader(msg[:2])
 	if err := extractAttribute(c, logger, msg[offset:]); err != nil {
 		return err
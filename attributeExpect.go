@@ -2,7 +2,6 @@ package conntrack
 
 import (
 	"encoding/binary"
-	"log"
 
 	"github.com/mdlayher/netlink"
 )
@@ -28,7 +27,7 @@ const (
 	ctaExpNatTuple
 )
 
-func extractNatInfo(v *NatInfo, logger *log.Logger, data []byte) error {
+func extractNatInfo(v *NatInfo, logger LeveledLogger, u unknown, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -43,18 +42,19 @@ func extractNatInfo(v *NatInfo, logger *log.Logger, data []byte) error {
 			ad.ByteOrder = nativeEndian
 		case ctaExpNatTuple:
 			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
+			if err := extractIPTuple(tuple, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			v.Tuple = tuple
 		default:
-			logger.Printf("extractNatInfo(): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func marshalNatInfo(logger *log.Logger, v *NatInfo) ([]byte, error) {
+func marshalNatInfo(logger LeveledLogger, v *NatInfo) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
 	if v.Dir != nil {
@@ -73,11 +73,12 @@ func marshalNatInfo(logger *log.Logger, v *NatInfo) ([]byte, error) {
 	return ae.Encode()
 }
 
-func extractAttributeExpect(c *Con, logger *log.Logger, data []byte) error {
+func extractAttributeExpect(c *Con, logger LeveledLogger, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
 	}
+	u := unknown{attrs: &c.Unknown}
 
 	c.Exp = &Exp{}
 
@@ -85,19 +86,19 @@ func extractAttributeExpect(c *Con, logger *log.Logger, data []byte) error {
 		switch ad.Type() {
 		case ctaExpMaster:
 			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
+			if err := extractIPTuple(tuple, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.Origin = tuple
 		case ctaExpTuple:
 			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
+			if err := extractIPTuple(tuple, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.Exp.Tuple = tuple
 		case ctaExpMask:
 			tuple := &IPTuple{}
-			if err := extractIPTuple(tuple, logger, ad.Bytes()); err != nil {
+			if err := extractIPTuple(tuple, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.Exp.Mask = tuple
@@ -131,7 +132,7 @@ func extractAttributeExpect(c *Con, logger *log.Logger, data []byte) error {
 			ad.ByteOrder = nativeEndian
 		case ctaExpNat:
 			tmp := &NatInfo{}
-			if err := extractNatInfo(tmp, logger, ad.Bytes()); err != nil {
+			if err := extractNatInfo(tmp, logger, u.nested(ad.Type()), ad.Bytes()); err != nil {
 				return err
 			}
 			c.Exp.Nat = tmp
@@ -139,13 +140,14 @@ func extractAttributeExpect(c *Con, logger *log.Logger, data []byte) error {
 			tmp := ad.String()
 			c.Exp.Fn = &tmp
 		default:
-			logger.Printf("extractAttributeExpect() - Unknown attribute: %d %d %v\n", ad.Type()&0xFF, ad.Type(), ad.Bytes())
+			logger.Debug("unknown attribute", "path", u.path, "type", ad.Type(), "data", ad.Bytes())
+			u.add(ad)
 		}
 	}
 	return ad.Err()
 }
 
-func extractExpectAttributes(logger *log.Logger, c *Con, msg []byte) error {
+func extractExpectAttributes(logger LeveledLogger, c *Con, msg []byte) error {
 	offset := checkHeader(msg[:2])
 	if err := extractAttributeExpect(c, logger, msg[offset:]); err != nil {
 		return err
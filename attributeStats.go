@@ -2,7 +2,6 @@ package conntrack
 
 import (
 	"encoding/binary"
-	"log"
 
 	"github.com/mdlayher/netlink"
 )
@@ -31,7 +30,7 @@ const (
 	ctaStatsExpDelete
 )
 
-func extractCPUStats(s *CPUStat, logger *log.Logger, data []byte) error {
+func extractCPUStats(s *CPUStat, logger LeveledLogger, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -71,13 +70,13 @@ func extractCPUStats(s *CPUStat, logger *log.Logger, data []byte) error {
 			tmp := ad.Uint32()
 			s.SearchRestart = &tmp
 		default:
-			logger.Printf("extractCPUStats()): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "type", ad.Type(), "data", ad.Bytes())
 		}
 	}
 	return ad.Err()
 }
 
-func extractExpCPUStats(s *CPUStat, logger *log.Logger, data []byte) error {
+func extractExpCPUStats(s *CPUStat, logger LeveledLogger, data []byte) error {
 	ad, err := netlink.NewAttributeDecoder(data)
 	if err != nil {
 		return err
@@ -99,7 +98,7 @@ func extractExpCPUStats(s *CPUStat, logger *log.Logger, data []byte) error {
 			tmp := ad.Uint32()
 			s.ExpDelete = &tmp
 		default:
-			logger.Printf("extractExpCPUStats()): %d | %d\t %v", ad.Type(), ad.Type()&0xFF, ad.Bytes())
+			logger.Debug("unknown attribute", "type", ad.Type(), "data", ad.Bytes())
 		}
 	}
 	return ad.Err()
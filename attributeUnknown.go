@@ -0,0 +1,75 @@
+package conntrack
+
+import (
+	"github.com/mdlayher/netlink"
+)
+
+// nlaTypeMask removes the flags from the type of a netlink attribute.
+const nlaTypeMask = 0x3fff
+
+// unknown collects the attributes, that are not supported by this package.
+type unknown struct {
+	// path of the attribute, that is decoded.
+	path  []uint16
+	attrs *[]Attribute
+}
+
+// nested returns the collector for the attributes nested in typ.
+func (u unknown) nested(typ uint16) unknown {
+	path := make([]uint16, len(u.path), len(u.path)+1)
+	copy(path, u.path)
+	return unknown{path: append(path, typ), attrs: u.attrs}
+}
+
+// add collects the current attribute of ad.
+func (u unknown) add(ad *netlink.AttributeDecoder) {
+	if u.attrs == nil {
+		return
+	}
+	*u.attrs = append(*u.attrs, Attribute{
+		Path: append([]uint16(nil), u.path...),
+		Type: ad.Type() | ad.TypeFlags(),
+		Data: append([]byte(nil), ad.Bytes()...),
+	})
+}
+
+// addUnknownAttributes adds attrs to the encoded attributes in data. Nesting
+// attributes of the path are created, if they do not exist.
+func addUnknownAttributes(data []byte, attrs []Attribute) ([]byte, error) {
+	for _, attr := range attrs {
+		var err error
+		if data, err = insertAttribute(data, attr.Path, attr); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func insertAttribute(data []byte, path []uint16, attr Attribute) ([]byte, error) {
+	attrs, err := netlink.UnmarshalAttributes(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) == 0 {
+		attrs = append(attrs, netlink.Attribute{Type: attr.Type, Data: attr.Data})
+		return netlink.MarshalAttributes(attrs)
+	}
+	for i := range attrs {
+		if attrs[i].Type&nlaTypeMask != path[0] {
+			continue
+		}
+		nested, err := insertAttribute(attrs[i].Data, path[1:], attr)
+		if err != nil {
+			return nil, err
+		}
+		attrs[i].Length = 0
+		attrs[i].Data = nested
+		return netlink.MarshalAttributes(attrs)
+	}
+	nested, err := insertAttribute(nil, path[1:], attr)
+	if err != nil {
+		return nil, err
+	}
+	attrs = append(attrs, netlink.Attribute{Type: path[0] | nlafNested, Data: nested})
+	return netlink.MarshalAttributes(attrs)
+}
@@ -0,0 +1,174 @@
+package conntrack
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+)
+
+func TestUnknownAttributes(t *testing.T) {
+	proto, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: ctaProtoNum, Data: []byte{17}},
+		{Type: 42, Data: []byte{0x1, 0x2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: ctaTupleProto | nlafNested, Data: proto},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: 23, Data: []byte{0x3, 0x4, 0x5, 0x6}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: ctaTupleOrig | nlafNested, Data: orig},
+		{Type: ctaCountersOrig | nlafNested, Data: counters},
+		{Type: 99 | nlafNested, Data: []byte{0x8, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	c, err := ParseAttributes(logger, append([]byte{0x2, 0x0, 0x0, 0x0}, attrs...))
+	if err != nil {
+		t.Fatalf("could not parse attributes: %v", err)
+	}
+	want := []Attribute{
+		{Path: []uint16{ctaTupleOrig, ctaTupleProto}, Type: 42, Data: []byte{0x1, 0x2}},
+		{Path: []uint16{ctaCountersOrig}, Type: 23, Data: []byte{0x3, 0x4, 0x5, 0x6}},
+		{Type: 99 | nlafNested, Data: []byte{0x8, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x1}},
+	}
+	if !reflect.DeepEqual(c.Unknown, want) {
+		t.Fatalf("unexpected unknown attributes:\n- want: %#v\n- got: %#v", want, c.Unknown)
+	}
+	if n := strings.Count(buf.String(), "DEBUG unknown attribute"); n != len(want) {
+		t.Fatalf("unexpected number of logged unknown attributes %d:\n%s", n, buf.String())
+	}
+
+	// The unknown attributes are encoded again, also if their path is not
+	// supported by the encoder.
+	data, err := MarshalAttributes(c)
+	if err != nil {
+		t.Fatalf("could not encode attributes: %v", err)
+	}
+	reencoded, err := ParseAttributes(logger, append([]byte{0x2, 0x0, 0x0, 0x0}, data...))
+	if err != nil {
+		t.Fatalf("could not parse encoded attributes: %v", err)
+	}
+	if !reflect.DeepEqual(reencoded.Unknown, want) {
+		t.Fatalf("unexpected unknown attributes after encoding:\n- want: %#v\n- got: %#v", want, reencoded.Unknown)
+	}
+	if reencoded.Origin == nil || reencoded.Origin.Proto == nil || *reencoded.Origin.Proto.Number != 17 {
+		t.Fatalf("unexpected origin: %#v", reencoded.Origin)
+	}
+}
+
+func TestUnknownAttributesNotSent(t *testing.T) {
+	master, err := MarshalAttributes(testCon("10.0.0.2", 21, 0))
+	if err != nil {
+		t.Fatalf("could not encode master: %v", err)
+	}
+	entry := testCon("10.0.0.1", 22, 0)
+	entry.Unknown = []Attribute{{Type: ctaTupleMaster | nlafNested, Data: master}}
+	reply, err := MarshalAttributes(entry)
+	if err != nil {
+		t.Fatalf("could not encode entry: %v", err)
+	}
+
+	var updates []netlink.Message
+	sock := newEventSocket()
+	sock.handler = func(req netlink.Message) []netlink.Message {
+		if req.Header.Flags&netlink.Dump == netlink.Dump {
+			return []netlink.Message{{
+				Header: netlink.Header{Type: netlink.HeaderType(1 << 8), Sequence: req.Header.Sequence},
+				Data:   append([]byte{0x2, 0x0, 0x0, 0x0}, reply...),
+			}}
+		}
+		updates = append(updates, req)
+		return []netlink.Message{{
+			Header: netlink.Header{Type: netlink.Error, Sequence: req.Header.Sequence},
+			Data:   make([]byte, 4+16),
+		}}
+	}
+	nfct := &Nfct{Con: netlink.NewConn(sock, 1), logger: newStdLogger(nil)}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	defer nfct.Close()
+
+	cons, err := nfct.Dump(Conntrack, IPv4)
+	if err != nil {
+		t.Fatalf("could not dump entries: %v", err)
+	}
+	if len(cons) != 1 || len(cons[0].Unknown) != 1 {
+		t.Fatalf("unexpected entries: %#v", cons)
+	}
+	mark := uint32(1)
+	cons[0].Mark = &mark
+	if err := nfct.Update(Conntrack, IPv4, cons[0]); err != nil {
+		t.Fatalf("could not update entry: %v", err)
+	}
+
+	if len(updates) != 1 {
+		t.Fatalf("unexpected number of requests: %d", len(updates))
+	}
+	attrs, err := netlink.UnmarshalAttributes(updates[0].Data[4:])
+	if err != nil {
+		t.Fatalf("could not decode request: %v", err)
+	}
+	for _, attr := range attrs {
+		if attr.Type&nlaTypeMask == ctaTupleMaster {
+			t.Fatalf("CTA_TUPLE_MASTER was sent: %#v", attr)
+		}
+	}
+}
+
+func TestUnknownAttributesSent(t *testing.T) {
+	entry := testCon("10.0.0.1", 22, 0)
+	entry.Unknown = []Attribute{{Type: 99, Data: []byte{0x1, 0x2, 0x3, 0x4}}}
+
+	for name, send := range map[string]bool{"opt-in": true, "default": false} {
+		t.Run(name, func(t *testing.T) {
+			var reqs []netlink.Message
+			sock := newEventSocket()
+			sock.handler = func(req netlink.Message) []netlink.Message {
+				reqs = append(reqs, req)
+				return []netlink.Message{{
+					Header: netlink.Header{Type: netlink.Error, Sequence: req.Header.Sequence},
+					Data:   make([]byte, 4+16),
+				}}
+			}
+			nfct := &Nfct{Con: netlink.NewConn(sock, 1), logger: newStdLogger(nil), sendUnknownAttributes: send}
+			AdjustWriteTimeout(nfct, func() error { return nil })
+			defer nfct.Close()
+
+			if err := nfct.Create(Conntrack, IPv4, entry); err != nil {
+				t.Fatalf("could not create entry: %v", err)
+			}
+			if len(reqs) != 1 {
+				t.Fatalf("unexpected number of requests: %d", len(reqs))
+			}
+			c, err := ParseAttributes(nil, reqs[0].Data)
+			if err != nil {
+				t.Fatalf("could not decode request: %v", err)
+			}
+			var want []Attribute
+			if send {
+				want = entry.Unknown
+			}
+			if !reflect.DeepEqual(c.Unknown, want) {
+				t.Fatalf("unexpected unknown attributes: %#v", c.Unknown)
+			}
+		})
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/florianl/go-conntrack/internal/bpfvm"
 	"github.com/florianl/go-conntrack/internal/unix"
+	"github.com/mdlayher/netlink"
 	"golang.org/x/net/bpf"
 )
 
@@ -30,10 +32,27 @@ const (
 	bpfVerdictReject = 0x00000000
 )
 
+// status bits of a connection, that are set for NAT
+const (
+	ipsSrcNat = 1 << 4
+	ipsDstNat = 1 << 5
+)
+
 type filterCheckStruct struct {
 	ct, len int
 	mask    bool
 	nest    []uint32
+
+	// expr marks attributes, that are only supported by filter expressions.
+	expr bool
+	// off is the offset of the value in the data of the attribute.
+	off int
+	// variable marks values of variable length, str values terminated by NUL.
+	variable, str bool
+	// family compares the value with the family of the message.
+	family bool
+	// status contains bits, that have to be set in the status of the connection.
+	status uint32
 }
 
 var filterCheck = map[ConnAttrType]filterCheckStruct{
@@ -55,15 +74,15 @@ var filterCheck = map[ConnAttrType]filterCheckStruct{
 	AttrIcmpv6Type:              {ct: ctaProtoIcmpv6Type, len: 1, nest: []uint32{ctaTupleOrig, ctaTupleProto}},
 	AttrIcmpv6Code:              {ct: ctaProtoIcmpv6Code, len: 1, nest: []uint32{ctaTupleOrig, ctaTupleProto}},
 	AttrIcmpv6ID:                {ct: ctaProtoIcmpv6ID, len: 2, nest: []uint32{ctaTupleOrig, ctaTupleProto}},
-	AttrOrigL3Proto:             {ct: ctaUnspec},
-	AttrReplL3Proto:             {ct: ctaUnspec},
+	AttrOrigL3Proto:             {len: 1, family: true, expr: true},
+	AttrReplL3Proto:             {len: 1, family: true, expr: true},
 	AttrOrigL4Proto:             {ct: ctaProtoNum, len: 1, nest: []uint32{ctaTupleOrig, ctaTupleProto}},
 	AttrReplL4Proto:             {ct: ctaProtoNum, len: 1, nest: []uint32{ctaTupleReply, ctaTupleProto}},
 	AttrTCPState:                {ct: ctaProtoinfoTCPState, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
-	AttrSNatIPv4:                {ct: ctaUnspec},
-	AttrDNatIPv4:                {ct: ctaUnspec},
-	AttrSNatPort:                {ct: ctaUnspec},
-	AttrDNatPort:                {ct: ctaUnspec},
+	AttrSNatIPv4:                {ct: ctaIPv4Dst, len: 4, mask: true, nest: []uint32{ctaTupleReply, ctaTupleIP}, status: ipsSrcNat, expr: true},
+	AttrDNatIPv4:                {ct: ctaIPv4Src, len: 4, mask: true, nest: []uint32{ctaTupleReply, ctaTupleIP}, status: ipsDstNat, expr: true},
+	AttrSNatPort:                {ct: ctaProtoDstPort, len: 2, nest: []uint32{ctaTupleReply, ctaTupleProto}, status: ipsSrcNat, expr: true},
+	AttrDNatPort:                {ct: ctaProtoSrcPort, len: 2, nest: []uint32{ctaTupleReply, ctaTupleProto}, status: ipsDstNat, expr: true},
 	AttrTimeout:                 {ct: ctaTimeout, len: 4},
 	AttrMark:                    {ct: ctaMark, len: 4, mask: true},
 	AttrMarkMask:                {ct: ctaMarkMask, len: 4},
@@ -76,16 +95,16 @@ var filterCheck = map[ConnAttrType]filterCheckStruct{
 	AttrStatus:                  {ct: ctaStatus, len: 4},
 	AttrTCPFlagsOrig:            {ct: ctaProtoinfoTCPFlagsOrig, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
 	AttrTCPFlagsRepl:            {ct: ctaProtoinfoTCPFlagsRepl, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
-	AttrTCPMaskOrig:             {ct: ctaUnspec},
-	AttrTCPMaskRepl:             {ct: ctaUnspec},
-	AttrMasterIPv4Src:           {ct: ctaUnspec},
-	AttrMasterIPv4Dst:           {ct: ctaUnspec},
-	AttrMasterIPv6Src:           {ct: ctaUnspec},
-	AttrMasterIPv6Dst:           {ct: ctaUnspec},
-	AttrMasterPortSrc:           {ct: ctaUnspec},
-	AttrMasterPortDst:           {ct: ctaUnspec},
-	AttrMasterL3Proto:           {ct: ctaUnspec},
-	AttrMasterL4Proto:           {ct: ctaUnspec},
+	AttrTCPMaskOrig:             {ct: ctaProtoinfoTCPFlagsOrig, len: 1, off: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}, expr: true},
+	AttrTCPMaskRepl:             {ct: ctaProtoinfoTCPFlagsRepl, len: 1, off: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}, expr: true},
+	AttrMasterIPv4Src:           {ct: ctaIPv4Src, len: 4, mask: true, nest: []uint32{ctaTupleMaster, ctaTupleIP}, expr: true},
+	AttrMasterIPv4Dst:           {ct: ctaIPv4Dst, len: 4, mask: true, nest: []uint32{ctaTupleMaster, ctaTupleIP}, expr: true},
+	AttrMasterIPv6Src:           {ct: ctaIPv6Src, len: 16, mask: true, nest: []uint32{ctaTupleMaster, ctaTupleIP}, expr: true},
+	AttrMasterIPv6Dst:           {ct: ctaIPv6Dst, len: 16, mask: true, nest: []uint32{ctaTupleMaster, ctaTupleIP}, expr: true},
+	AttrMasterPortSrc:           {ct: ctaProtoSrcPort, len: 2, nest: []uint32{ctaTupleMaster, ctaTupleProto}, expr: true},
+	AttrMasterPortDst:           {ct: ctaProtoDstPort, len: 2, nest: []uint32{ctaTupleMaster, ctaTupleProto}, expr: true},
+	AttrMasterL3Proto:           {ct: ctaTupleMaster, len: 1, family: true, expr: true},
+	AttrMasterL4Proto:           {ct: ctaProtoNum, len: 1, nest: []uint32{ctaTupleMaster, ctaTupleProto}, expr: true},
 	AttrSecmark:                 {ct: ctaSecmark, len: 4},
 	AttrOrigNatSeqCorrectionPos: {ct: ctaUnspec},
 	AttrOrigNatSeqOffsetBefore:  {ct: ctaUnspec},
@@ -101,16 +120,55 @@ var filterCheck = map[ConnAttrType]filterCheckStruct{
 	AttrTCPWScaleOrig:           {ct: ctaProtoinfoTCPWScaleOrig, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
 	AttrTCPWScaleRepl:           {ct: ctaProtoinfoTCPWScaleRepl, len: 1, nest: []uint32{ctaProtoinfo, ctaProtoinfoTCP}},
 	AttrZone:                    {ct: ctaZone, len: 2},
-	AttrSecCtx:                  {ct: ctaUnspec},
+	AttrSecCtx:                  {ct: ctaSecCtxName, variable: true, str: true, nest: []uint32{ctaSecCtx}, expr: true},
 	AttrTimestampStart:          {ct: ctaTimestampStart, len: 8, nest: []uint32{ctaTimestamp}},
 	AttrTimestampStop:           {ct: ctaTimestampStop, len: 8, nest: []uint32{ctaTimestamp}},
-	AttrHelperInfo:              {ct: ctaUnspec},
-	AttrConnlabels:              {ct: ctaUnspec},
+	AttrHelperName:              {ct: ctaHelpName, variable: true, str: true, nest: []uint32{ctaHelp}, expr: true},
+	AttrHelperInfo:              {ct: ctaHelpInfo, variable: true, nest: []uint32{ctaHelp}, expr: true},
+	AttrConnlabels:              {ct: ctaLables, variable: true, expr: true},
 	AttrConnlabelsMask:          {ct: ctaUnspec},
-	AttrOrigzone:                {ct: ctaUnspec},
-	AttrReplzone:                {ct: ctaUnspec},
-	AttrSNatIPv6:                {ct: ctaUnspec},
-	AttrDNatIPv6:                {ct: ctaUnspec},
+	AttrOrigzone:                {ct: ctaTupleZone, len: 2, nest: []uint32{ctaTupleOrig}, expr: true},
+	AttrReplzone:                {ct: ctaTupleZone, len: 2, nest: []uint32{ctaTupleReply}, expr: true},
+	AttrSNatIPv6:                {ct: ctaIPv6Dst, len: 16, mask: true, nest: []uint32{ctaTupleReply, ctaTupleIP}, status: ipsSrcNat, expr: true},
+	AttrDNatIPv6:                {ct: ctaIPv6Src, len: 16, mask: true, nest: []uint32{ctaTupleReply, ctaTupleIP}, status: ipsDstNat, expr: true},
+}
+
+// filterCheckExpect describes the attributes of messages of the Expected
+// subsystem. The master tuple is filtered by the AttrMaster types and the
+// expected tuple by the AttrOrig types.
+var filterCheckExpect = map[ConnAttrType]filterCheckStruct{
+	AttrOrigIPv4Src:   {ct: ctaIPv4Src, len: 4, mask: true, nest: []uint32{ctaExpTuple, ctaTupleIP}},
+	AttrOrigIPv4Dst:   {ct: ctaIPv4Dst, len: 4, mask: true, nest: []uint32{ctaExpTuple, ctaTupleIP}},
+	AttrOrigIPv6Src:   {ct: ctaIPv6Src, len: 16, mask: true, nest: []uint32{ctaExpTuple, ctaTupleIP}},
+	AttrOrigIPv6Dst:   {ct: ctaIPv6Dst, len: 16, mask: true, nest: []uint32{ctaExpTuple, ctaTupleIP}},
+	AttrOrigPortSrc:   {ct: ctaProtoSrcPort, len: 2, nest: []uint32{ctaExpTuple, ctaTupleProto}},
+	AttrOrigPortDst:   {ct: ctaProtoDstPort, len: 2, nest: []uint32{ctaExpTuple, ctaTupleProto}},
+	AttrOrigL3Proto:   {len: 1, family: true},
+	AttrOrigL4Proto:   {ct: ctaProtoNum, len: 1, nest: []uint32{ctaExpTuple, ctaTupleProto}},
+	AttrMasterIPv4Src: {ct: ctaIPv4Src, len: 4, mask: true, nest: []uint32{ctaExpMaster, ctaTupleIP}},
+	AttrMasterIPv4Dst: {ct: ctaIPv4Dst, len: 4, mask: true, nest: []uint32{ctaExpMaster, ctaTupleIP}},
+	AttrMasterIPv6Src: {ct: ctaIPv6Src, len: 16, mask: true, nest: []uint32{ctaExpMaster, ctaTupleIP}},
+	AttrMasterIPv6Dst: {ct: ctaIPv6Dst, len: 16, mask: true, nest: []uint32{ctaExpMaster, ctaTupleIP}},
+	AttrMasterPortSrc: {ct: ctaProtoSrcPort, len: 2, nest: []uint32{ctaExpMaster, ctaTupleProto}},
+	AttrMasterPortDst: {ct: ctaProtoDstPort, len: 2, nest: []uint32{ctaExpMaster, ctaTupleProto}},
+	AttrMasterL3Proto: {len: 1, family: true},
+	AttrMasterL4Proto: {ct: ctaProtoNum, len: 1, nest: []uint32{ctaExpMaster, ctaTupleProto}},
+	AttrTimeout:       {ct: ctaExpTimeout, len: 4},
+	AttrZone:          {ct: ctaExpZone, len: 2},
+	AttrHelperName:    {ct: ctaExpHelpName, variable: true, str: true},
+	AttrExpID:         {ct: ctaExpID, len: 4},
+	AttrExpFlags:      {ct: ctaExpFlags, len: 4},
+	AttrExpClass:      {ct: ctaExpClass, len: 4},
+	AttrExpNATDir:     {ct: ctaExpNatDir, len: 4, nest: []uint32{ctaExpNat}},
+}
+
+// filterChecks returns the description of the attributes of messages of
+// subsys.
+func filterChecks(subsys Table) map[ConnAttrType]filterCheckStruct {
+	if subsys == Expected {
+		return filterCheckExpect
+	}
+	return filterCheck
 }
 
 func encodeValue(data []byte) (val uint32) {
@@ -392,23 +450,85 @@ func filterMarkAttribute(filters []ConnAttr) []bpf.RawInstruction {
 	return raw
 }
 
-func (nfct *Nfct) attachFilter(subsys Table, filters []ConnAttr) error {
-	bpfFilters, err := constructFilter(subsys, filters)
+// attachFilter attaches the BPF filter of filters and expr to con. If the
+// filter exceeds the limit of instructions of the kernel, it is not attached
+// and the returned VM has to be used to filter the messages in userspace.
+func (nfct *Nfct) attachFilter(con *netlink.Conn, subsys Table, filters []ConnAttr, expr FilterExpr) (*bpfvm.VM, error) {
+	bpfFilters, err := buildFilter(subsys, filters, expr)
+	if errors.Is(err, ErrFilterLength) {
+		return nfct.userspaceFilter(subsys, filters, expr)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if nfct.debug {
-		fmtInstructions := fmtRawInstructions(bpfFilters)
-		nfct.logger.Println("---BPF filter start---")
-		nfct.logger.Print(fmtInstructions)
-		nfct.logger.Println("---BPF filter end---")
+	if nfct.debugEnabled() {
+		nfct.logger.Debug("attach BPF filter", "table", subsys, "instructions", fmtRawInstructions(bpfFilters))
 	}
 
-	return nfct.Con.SetBPF(bpfFilters)
+	return nil, con.SetBPF(bpfFilters)
 }
 
-func (nfct *Nfct) removeFilter() error {
-	return nfct.Con.RemoveBPF()
+// userspaceFilter returns the VM, that runs the BPF filter of filters and expr
+// without the limit of instructions of the kernel.
+func (nfct *Nfct) userspaceFilter(subsys Table, filters []ConnAttr, expr FilterExpr) (*bpfvm.VM, error) {
+	expr, err := combineFilter(filters, expr)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := compileProgram(subsys, expr)
+	if err != nil {
+		return nil, err
+	}
+	nfct.logger.Info("BPF filter exceeds the limit of the kernel, filtering in userspace", "table", subsys, "instructions", len(prog))
+	return bpfvm.NewWithLimit(prog, 0)
+}
+
+// buildFilter returns the BPF filter for filters and expr, which are linked by
+// an AND operation.
+func buildFilter(subsys Table, filters []ConnAttr, expr FilterExpr) ([]bpf.RawInstruction, error) {
+	if expr == nil {
+		// constructFilter only supports the attributes of the Conntrack
+		// subsystem.
+		legacy := subsys != Expected
+		for _, filter := range filters {
+			if filterCheck[filter.Type].expr {
+				legacy = false
+			}
+		}
+		if legacy {
+			raw, err := constructFilter(subsys, filters)
+			if !errors.Is(err, ErrFilterLength) {
+				return raw, err
+			}
+			// The linear comparisons of constructFilter are too long, but
+			// the binary search of compileExpr might fit.
+		}
+	}
+	expr, err := combineFilter(filters, expr)
+	if err != nil {
+		return nil, err
+	}
+	return compileExpr(subsys, expr)
+}
+
+// combineFilter returns the FilterExpr of filters and expr, which are linked
+// by an AND operation.
+func combineFilter(filters []ConnAttr, expr FilterExpr) (FilterExpr, error) {
+	if expr == nil {
+		expr = andExpr{}
+	}
+	if len(filters) == 0 {
+		return expr, nil
+	}
+	legacy, err := filterToExpr(filters)
+	if err != nil {
+		return nil, err
+	}
+	return andExpr{legacy, expr}, nil
+}
+
+func (nfct *Nfct) removeFilter(con *netlink.Conn) error {
+	return con.RemoveBPF()
 }
 
 func fmtRawInstruction(raw bpf.RawInstruction) string {
@@ -429,35 +549,65 @@ func fmtRawInstructions(raw []bpf.RawInstruction) string {
 	return output.String()
 }
 
-// From libnetfilter_conntrack:src/conntrack/bsf.c
+// code2str returns the name of op in the style of
+// libnetfilter_conntrack:src/conntrack/bsf.c.
 func code2str(op uint16) string {
-	switch op {
-	case unix.BPF_LD | unix.BPF_IMM:
-		return "BPF_LD|BPF_IMM"
-	case unix.BPF_LDX | unix.BPF_IMM:
-		return "BPF_LDX|BPF_IMM"
-	case unix.BPF_LD | unix.BPF_B | unix.BPF_ABS:
-		return "BPF_LD|BPF_B|BPF_ABS"
-	case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
-		return "BPF_JMP|BPF_JEQ|BPF_K"
-	case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
-		return "BPF_ALU|BPF_AND|BPF_K"
-	case unix.BPF_JMP | unix.BPF_JA:
-		return "BPF_JMP|BPF_JA"
-	case unix.BPF_RET | unix.BPF_K:
-		return "BPF_RET|BPF_K"
-	case unix.BPF_ALU | unix.BPF_ADD | unix.BPF_K:
-		return "BPF_ALU|BPF_ADD|BPF_K"
-	case unix.BPF_MISC | unix.BPF_TAX:
-		return "BPF_MISC|BPF_TAX"
-	case unix.BPF_MISC | unix.BPF_TXA:
-		return "BPF_MISC|BPF_TXA"
-	case unix.BPF_LD | unix.BPF_B | unix.BPF_IND:
-		return "BPF_LD|BPF_B|BPF_IND"
-	case unix.BPF_LD | unix.BPF_H | unix.BPF_IND:
-		return "BPF_LD|BPF_H|BPF_IND"
-	case unix.BPF_LD | unix.BPF_W | unix.BPF_IND:
-		return "BPF_LD|BPF_W|BPF_IND"
+	classes := map[uint16]string{
+		unix.BPF_LD: "BPF_LD", unix.BPF_LDX: "BPF_LDX", unix.BPF_ST: "BPF_ST", unix.BPF_STX: "BPF_STX",
+		unix.BPF_ALU: "BPF_ALU", unix.BPF_JMP: "BPF_JMP", unix.BPF_RET: "BPF_RET", unix.BPF_MISC: "BPF_MISC",
+	}
+	sizes := map[uint16]string{unix.BPF_W: "BPF_W", unix.BPF_H: "BPF_H", unix.BPF_B: "BPF_B"}
+	modes := map[uint16]string{
+		unix.BPF_IMM: "BPF_IMM", unix.BPF_ABS: "BPF_ABS", unix.BPF_IND: "BPF_IND",
+		unix.BPF_MEM: "BPF_MEM", unix.BPF_LEN: "BPF_LEN", unix.BPF_MSH: "BPF_MSH",
+	}
+	aluOps := map[uint16]string{
+		unix.BPF_ADD: "BPF_ADD", unix.BPF_SUB: "BPF_SUB", unix.BPF_MUL: "BPF_MUL", unix.BPF_DIV: "BPF_DIV",
+		unix.BPF_OR: "BPF_OR", unix.BPF_AND: "BPF_AND", unix.BPF_LSH: "BPF_LSH", unix.BPF_RSH: "BPF_RSH",
+		unix.BPF_NEG: "BPF_NEG", unix.BPF_MOD: "BPF_MOD", unix.BPF_XOR: "BPF_XOR",
+	}
+	jmpOps := map[uint16]string{
+		unix.BPF_JA: "BPF_JA", unix.BPF_JEQ: "BPF_JEQ", unix.BPF_JGT: "BPF_JGT",
+		unix.BPF_JGE: "BPF_JGE", unix.BPF_JSET: "BPF_JSET",
+	}
+	sources := map[uint16]string{unix.BPF_K: "BPF_K", unix.BPF_X: "BPF_X"}
+
+	class := op & 0x07
+	parts := []string{classes[class]}
+	var ok bool
+	switch class {
+	case unix.BPF_LD, unix.BPF_LDX:
+		mode := op & 0xe0
+		if mode == unix.BPF_ABS || mode == unix.BPF_IND || mode == unix.BPF_MSH {
+			parts = append(parts, sizes[op&0x18])
+		}
+		ok = op&^0xf8 == class && sizes[op&0x18] != "" && modes[mode] != ""
+		parts = append(parts, modes[mode])
+	case unix.BPF_ST, unix.BPF_STX:
+		ok = op == class
+	case unix.BPF_ALU:
+		ok = op&^0xf8 == class && aluOps[op&0xf0] != ""
+		parts = append(parts, aluOps[op&0xf0])
+		if op&0xf0 != unix.BPF_NEG {
+			parts = append(parts, sources[op&0x08])
+		}
+	case unix.BPF_JMP:
+		ok = op&^0xf8 == class && jmpOps[op&0xf0] != ""
+		parts = append(parts, jmpOps[op&0xf0])
+		if op&0xf0 != unix.BPF_JA {
+			parts = append(parts, sources[op&0x08])
+		}
+	case unix.BPF_RET:
+		rval := map[uint16]string{unix.BPF_K: "BPF_K", unix.BPF_X: "BPF_X", unix.BPF_A: "BPF_A"}[op&0x18]
+		ok = op&^0x18 == class && rval != ""
+		parts = append(parts, rval)
+	case unix.BPF_MISC:
+		misc := map[uint16]string{unix.BPF_TAX: "BPF_TAX", unix.BPF_TXA: "BPF_TXA"}[op&0xf8]
+		ok = misc != ""
+		parts = append(parts, misc)
+	}
+	if !ok {
+		return "UNKNOWN_INSTRUCTION"
 	}
-	return "UNKNOWN_INSTRUCTION"
+	return strings.Join(parts, "|")
 }
@@ -0,0 +1,644 @@
+package conntrack
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+	"golang.org/x/net/bpf"
+)
+
+// BPF extensions to find netlink attributes
+const (
+	// SKF_AD_OFF + SKF_AD_NLATTR
+	bpfNlattr = 0xfffff00c
+	// SKF_AD_OFF + SKF_AD_NLATTR_NEST
+	bpfNlattrNest = 0xfffff010
+	// SKF_AD_OFF + SKF_AD_RANDOM
+	bpfRandom = 0xfffff038
+)
+
+// label is a symbolic target of a jump, that is resolved by assemble.
+type label int
+
+// instruction of a program. Conditional jumps and BPF_JA jump to labels.
+type instruction struct {
+	raw    bpf.RawInstruction
+	jt, jf label
+}
+
+// program is a BPF program with symbolic jump targets.
+type program struct {
+	ins []instruction
+	// labels contains the index of the instruction, that follows a label.
+	labels []int
+	// checks describe the attributes of the messages of the subsystem.
+	checks map[ConnAttrType]filterCheckStruct
+}
+
+func isJump(op uint16) bool {
+	return op&0x07 == unix.BPF_JMP
+}
+
+func isConditional(op uint16) bool {
+	return isJump(op) && op&0xf0 != unix.BPF_JA
+}
+
+// newLabel returns a label, that is placed by mark.
+func (p *program) newLabel() label {
+	p.labels = append(p.labels, -1)
+	return label(len(p.labels) - 1)
+}
+
+// mark places l in front of the next instruction.
+func (p *program) mark(l label) {
+	p.labels[l] = len(p.ins)
+}
+
+func (p *program) emit(raw bpf.RawInstruction) {
+	p.ins = append(p.ins, instruction{raw: raw})
+}
+
+// jump emits a conditional jump to jt or jf.
+func (p *program) jump(raw bpf.RawInstruction, jt, jf label) {
+	p.ins = append(p.ins, instruction{raw: raw, jt: jt, jf: jf})
+}
+
+// ja emits an unconditional jump to l.
+func (p *program) ja(l label) {
+	p.ins = append(p.ins, instruction{raw: bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JA}, jt: l})
+}
+
+// assemble resolves the labels of p. Conditional jumps can skip at most 255
+// instructions. Jumps to labels, that are further away, are replaced by a
+// conditional jump to two BPF_JA.
+func (p *program) assemble() ([]bpf.RawInstruction, error) {
+	long := make([]bool, len(p.ins))
+	pos := make([]int, len(p.ins)+1)
+	target := func(l label) int {
+		return pos[p.labels[l]]
+	}
+	for {
+		for i, ins := range p.ins {
+			pos[i+1] = pos[i] + 1
+			if long[i] {
+				pos[i+1] += 2
+			}
+			if isJump(ins.raw.Op) && p.labels[ins.jt] < 0 {
+				return nil, fmt.Errorf("jump to unknown label %d", ins.jt)
+			}
+			if isConditional(ins.raw.Op) && p.labels[ins.jf] < 0 {
+				return nil, fmt.Errorf("jump to unknown label %d", ins.jf)
+			}
+		}
+		changed := false
+		for i, ins := range p.ins {
+			if long[i] || !isConditional(ins.raw.Op) {
+				continue
+			}
+			if target(ins.jt)-pos[i]-1 > 0xff || target(ins.jf)-pos[i]-1 > 0xff {
+				long[i] = true
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	raw := make([]bpf.RawInstruction, 0, pos[len(p.ins)])
+	for i, ins := range p.ins {
+		switch {
+		case !isJump(ins.raw.Op):
+			raw = append(raw, ins.raw)
+		case !isConditional(ins.raw.Op):
+			ins.raw.K = uint32(target(ins.jt) - pos[i] - 1)
+			raw = append(raw, ins.raw)
+		case long[i]:
+			ins.raw.Jt, ins.raw.Jf = 0, 1
+			raw = append(raw, ins.raw,
+				bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JA, K: uint32(target(ins.jt) - pos[i] - 2)},
+				bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JA, K: uint32(target(ins.jf) - pos[i] - 3)})
+		default:
+			ins.raw.Jt = uint8(target(ins.jt) - pos[i] - 1)
+			ins.raw.Jf = uint8(target(ins.jf) - pos[i] - 1)
+			raw = append(raw, ins.raw)
+		}
+	}
+	return raw, nil
+}
+
+// compileExpr returns the BPF filter of expr for messages of subsys. Messages
+// of other subsystems are accepted.
+func compileExpr(subsys Table, expr FilterExpr) ([]bpf.RawInstruction, error) {
+	raw, err := compileProgram(subsys, expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > bpfMAXINSTR {
+		return nil, ErrFilterLength
+	}
+	return raw, nil
+}
+
+// compileProgram is like compileExpr, but does not limit the number of
+// instructions.
+func compileProgram(subsys Table, expr FilterExpr) ([]bpf.RawInstruction, error) {
+	p := &program{checks: filterChecks(subsys)}
+	accept, reject := p.newLabel(), p.newLabel()
+
+	// check the subsystem in the type of the message
+	match := p.newLabel()
+	p.emit(bpf.RawInstruction{Op: unix.BPF_LDX | unix.BPF_IMM, K: 4})
+	p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_B | unix.BPF_IND, K: 1})
+	p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: uint32(subsys)}, match, accept)
+	p.mark(match)
+
+	if err := p.compile(expr, accept, reject); err != nil {
+		return nil, err
+	}
+	p.mark(accept)
+	p.emit(bpf.RawInstruction{Op: unix.BPF_RET | unix.BPF_K, K: bpfVerdictAccept})
+	p.mark(reject)
+	p.emit(bpf.RawInstruction{Op: unix.BPF_RET | unix.BPF_K, K: bpfVerdictReject})
+
+	return p.assemble()
+}
+
+// compile emits the instructions of expr, that jump to t, if expr matches, and
+// to f otherwise.
+func (p *program) compile(expr FilterExpr, t, f label) error {
+	switch e := expr.(type) {
+	case andExpr:
+		for i, sub := range e {
+			if i == len(e)-1 {
+				return p.compile(sub, t, f)
+			}
+			next := p.newLabel()
+			if err := p.compile(sub, next, f); err != nil {
+				return err
+			}
+			p.mark(next)
+		}
+		p.ja(t)
+	case orExpr:
+		sets, rest := p.splitSets(e)
+		for _, set := range sets {
+			next := p.newLabel()
+			if err := p.compileSet(set, t, next); err != nil {
+				return err
+			}
+			p.mark(next)
+		}
+		for i, sub := range rest {
+			if i == len(rest)-1 {
+				return p.compile(sub, t, f)
+			}
+			next := p.newLabel()
+			if err := p.compile(sub, t, next); err != nil {
+				return err
+			}
+			p.mark(next)
+		}
+		p.ja(f)
+	case notExpr:
+		return p.compile(e.expr, f, t)
+	case ConnAttr:
+		if e.Negate {
+			t, f = f, t
+		}
+		return p.compileAttr(e, t, f)
+	case Compare:
+		return p.compileCompare(e, t, f)
+	case msgTypeExpr:
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: msgTypeOffset()})
+		p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: uint32(e)}, t, f)
+	case MessageFlags:
+		// nlmsghdr.nlmsg_flags is stored in native endianness.
+		flags := make([]byte, 2)
+		nativeEndian.PutUint16(flags, uint16(e.Flags))
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 6})
+		p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, K: encodeValue(flags)}, t, f)
+	case Sample:
+		p.compileSample(e, t, f)
+	case nil:
+		return fmt.Errorf("%w: missing expression", ErrFilterAttributeNotImplemented)
+	default:
+		return fmt.Errorf("%w: %T", ErrFilterAttributeNotImplemented, expr)
+	}
+	return nil
+}
+
+// findAttr emits the instructions, that load the offset of the attribute ct
+// nested in nest into X. If the attribute does not exist, they jump to f.
+func (p *program) findAttr(nest []uint32, ct uint32, f label) {
+	// sizeof(nlmsghdr) + sizeof(nfgenmsg) = 20
+	p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IMM, K: 0x14})
+	ext := uint32(bpfNlattr)
+	for _, typ := range append(nest[:len(nest):len(nest)], ct) {
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LDX | unix.BPF_IMM, K: typ})
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: ext})
+		found := p.newLabel()
+		p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 0}, f, found)
+		p.mark(found)
+		ext = bpfNlattrNest
+	}
+	p.emit(bpf.RawInstruction{Op: unix.BPF_MISC | unix.BPF_TAX})
+}
+
+// checkStatus emits the instructions, that jump to f, if none of the bits of
+// status is set in the status of the connection.
+func (p *program) checkStatus(status uint32, f label) {
+	if status == 0 {
+		return
+	}
+	set := p.newLabel()
+	p.findAttr(nil, ctaStatus, f)
+	p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_W | unix.BPF_IND, K: 4})
+	p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, K: status}, set, f)
+	p.mark(set)
+}
+
+// compileAttr emits the instructions, that compare the attribute of filter.
+func (p *program) compileAttr(filter ConnAttr, t, f label) error {
+	check, ok := p.checks[filter.Type]
+	if !ok || (check.ct == ctaUnspec && !check.family) {
+		return fmt.Errorf("%w: %d", ErrFilterAttributeNotImplemented, filter.Type)
+	}
+	data := filter.Data
+	if check.str && (len(data) == 0 || data[len(data)-1] != 0) {
+		data = append(data[:len(data):len(data)], 0)
+	}
+	if !check.variable && len(data) != check.len {
+		return ErrFilterAttributeLength
+	}
+	if len(filter.Mask) != 0 && len(filter.Mask) != len(data) {
+		return ErrFilterAttributeMaskLength
+	}
+
+	p.checkStatus(check.status, f)
+
+	if check.family {
+		if check.ct != ctaUnspec {
+			p.findAttr(check.nest, uint32(check.ct), f)
+		}
+		// nfgenmsg.nfgen_family follows the nlmsghdr
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 16})
+		p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: uint32(data[0])}, t, f)
+		return nil
+	}
+
+	p.findAttr(check.nest, uint32(check.ct), f)
+
+	if check.variable {
+		// The length of the attribute is stored in native endianness.
+		length := make([]byte, 2)
+		nativeEndian.PutUint16(length, uint16(4+len(data)))
+		match := p.newLabel()
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_H | unix.BPF_IND, K: 0})
+		p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: encodeValue(length)}, match, f)
+		p.mark(match)
+		if len(data) == 0 {
+			p.ja(t)
+			return nil
+		}
+	}
+
+	for off := 0; off < len(data); {
+		size, step := uint16(unix.BPF_W), 4
+		switch {
+		case len(data)-off == 1 || len(data)-off == 3:
+			size, step = unix.BPF_B, 1
+		case len(data)-off == 2:
+			size, step = unix.BPF_H, 2
+		}
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IND | size, K: uint32(4 + check.off + off)})
+		val := encodeValue(data[off : off+step])
+		if len(filter.Mask) != 0 {
+			mask := encodeValue(filter.Mask[off : off+step])
+			p.emit(bpf.RawInstruction{Op: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: mask})
+			val &= mask
+		}
+		off += step
+		match := t
+		if off < len(data) {
+			match = p.newLabel()
+		}
+		p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: val}, match, f)
+		if match != t {
+			p.mark(match)
+		}
+	}
+	return nil
+}
+
+// compileCompare emits the instructions, that compare the attribute of cmp.
+func (p *program) compileCompare(cmp Compare, t, f label) error {
+	check, ok := p.checks[cmp.Type]
+	if !ok || check.ct == ctaUnspec || check.family || check.variable {
+		return fmt.Errorf("%w: %d", ErrFilterAttributeNotImplemented, cmp.Type)
+	}
+	size := uint16(unix.BPF_W)
+	switch check.len {
+	case 1:
+		size = unix.BPF_B
+	case 2:
+		size = unix.BPF_H
+	case 4, 8:
+	default:
+		return fmt.Errorf("%w: %d", ErrFilterAttributeNotImplemented, cmp.Type)
+	}
+	if check.len < 8 && cmp.Value>>(8*check.len) != 0 {
+		return ErrFilterAttributeLength
+	}
+
+	if cmp.Op > CompareAnySet {
+		return fmt.Errorf("%w: operator %d", ErrFilterAttributeNotImplemented, cmp.Op)
+	}
+
+	p.checkStatus(check.status, f)
+	p.findAttr(check.nest, uint32(check.ct), f)
+
+	// A missing attribute does not match any operator, so the inverted
+	// comparison is used only after the attribute was found.
+	op := cmp.Op
+	switch op {
+	case CompareLt:
+		op, t, f = CompareGe, f, t
+	case CompareLe:
+		op, t, f = CompareGt, f, t
+	}
+
+	// Values of 8 bytes are compared in two words, the most significant first.
+	words := []uint32{uint32(cmp.Value)}
+	if check.len == 8 {
+		words = []uint32{uint32(cmp.Value >> 32), uint32(cmp.Value)}
+	}
+	for i, w := range words {
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IND | size, K: uint32(4 + check.off + 4*i)})
+		next := t
+		last := i == len(words)-1
+		if !last {
+			next = p.newLabel()
+		}
+		switch {
+		case op == CompareEq:
+			p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: w}, next, f)
+		case op == CompareAnySet && last:
+			p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, K: w}, t, f)
+		case op == CompareAnySet:
+			p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, K: w}, t, next)
+		case last && op == CompareGt:
+			p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, K: w}, t, f)
+		case last:
+			p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: w}, t, f)
+		default:
+			// The less significant word decides, if the words are equal.
+			eq := p.newLabel()
+			p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, K: w}, t, eq)
+			p.mark(eq)
+			p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: w}, next, f)
+		}
+		if !last {
+			p.mark(next)
+		}
+	}
+	return nil
+}
+
+// minSetSize is the number of values of an attribute in an OR operation, from
+// which on they are compiled into a binary search.
+const minSetSize = 8
+
+// valueRange contains the values from lo to hi, including both.
+type valueRange struct {
+	lo, hi uint32
+}
+
+// splitSets returns the ConnAttr of or, that are compiled into a binary search
+// grouped by their type, and the remaining expressions. Only attributes with
+// up to 4 bytes and prefix masks are supported.
+func (p *program) splitSets(or orExpr) ([][]ConnAttr, []FilterExpr) {
+	groups := make(map[ConnAttrType][]ConnAttr)
+	var order []ConnAttrType
+	for _, expr := range or {
+		if attr, ok := expr.(ConnAttr); ok && p.setEligible(attr) {
+			if _, ok := groups[attr.Type]; !ok {
+				order = append(order, attr.Type)
+			}
+			groups[attr.Type] = append(groups[attr.Type], attr)
+		}
+	}
+
+	var sets [][]ConnAttr
+	for _, typ := range order {
+		if len(groups[typ]) < minSetSize {
+			delete(groups, typ)
+			continue
+		}
+		sets = append(sets, groups[typ])
+	}
+	var rest []FilterExpr
+	for _, expr := range or {
+		if attr, ok := expr.(ConnAttr); ok && p.setEligible(attr) {
+			if _, ok := groups[attr.Type]; ok {
+				continue
+			}
+		}
+		rest = append(rest, expr)
+	}
+	return sets, rest
+}
+
+// setEligible returns true, if attr can be part of a binary search.
+func (p *program) setEligible(attr ConnAttr) bool {
+	check, ok := p.checks[attr.Type]
+	if !ok || attr.Negate || check.ct == ctaUnspec || check.family || check.variable {
+		return false
+	}
+	switch check.len {
+	case 1, 2, 4:
+	default:
+		return false
+	}
+	if len(attr.Data) != check.len {
+		return false
+	}
+	if len(attr.Mask) == 0 {
+		return true
+	}
+	if len(attr.Mask) != check.len {
+		return false
+	}
+	inv := ^encodeValue(attr.Mask) & widthMask(check.len)
+	return inv&(inv+1) == 0
+}
+
+// widthMask returns the mask of all bits of a value with size bytes.
+func widthMask(size int) uint32 {
+	return uint32(uint64(1)<<(8*size) - 1)
+}
+
+// compileSet emits the instructions of a binary search for the values of set,
+// which are all of the same type.
+func (p *program) compileSet(set []ConnAttr, t, f label) error {
+	check := p.checks[set[0].Type]
+	ranges := make([]valueRange, 0, len(set))
+	for _, attr := range set {
+		mask := widthMask(check.len)
+		if len(attr.Mask) != 0 {
+			mask = encodeValue(attr.Mask)
+		}
+		lo := encodeValue(attr.Data) & mask
+		ranges = append(ranges, valueRange{lo: lo, hi: lo | ^mask&widthMask(check.len)})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].lo < ranges[j].lo })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if uint64(r.lo) <= uint64(last.hi)+1 {
+			if r.hi > last.hi {
+				last.hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	size := uint16(unix.BPF_W)
+	switch check.len {
+	case 1:
+		size = unix.BPF_B
+	case 2:
+		size = unix.BPF_H
+	}
+	p.checkStatus(check.status, f)
+	p.findAttr(check.nest, uint32(check.ct), f)
+	p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IND | size, K: uint32(4 + check.off)})
+	p.search(merged, t, f)
+	return nil
+}
+
+// searchBlockSize is the number of ranges, that are searched with jumps to local
+// labels. The local labels jump to the actual targets, which are likely too
+// far away for conditional jumps.
+const searchBlockSize = 64
+
+// search emits the instructions, that jump to t, if the value in A is in one
+// of ranges, and to f otherwise. ranges have to be sorted and disjoint.
+func (p *program) search(ranges []valueRange, t, f label) {
+	if len(ranges) <= searchBlockSize {
+		lt, lf := p.newLabel(), p.newLabel()
+		p.searchBlock(ranges, lt, lf)
+		p.mark(lt)
+		p.ja(t)
+		p.mark(lf)
+		p.ja(f)
+		return
+	}
+	p.searchNode(ranges, t, f, p.search)
+}
+
+// searchBlock is like search, but all jumps to t and f are conditional jumps.
+func (p *program) searchBlock(ranges []valueRange, t, f label) {
+	p.searchNode(ranges, t, f, p.searchBlock)
+}
+
+// searchNode emits the comparison with the range in the middle of ranges and
+// uses sub for the ranges on both sides.
+func (p *program) searchNode(ranges []valueRange, t, f label, sub func([]valueRange, label, label)) {
+	m := len(ranges) / 2
+	left, right := f, f
+	if m > 0 {
+		left = p.newLabel()
+	}
+	if m < len(ranges)-1 {
+		right = p.newLabel()
+	}
+	ge := p.newLabel()
+	p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: ranges[m].lo}, ge, left)
+	p.mark(ge)
+	p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, K: ranges[m].hi}, right, t)
+	if left != f {
+		p.mark(left)
+		sub(ranges[:m], t, f)
+	}
+	if right != f {
+		p.mark(right)
+		sub(ranges[m+1:], t, f)
+	}
+}
+
+// msgTypeOffset returns the offset of the message type in the netlink header.
+// nlmsghdr.nlmsg_type contains the subsystem in the upper and the message
+// type in the lower byte and is stored in native endianness.
+func msgTypeOffset() uint32 {
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, 0xff)
+	if b[0] == 0xff {
+		return 4
+	}
+	return 5
+}
+
+// Parameters of the FNV-1a hash of the original tuple, that is used by Sample.
+const (
+	sampleHashOffset = 2166136261
+	sampleHashPrime  = 16777619
+)
+
+// sampleTypes are the attributes of the original tuple, that are hashed for
+// Sample. Attributes, that do not exist, are skipped.
+var sampleTypes = []ConnAttrType{
+	AttrOrigIPv4Src, AttrOrigIPv6Src, AttrOrigIPv4Dst, AttrOrigIPv6Dst,
+	AttrOrigL4Proto, AttrOrigPortSrc, AttrOrigPortDst,
+}
+
+// compileSample emits the instructions, that jump to t for one of s.N
+// messages. The hash of the tuple is kept in the scratch memory M[0] and the
+// offset of the hashed attribute in M[1].
+func (p *program) compileSample(s Sample, t, f label) {
+	if s.N <= 1 {
+		p.ja(t)
+		return
+	}
+	if !s.Tuple {
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: bpfRandom})
+	} else {
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IMM, K: sampleHashOffset})
+		p.emit(bpf.RawInstruction{Op: unix.BPF_ST, K: 0})
+		for _, typ := range sampleTypes {
+			check, ok := p.checks[typ]
+			if !ok {
+				continue
+			}
+			skip := p.newLabel()
+			p.findAttr(check.nest, uint32(check.ct), skip)
+			p.emit(bpf.RawInstruction{Op: unix.BPF_STX, K: 1})
+			for off := 0; off < check.len; off += 4 {
+				size := uint16(unix.BPF_W)
+				switch check.len {
+				case 1:
+					size = unix.BPF_B
+				case 2:
+					size = unix.BPF_H
+				}
+				p.emit(bpf.RawInstruction{Op: unix.BPF_LDX | unix.BPF_W | unix.BPF_MEM, K: 1})
+				p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_IND | size, K: uint32(4 + off)})
+				p.emit(bpf.RawInstruction{Op: unix.BPF_MISC | unix.BPF_TAX})
+				p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_W | unix.BPF_MEM, K: 0})
+				p.emit(bpf.RawInstruction{Op: unix.BPF_ALU | unix.BPF_XOR | unix.BPF_X})
+				p.emit(bpf.RawInstruction{Op: unix.BPF_ALU | unix.BPF_MUL | unix.BPF_K, K: sampleHashPrime})
+				p.emit(bpf.RawInstruction{Op: unix.BPF_ST, K: 0})
+			}
+			p.mark(skip)
+		}
+		// Mix the upper bits into the lower ones, that decide the modulo.
+		p.emit(bpf.RawInstruction{Op: unix.BPF_LD | unix.BPF_W | unix.BPF_MEM, K: 0})
+		p.emit(bpf.RawInstruction{Op: unix.BPF_MISC | unix.BPF_TAX})
+		p.emit(bpf.RawInstruction{Op: unix.BPF_ALU | unix.BPF_RSH | unix.BPF_K, K: 16})
+		p.emit(bpf.RawInstruction{Op: unix.BPF_ALU | unix.BPF_XOR | unix.BPF_X})
+	}
+	p.emit(bpf.RawInstruction{Op: unix.BPF_ALU | unix.BPF_MOD | unix.BPF_K, K: s.N})
+	p.jump(bpf.RawInstruction{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 0}, t, f)
+}
@@ -0,0 +1,632 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/florianl/go-conntrack/internal/bpfvm"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/net/bpf"
+)
+
+// encodeMessage returns c as encoded netlink message of table.
+func encodeMessage(t *testing.T, table Table, msgType uint16, flags netlink.HeaderFlags, c Con) []byte {
+	t.Helper()
+	attrs, err := MarshalAttributes(c)
+	if table == Expected && c.Exp != nil {
+		ae := netlink.NewAttributeEncoder()
+		if err = nestExpectedAttributes(newStdLogger(nil), ae, c.Exp); err == nil {
+			attrs, err = ae.Encode()
+		}
+		c.Origin = c.Exp.Tuple
+	}
+	if err != nil {
+		t.Fatalf("could not encode attributes: %v", err)
+	}
+	family := IPv4
+	if c.Origin != nil && c.Origin.Src != nil && c.Origin.Src.To4() == nil {
+		family = IPv6
+	}
+	data := append(putExtraHeader(uint8(family), 0, 0), attrs...)
+	msg := netlink.Message{
+		Header: netlink.Header{
+			Length: uint32(16 + len(data)),
+			Type:   netlink.HeaderType(uint16(table)<<8 | msgType),
+			Flags:  flags,
+		},
+		Data: data,
+	}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("could not encode message: %v", err)
+	}
+	return b
+}
+
+// testCon returns a TCP connection with the given source address, destination
+// port and mark. Mark is only set, if it is not zero.
+func testCon(src string, dport uint16, mark uint32) Con {
+	s, d := net.ParseIP(src), net.ParseIP("192.0.2.1")
+	proto := uint8(6)
+	sport := uint16(40000)
+	c := Con{Origin: &IPTuple{Src: &s, Dst: &d, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}}}
+	if mark != 0 {
+		c.Mark = &mark
+	}
+	return c
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func runFilter(t *testing.T, prog []bpf.RawInstruction, pkt []byte) bool {
+	t.Helper()
+	vm, err := bpfvm.New(prog)
+	if err != nil {
+		t.Fatalf("invalid filter: %v", err)
+	}
+	return vm.Run(pkt) != 0
+}
+
+func TestCompileExpr(t *testing.T) {
+	// (dport 53 OR dport 853) AND NOT src 10.0.0.0/8, OR mark 0x10
+	expr := Or(
+		And(
+			Or(ConnAttr{Type: AttrOrigPortDst, Data: u16(53)}, ConnAttr{Type: AttrOrigPortDst, Data: u16(853)}),
+			Not(ConnAttr{Type: AttrOrigIPv4Src, Data: []byte{10, 0, 0, 0}, Mask: []byte{255, 0, 0, 0}}),
+		),
+		ConnAttr{Type: AttrMark, Data: u32(0x10)},
+	)
+	prog, err := compileExpr(Conntrack, expr)
+	if err != nil {
+		t.Fatalf("could not compile expression: %v", err)
+	}
+
+	tests := map[string]struct {
+		pkt  []byte
+		want bool
+	}{
+		"dns":                {pkt: encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("192.168.1.1", 53, 0)), want: true},
+		"dns over tls":       {pkt: encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("192.168.1.1", 853, 0)), want: true},
+		"internal dns":       {pkt: encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("10.1.1.1", 53, 0))},
+		"http":               {pkt: encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("192.168.1.1", 80, 0))},
+		"marked http":        {pkt: encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("10.1.1.1", 80, 0x10)), want: true},
+		"other mark":         {pkt: encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("10.1.1.1", 80, 0x11))},
+		"other subsystem":    {pkt: encodeMessage(t, Expected, ipctnlMsgExpNew, 0, testCon("10.1.1.1", 80, 0)), want: true},
+		"missing attributes": {pkt: encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, Con{})},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := runFilter(t, prog, tc.pkt); got != tc.want {
+				t.Fatalf("unexpected verdict %t", got)
+			}
+		})
+	}
+}
+
+func TestCompileExprLongJumps(t *testing.T) {
+	// Each address is compared in more than 20 instructions, so the jumps to
+	// the verdicts exceed 255 instructions.
+	var or []FilterExpr
+	for i := 0; i < 100; i++ {
+		or = append(or, ConnAttr{Type: AttrOrigIPv6Src, Data: net.ParseIP(fmt.Sprintf("2001:db8::%x", 0x100+i))})
+	}
+	prog, err := compileExpr(Conntrack, And(Or(or...), ConnAttr{Type: AttrOrigPortDst, Data: u16(22)}))
+	if err != nil {
+		t.Fatalf("could not compile expression: %v", err)
+	}
+	if len(prog) < 256 {
+		t.Fatalf("program is too short to test long jumps: %d", len(prog))
+	}
+
+	con := func(src string, dport uint16) []byte {
+		c := testCon("192.168.1.1", dport, 0)
+		ip := net.ParseIP(src)
+		c.Origin.Src = &ip
+		c.Origin.Dst = &ip
+		return encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, c)
+	}
+	if !runFilter(t, prog, con("2001:db8::163", 22)) {
+		t.Fatal("last address is not accepted")
+	}
+	if runFilter(t, prog, con("2001:db8::163", 23)) {
+		t.Fatal("other port is accepted")
+	}
+	if runFilter(t, prog, con("2001:db8::1", 22)) {
+		t.Fatal("other address is accepted")
+	}
+}
+
+func TestBuildFilter(t *testing.T) {
+	filters := []ConnAttr{{Type: AttrMark, Data: u32(1), Mask: u32(0xff), Negate: true}}
+	prog, err := buildFilter(Conntrack, filters, ConnAttr{Type: AttrOrigPortDst, Data: u16(22)})
+	if err != nil {
+		t.Fatalf("could not build filter: %v", err)
+	}
+	if !runFilter(t, prog, encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("10.1.1.1", 22, 0x102))) {
+		t.Fatal("connection is not accepted")
+	}
+	if runFilter(t, prog, encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("10.1.1.1", 22, 0x101))) {
+		t.Fatal("negated mark is accepted")
+	}
+
+	tests := map[string]struct {
+		filters []ConnAttr
+		expr    FilterExpr
+		err     error
+	}{
+		"not implemented": {expr: ConnAttr{Type: AttrOrigNatSeqOffsetBefore}, err: ErrFilterAttributeNotImplemented},
+		"length":          {expr: ConnAttr{Type: AttrOrigPortDst, Data: u32(22)}, err: ErrFilterAttributeLength},
+		"mask length":     {expr: ConnAttr{Type: AttrMark, Data: u32(22), Mask: u16(0xff)}, err: ErrFilterAttributeMaskLength},
+		"nil":             {expr: And(nil), err: ErrFilterAttributeNotImplemented},
+		"negate mix": {
+			filters: []ConnAttr{{Type: AttrMark, Data: u32(1)}, {Type: AttrMark, Data: u32(2), Negate: true}},
+			expr:    And(),
+			err:     ErrFilterAttributeNegateMix,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := buildFilter(Conntrack, tc.filters, tc.expr); !errors.Is(err, tc.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCompileExprAttributes(t *testing.T) {
+	natted := testCon("10.0.0.1", 80, 0)
+	status := uint32(ipsSrcNat | ipsDstNat)
+	rsrc, rdst := net.ParseIP("192.0.2.80"), net.ParseIP("203.0.113.5")
+	rsport, rdport := uint16(8080), uint16(61000)
+	natted.Status = &status
+	natted.Reply = &IPTuple{Src: &rsrc, Dst: &rdst, Proto: &ProtoTuple{SrcPort: &rsport, DstPort: &rdport}}
+	flags, mask := uint8(0x02), uint8(0x12)
+	natted.ProtoInfo = &ProtoInfo{TCP: &TCPInfo{FlagsOrig: &TCPFlags{Flags: &flags, Mask: &mask}}}
+	helper := "ftp"
+	natted.Helper = &Helper{Name: &helper}
+	masterSrc := net.ParseIP("10.0.0.9").To4()
+	labels := make([]byte, 16)
+	labels[15] = 0x4
+	natted.Unknown = []Attribute{
+		{Path: []uint16{ctaTupleMaster, ctaTupleIP}, Type: ctaIPv4Src, Data: masterSrc},
+		{Path: []uint16{ctaTupleMaster, ctaTupleProto}, Type: ctaProtoDstPort, Data: u16(21)},
+		{Path: []uint16{ctaTupleOrig}, Type: ctaTupleZone, Data: u16(7)},
+		{Path: []uint16{ctaSecCtx}, Type: ctaSecCtxName, Data: []byte("system_u:object_r:ssh_t\x00")},
+		{Type: ctaLables, Data: labels},
+	}
+	natted6 := testCon("2001:db8::1", 80, 0)
+	plain := testCon("10.0.0.1", 80, 0)
+	plain.Status = new(uint32)
+	plain.Reply = natted.Reply
+
+	tests := map[string]struct {
+		expr FilterExpr
+		con  Con
+		want bool
+	}{
+		"snat":                {expr: ConnAttr{Type: AttrSNatIPv4, Data: rdst.To4()}, con: natted, want: true},
+		"snat without status": {expr: ConnAttr{Type: AttrSNatIPv4, Data: rdst.To4()}, con: plain},
+		"dnat":                {expr: ConnAttr{Type: AttrDNatIPv4, Data: []byte{192, 0, 2, 0}, Mask: []byte{255, 255, 255, 0}}, con: natted, want: true},
+		"snat port":           {expr: ConnAttr{Type: AttrSNatPort, Data: u16(61000)}, con: natted, want: true},
+		"dnat port":           {expr: ConnAttr{Type: AttrDNatPort, Data: u16(8081)}, con: natted},
+		"master":              {expr: And(ConnAttr{Type: AttrMasterIPv4Src, Data: masterSrc}, ConnAttr{Type: AttrMasterPortDst, Data: u16(21)}), con: natted, want: true},
+		"master l3proto":      {expr: ConnAttr{Type: AttrMasterL3Proto, Data: []byte{uint8(IPv4)}}, con: natted, want: true},
+		"no master":           {expr: ConnAttr{Type: AttrMasterL3Proto, Data: []byte{uint8(IPv4)}}, con: plain},
+		"l3proto":             {expr: ConnAttr{Type: AttrOrigL3Proto, Data: []byte{uint8(IPv6)}}, con: natted6, want: true},
+		"other l3proto":       {expr: ConnAttr{Type: AttrReplL3Proto, Data: []byte{uint8(IPv6)}}, con: natted},
+		"zone":                {expr: ConnAttr{Type: AttrOrigzone, Data: u16(7)}, con: natted, want: true},
+		"reply zone":          {expr: ConnAttr{Type: AttrReplzone, Data: u16(7)}, con: natted},
+		"tcp mask":            {expr: ConnAttr{Type: AttrTCPMaskOrig, Data: []byte{0x12}}, con: natted, want: true},
+		"tcp flags":           {expr: ConnAttr{Type: AttrTCPFlagsOrig, Data: []byte{0x12}}, con: natted},
+		"helper":              {expr: ConnAttr{Type: AttrHelperName, Data: []byte("ftp")}, con: natted, want: true},
+		"helper prefix":       {expr: ConnAttr{Type: AttrHelperName, Data: []byte("ft")}, con: natted},
+		"secctx":              {expr: ConnAttr{Type: AttrSecCtx, Data: []byte("system_u:object_r:ssh_t")}, con: natted, want: true},
+		"other secctx":        {expr: ConnAttr{Type: AttrSecCtx, Data: []byte("system_u:object_r:ssh_x")}, con: natted},
+		"label":               {expr: ConnAttr{Type: AttrConnlabels, Data: labels, Mask: labels}, con: natted, want: true},
+		"other label":         {expr: ConnAttr{Type: AttrConnlabels, Data: labels[1:], Mask: labels[1:]}, con: natted},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			prog, err := compileExpr(Conntrack, tc.expr)
+			if err != nil {
+				t.Fatalf("could not compile expression: %v", err)
+			}
+			if got := runFilter(t, prog, encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, tc.con)); got != tc.want {
+				t.Fatalf("unexpected verdict %t", got)
+			}
+		})
+	}
+
+	// RegisterFiltered supports these attributes as well.
+	prog, err := buildFilter(Conntrack, []ConnAttr{{Type: AttrHelperName, Data: []byte("ftp")}, {Type: AttrOrigPortDst, Data: u16(80)}}, nil)
+	if err != nil {
+		t.Fatalf("could not build filter: %v", err)
+	}
+	if !runFilter(t, prog, encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, natted)) {
+		t.Fatal("connection with helper is not accepted")
+	}
+	if runFilter(t, prog, encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, plain)) {
+		t.Fatal("connection without helper is accepted")
+	}
+}
+
+func TestCompileCompare(t *testing.T) {
+	con := testCon("10.0.0.1", 443, 0)
+	timeout, use, status := uint32(120), uint32(3), uint32(ipsDstNat|0x8)
+	packets, bytes := uint64(1<<32+10), uint64(1500)
+	con.Timeout, con.Status = &timeout, &status
+	// Use and the counters are only sent by the kernel.
+	con.Unknown = []Attribute{
+		{Type: ctaUse, Data: u32(use)},
+		{Path: []uint16{ctaCountersOrig}, Type: ctaCounterPackets, Data: u64(packets)},
+		{Path: []uint16{ctaCountersOrig}, Type: ctaCounterBytes, Data: u64(bytes)},
+	}
+
+	tests := map[string]struct {
+		expr FilterExpr
+		want bool
+	}{
+		"port range":            {expr: Range(AttrOrigPortSrc, 1024, 65535), want: true},
+		"port below range":      {expr: Range(AttrOrigPortDst, 1024, 65535)},
+		"port equal":            {expr: Compare{Type: AttrOrigPortDst, Op: CompareEq, Value: 443}, want: true},
+		"timeout greater":       {expr: Compare{Type: AttrTimeout, Op: CompareGt, Value: 119}, want: true},
+		"timeout not greater":   {expr: Compare{Type: AttrTimeout, Op: CompareGt, Value: 120}},
+		"timeout less":          {expr: Compare{Type: AttrTimeout, Op: CompareLt, Value: 121}, want: true},
+		"timeout not less":      {expr: Compare{Type: AttrTimeout, Op: CompareLt, Value: 120}},
+		"use less or equal":     {expr: Compare{Type: AttrUse, Op: CompareLe, Value: 3}, want: true},
+		"use greater or equal":  {expr: Compare{Type: AttrUse, Op: CompareGe, Value: 4}},
+		"missing mark":          {expr: Compare{Type: AttrMark, Op: CompareLt, Value: 10}},
+		"status bits":           {expr: Compare{Type: AttrStatus, Op: CompareAnySet, Value: ipsSrcNat | ipsDstNat}, want: true},
+		"other status bits":     {expr: Compare{Type: AttrStatus, Op: CompareAnySet, Value: ipsSrcNat | 0x1}},
+		"packets high word":     {expr: Compare{Type: AttrOrigCounterPackets, Op: CompareGt, Value: 1 << 32}, want: true},
+		"packets low word":      {expr: Compare{Type: AttrOrigCounterPackets, Op: CompareGt, Value: 1<<32 + 10}},
+		"packets less":          {expr: Compare{Type: AttrOrigCounterPackets, Op: CompareLt, Value: 1<<33 + 1}, want: true},
+		"packets equal":         {expr: Compare{Type: AttrOrigCounterPackets, Op: CompareEq, Value: 1<<32 + 10}, want: true},
+		"packets bits":          {expr: Compare{Type: AttrOrigCounterPackets, Op: CompareAnySet, Value: 1 << 32}, want: true},
+		"bytes greater":         {expr: Compare{Type: AttrOrigCounterBytes, Op: CompareGe, Value: 1 << 20}},
+		"bytes less or equal":   {expr: Compare{Type: AttrOrigCounterBytes, Op: CompareLe, Value: 1500}, want: true},
+		"reply bytes not exist": {expr: Not(Compare{Type: AttrReplCounterBytes, Op: CompareGe, Value: 0}), want: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			prog, err := compileExpr(Conntrack, tc.expr)
+			if err != nil {
+				t.Fatalf("could not compile expression: %v", err)
+			}
+			if got := runFilter(t, prog, encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, con)); got != tc.want {
+				t.Fatalf("unexpected verdict %t", got)
+			}
+		})
+	}
+
+	errTests := map[string]struct {
+		expr FilterExpr
+		err  error
+	}{
+		"value too large": {expr: Compare{Type: AttrOrigPortDst, Op: CompareGt, Value: 1 << 16}, err: ErrFilterAttributeLength},
+		"address":         {expr: Compare{Type: AttrOrigIPv6Src, Op: CompareGt}, err: ErrFilterAttributeNotImplemented},
+		"string":          {expr: Compare{Type: AttrHelperName, Op: CompareEq}, err: ErrFilterAttributeNotImplemented},
+		"operator":        {expr: Compare{Type: AttrMark, Op: CompareAnySet + 1}, err: ErrFilterAttributeNotImplemented},
+	}
+	for name, tc := range errTests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := compileExpr(Conntrack, tc.expr); !errors.Is(err, tc.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCompileSet(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	type prefix struct {
+		addr uint32
+		bits int
+	}
+	var prefixes []prefix
+	var filters []ConnAttr
+	for i := 0; i < 1500; i++ {
+		bits := 16 + rng.Intn(17)
+		mask := uint32(0xffffffff) << (32 - bits)
+		p := prefix{addr: rng.Uint32() & mask, bits: bits}
+		prefixes = append(prefixes, p)
+		filters = append(filters, ConnAttr{Type: AttrOrigIPv4Src, Data: u32(p.addr), Mask: u32(mask)})
+	}
+	if _, err := constructFilter(Conntrack, filters); !errors.Is(err, ErrFilterLength) {
+		t.Fatalf("unexpected error of linear filter: %v", err)
+	}
+	prog, err := buildFilter(Conntrack, filters, nil)
+	if err != nil {
+		t.Fatalf("could not build filter: %v", err)
+	}
+
+	contains := func(addr uint32) bool {
+		for _, p := range prefixes {
+			if addr>>(32-p.bits) == p.addr>>(32-p.bits) {
+				return true
+			}
+		}
+		return false
+	}
+	check := func(addr uint32) {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, addr)
+		if got := runFilter(t, prog, encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon(ip.String(), 80, 0))); got != contains(addr) {
+			t.Fatalf("unexpected verdict %t for %s", got, ip)
+		}
+	}
+	for _, p := range prefixes[:100] {
+		check(p.addr)
+		check(p.addr | 0xffffffff>>p.bits)
+		check(p.addr - 1)
+		check(p.addr | 0xffffffff>>p.bits + 1)
+	}
+	for i := 0; i < 1000; i++ {
+		check(rng.Uint32())
+	}
+}
+
+func TestCompileSetPorts(t *testing.T) {
+	var ports []FilterExpr
+	for port := 1000; port < 1100; port++ {
+		ports = append(ports, ConnAttr{Type: AttrOrigPortDst, Data: u16(uint16(port))})
+	}
+	ports = append(ports, ConnAttr{Type: AttrOrigPortDst, Data: u16(22)}, ConnAttr{Type: AttrMark, Data: u32(7)})
+	prog, err := compileExpr(Conntrack, Or(ports...))
+	if err != nil {
+		t.Fatalf("could not compile expression: %v", err)
+	}
+	// 100 consecutive ports are merged into a single range.
+	if len(prog) > 30 {
+		t.Fatalf("program is too long: %d instructions", len(prog))
+	}
+	for port, want := range map[uint16]bool{22: true, 23: false, 999: false, 1000: true, 1050: true, 1099: true, 1100: false} {
+		if got := runFilter(t, prog, encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("10.0.0.1", port, 0))); got != want {
+			t.Fatalf("unexpected verdict %t for port %d", got, port)
+		}
+	}
+	if !runFilter(t, prog, encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("10.0.0.1", 80, 7))) {
+		t.Fatal("mark is not accepted")
+	}
+}
+
+func TestUserspaceFilter(t *testing.T) {
+	var filters []ConnAttr
+	for i := 0; i < 1000; i++ {
+		ip := net.ParseIP(fmt.Sprintf("2001:db8::%x", 0x100+i))
+		filters = append(filters, ConnAttr{Type: AttrOrigIPv6Src, Data: ip, Mask: net.CIDRMask(128, 128)})
+	}
+	if _, err := buildFilter(Conntrack, filters, nil); !errors.Is(err, ErrFilterLength) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nfct := &Nfct{logger: newStdLogger(nil)}
+	vm, err := nfct.userspaceFilter(Conntrack, filters, ConnAttr{Type: AttrOrigPortDst, Data: u16(22)})
+	if err != nil {
+		t.Fatalf("could not create userspace filter: %v", err)
+	}
+	s := &Subscription{filter: vm}
+
+	accept := func(c Con) bool {
+		var msg netlink.Message
+		if err := msg.UnmarshalBinary(encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, c)); err != nil {
+			t.Fatalf("could not decode message: %v", err)
+		}
+		return s.accept(msg)
+	}
+	if !accept(testCon("2001:db8::4e7", 22, 0)) {
+		t.Fatal("last address is not accepted")
+	}
+	if accept(testCon("2001:db8::4e7", 23, 0)) {
+		t.Fatal("other port is accepted")
+	}
+	if accept(testCon("2001:db8::4e8", 22, 0)) {
+		t.Fatal("other address is accepted")
+	}
+}
+
+func TestCompileExprExpected(t *testing.T) {
+	master := testCon("10.0.0.1", 21, 0).Origin
+	tuple := testCon("10.0.0.1", 40123, 0).Origin
+	flags, class, zone, dir := uint32(0x4), uint32(1), uint16(3), uint32(1)
+	helper := "ftp"
+	exp := Con{Exp: &Exp{
+		Master:     master,
+		Tuple:      tuple,
+		Flags:      &flags,
+		Class:      &class,
+		Zone:       &zone,
+		HelperName: &helper,
+		Nat:        &NatInfo{Dir: &dir},
+	}}
+
+	tests := map[string]struct {
+		filters []ConnAttr
+		want    bool
+	}{
+		"master port":     {filters: []ConnAttr{{Type: AttrMasterPortDst, Data: u16(21)}}, want: true},
+		"tuple port":      {filters: []ConnAttr{{Type: AttrOrigPortDst, Data: u16(21)}}},
+		"expected tuple":  {filters: []ConnAttr{{Type: AttrOrigPortDst, Data: u16(40123)}, {Type: AttrOrigIPv4Src, Data: []byte{10, 0, 0, 0}, Mask: []byte{255, 0, 0, 0}}}, want: true},
+		"master address":  {filters: []ConnAttr{{Type: AttrMasterIPv4Dst, Data: []byte{192, 0, 2, 1}, Mask: []byte{255, 255, 255, 255}}}, want: true},
+		"helper":          {filters: []ConnAttr{{Type: AttrHelperName, Data: []byte("ftp")}}, want: true},
+		"other helper":    {filters: []ConnAttr{{Type: AttrHelperName, Data: []byte("sip")}}},
+		"class":           {filters: []ConnAttr{{Type: AttrExpClass, Data: u32(1)}}, want: true},
+		"zone":            {filters: []ConnAttr{{Type: AttrZone, Data: u16(3)}}, want: true},
+		"flags":           {filters: []ConnAttr{{Type: AttrExpFlags, Data: u32(0x4)}}, want: true},
+		"negated flags":   {filters: []ConnAttr{{Type: AttrExpFlags, Data: u32(0x4), Negate: true}}},
+		"nat direction":   {filters: []ConnAttr{{Type: AttrExpNATDir, Data: u32(1)}}, want: true},
+		"missing id":      {filters: []ConnAttr{{Type: AttrExpID, Data: u32(1)}}},
+		"l3proto":         {filters: []ConnAttr{{Type: AttrMasterL3Proto, Data: []byte{uint8(IPv4)}}}, want: true},
+		"other l4 proto":  {filters: []ConnAttr{{Type: AttrMasterL4Proto, Data: []byte{17}}}},
+		"master l4 proto": {filters: []ConnAttr{{Type: AttrMasterL4Proto, Data: []byte{6}}}, want: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			prog, err := buildFilter(Expected, tc.filters, nil)
+			if err != nil {
+				t.Fatalf("could not build filter: %v", err)
+			}
+			if got := runFilter(t, prog, encodeMessage(t, Expected, ipctnlMsgExpNew, 0, exp)); got != tc.want {
+				t.Fatalf("unexpected verdict %t", got)
+			}
+			// Messages of the Conntrack subsystem are not filtered.
+			if !runFilter(t, prog, encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("10.0.0.1", 80, 0))) {
+				t.Fatal("message of other subsystem is rejected")
+			}
+		})
+	}
+
+	if _, err := buildFilter(Expected, []ConnAttr{{Type: AttrMark, Data: u32(1), Mask: u32(1)}}, nil); !errors.Is(err, ErrFilterAttributeNotImplemented) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCompileEvents(t *testing.T) {
+	status := uint32(0x4)
+	assured := testCon("10.0.0.1", 22, 0)
+	assured.Status = &status
+	udp := testCon("10.0.0.1", 53, 0)
+	*udp.Origin.Proto.Number = 17
+
+	events := []struct {
+		kind    EventKind
+		msgType uint16
+		flags   netlink.HeaderFlags
+	}{
+		{kind: EventNew, msgType: ipctnlMsgCtNew, flags: netlink.Create | netlink.Excl},
+		{kind: EventUpdate, msgType: ipctnlMsgCtNew},
+		{kind: EventDestroy, msgType: ipctnlMsgCtDelete},
+	}
+	tests := map[string]struct {
+		expr FilterExpr
+		con  Con
+		want []EventKind
+	}{
+		"updates":            {expr: EventKinds(EventUpdate), con: assured, want: []EventKind{EventUpdate}},
+		"new and destroy":    {expr: EventKinds(EventNew, EventDestroy), con: assured, want: []EventKind{EventNew, EventDestroy}},
+		"none":               {expr: EventKinds(), con: assured},
+		"created":            {expr: MessageFlags{Flags: netlink.Create}, con: assured, want: []EventKind{EventNew}},
+		"not created":        {expr: Not(MessageFlags{Flags: netlink.Create | netlink.Excl}), con: assured, want: []EventKind{EventUpdate, EventDestroy}},
+		"assured updates":    {expr: And(EventKinds(EventUpdate), Compare{Type: AttrStatus, Op: CompareAnySet, Value: 0x4}), con: assured, want: []EventKind{EventUpdate}},
+		"unassured updates":  {expr: And(EventKinds(EventUpdate), Compare{Type: AttrStatus, Op: CompareAnySet, Value: 0x4}), con: udp},
+		"tcp destroy":        {expr: And(EventKinds(EventDestroy), ConnAttr{Type: AttrOrigL4Proto, Data: []byte{6}}), con: assured, want: []EventKind{EventDestroy}},
+		"udp destroy":        {expr: And(EventKinds(EventDestroy), ConnAttr{Type: AttrOrigL4Proto, Data: []byte{6}}), con: udp},
+		"destroy or port 53": {expr: Or(EventKinds(EventDestroy), ConnAttr{Type: AttrOrigPortDst, Data: u16(53)}), con: udp, want: []EventKind{EventNew, EventUpdate, EventDestroy}},
+		"destroy or port 22": {expr: Or(EventKinds(EventDestroy), ConnAttr{Type: AttrOrigPortDst, Data: u16(22)}), con: udp, want: []EventKind{EventDestroy}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			prog, err := compileExpr(Conntrack, tc.expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			m, err := NewMatcher(Conntrack, nil, tc.expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, e := range events {
+				want := false
+				for _, kind := range tc.want {
+					want = want || kind == e.kind
+				}
+				if got := runFilter(t, prog, encodeMessage(t, Conntrack, e.msgType, e.flags, tc.con)); got != want {
+					t.Errorf("filter returns %t for %s", got, e.kind)
+				}
+				if got := m.MatchEvent(Event{Kind: e.kind, Table: Conntrack, Con: tc.con}); got != want {
+					t.Errorf("MatchEvent returns %t for %s", got, e.kind)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []uint32{2, 3, 10} {
+		expr := Sample{N: n, Tuple: true}
+		prog, err := compileExpr(Conntrack, expr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		m, err := NewMatcher(Conntrack, nil, expr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		sampled := 0
+		for i := 0; i < 1000; i++ {
+			c := randomCon(rng)
+			src := net.IPv4(10, byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256)))
+			if c.Origin.Src.To4() == nil {
+				src = net.ParseIP(fmt.Sprintf("2001:db8::%x", rng.Intn(0x10000)))
+			}
+			*c.Origin.Src = src
+			pkt := encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, c)
+			got := runFilter(t, prog, pkt)
+			if got != m.Match(c) {
+				t.Fatalf("filter and Matcher disagree for %v", src)
+			}
+			if runFilter(t, prog, pkt) != got {
+				t.Fatal("sample of a tuple is not deterministic")
+			}
+			if got {
+				sampled++
+			}
+		}
+		if want := 1000 / int(n); sampled < want/2 || sampled > want*3/2 {
+			t.Errorf("%d of 1000 connections are sampled for 1/%d", sampled, n)
+		}
+	}
+
+	prog, err := compileExpr(Conntrack, Sample{N: 4})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	vm, err := bpfvm.New(prog)
+	if err != nil {
+		t.Fatalf("invalid filter: %v", err)
+	}
+	var random uint32
+	vm.Random = func() uint32 {
+		random++
+		return random
+	}
+	pkt := encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("10.0.0.1", 22, 0))
+	sampled := 0
+	for i := 0; i < 100; i++ {
+		if vm.Run(pkt) != 0 {
+			sampled++
+		}
+	}
+	if sampled != 25 {
+		t.Fatalf("%d of 100 messages are sampled", sampled)
+	}
+
+	for _, n := range []uint32{0, 1} {
+		prog, err := compileExpr(Conntrack, Sample{N: n})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !runFilter(t, prog, pkt) {
+			t.Fatalf("sample of %d rejects a message", n)
+		}
+	}
+}
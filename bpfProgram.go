@@ -0,0 +1,104 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/florianl/go-conntrack/internal/bpfvm"
+	"golang.org/x/net/bpf"
+)
+
+// MaxFilterInstructions is the maximum number of instructions of a BPF filter,
+// that is accepted by the kernel.
+const MaxFilterInstructions = bpfMAXINSTR
+
+// Errors, that are returned for BPF filters, that are not compiled by
+// CompileFilter.
+var (
+	ErrFilterInvalid = errors.New("invalid BPF filter")
+	ErrFilterFormat  = errors.New("invalid format of BPF filter")
+)
+
+// CompileFilter returns the BPF filter, that RegisterFiltered attaches for
+// filters and expr to a socket, that is subscribed to the events of t. If the
+// filter exceeds MaxFilterInstructions, ErrFilterLength is returned.
+//
+// The filter can be inspected with DisassembleFilter, exported with
+// ExportFilter or attached to a netlink.Conn with SetBPF.
+func CompileFilter(t Table, filters []ConnAttr, expr FilterExpr) ([]bpf.RawInstruction, error) {
+	return buildFilter(t, filters, expr)
+}
+
+// CheckFilter returns an error, if the kernel would reject prog. If prog
+// exceeds MaxFilterInstructions, ErrFilterLength is returned. Other errors
+// wrap ErrFilterInvalid.
+func CheckFilter(prog []bpf.RawInstruction) error {
+	if len(prog) > MaxFilterInstructions {
+		return ErrFilterLength
+	}
+	if _, err := bpfvm.New(prog); err != nil {
+		return fmt.Errorf("%w: %v", ErrFilterInvalid, err)
+	}
+	return nil
+}
+
+// DisassembleFilter returns a listing of prog with one instruction per line.
+func DisassembleFilter(prog []bpf.RawInstruction) string {
+	return fmtRawInstructions(prog)
+}
+
+// ExportFilter returns prog in the format of tcpdump -ddd. The first line is
+// the number of instructions, followed by one line per instruction with its
+// code, jt, jf and k as decimal numbers.
+func ExportFilter(prog []bpf.RawInstruction) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d\n", len(prog))
+	for _, ins := range prog {
+		fmt.Fprintf(&b, "%d %d %d %d\n", ins.Op, ins.Jt, ins.Jf, ins.K)
+	}
+	return b.String()
+}
+
+// ImportFilter returns the BPF filter of s in the format of ExportFilter. The
+// instructions might also be separated by commas, like in the bytecode option
+// of the iptables bpf match. Errors wrap ErrFilterFormat. Use CheckFilter to
+// verify the imported filter.
+func ImportFilter(s string) ([]bpf.RawInstruction, error) {
+	lines := strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' })
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%w: missing number of instructions", ErrFilterFormat)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%w: invalid number of instructions %q", ErrFilterFormat, lines[0])
+	}
+	if n != len(lines)-1 {
+		return nil, fmt.Errorf("%w: expected %d instructions, got %d", ErrFilterFormat, n, len(lines)-1)
+	}
+
+	prog := make([]bpf.RawInstruction, 0, n)
+	for i, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%w: instruction %d: expected 4 fields, got %d", ErrFilterFormat, i, len(fields))
+		}
+		var values [4]uint64
+		for j, bits := range []int{16, 8, 8, 32} {
+			if values[j], err = strconv.ParseUint(fields[j], 10, bits); err != nil {
+				return nil, fmt.Errorf("%w: instruction %d: invalid value %q", ErrFilterFormat, i, fields[j])
+			}
+		}
+		prog = append(prog, bpf.RawInstruction{
+			Op: uint16(values[0]),
+			Jt: uint8(values[1]),
+			Jf: uint8(values[2]),
+			K:  uint32(values[3]),
+		})
+	}
+	return prog, nil
+}
@@ -0,0 +1,123 @@
+package conntrack
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestCompileFilter(t *testing.T) {
+	expr, err := ParseFilter("proto tcp and orig.dport in {22, 80, 443} and mark < 16")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	prog, err := CompileFilter(Conntrack, nil, expr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := CheckFilter(prog); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	imported, err := ImportFilter(ExportFilter(prog))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(imported, prog) {
+		t.Fatalf("unexpected filter after export and import\n%s", DisassembleFilter(imported))
+	}
+
+	listing := DisassembleFilter(prog)
+	if strings.Contains(listing, "UNKNOWN_INSTRUCTION") || strings.Count(listing, "\n") != len(prog) {
+		t.Fatalf("unexpected listing:\n%s", listing)
+	}
+
+	legacy, err := CompileFilter(Conntrack, []ConnAttr{{Type: AttrOrigPortDst, Data: u16(22)}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := CheckFilter(legacy); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckFilter(t *testing.T) {
+	ret := bpf.RawInstruction{Op: 0x06, K: bpfVerdictAccept}
+	tests := map[string]struct {
+		prog []bpf.RawInstruction
+		err  error
+	}{
+		"valid":      {prog: []bpf.RawInstruction{ret}},
+		"empty":      {err: ErrFilterInvalid},
+		"no return":  {prog: []bpf.RawInstruction{{Op: 0x00, K: 1}}, err: ErrFilterInvalid},
+		"jump":       {prog: []bpf.RawInstruction{{Op: 0x15, Jt: 2}, ret}, err: ErrFilterInvalid},
+		"too long":   {prog: make([]bpf.RawInstruction, MaxFilterInstructions+1), err: ErrFilterLength},
+		"bad opcode": {prog: []bpf.RawInstruction{{Op: 0xff}, ret}, err: ErrFilterInvalid},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := CheckFilter(tc.prog); !errors.Is(err, tc.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestImportFilter(t *testing.T) {
+	want := []bpf.RawInstruction{{Op: 0x30, K: 16}, {Op: 0x15, Jt: 0, Jf: 1, K: 1}, {Op: 0x06, K: 4294967295}, {Op: 0x06}}
+	tests := map[string]struct {
+		input string
+		err   error
+	}{
+		"tcpdump":  {input: "4\n48 0 0 16\n21 0 1 1\n6 0 0 4294967295\n6 0 0 0\n"},
+		"iptables": {input: "4,48 0 0 16,21 0 1 1,6 0 0 4294967295,6 0 0 0"},
+		"empty":    {input: "\n", err: ErrFilterFormat},
+		"count":    {input: "3\n48 0 0 16\n", err: ErrFilterFormat},
+		"fields":   {input: "1\n6 0 0\n", err: ErrFilterFormat},
+		"range":    {input: "1\n6 256 0 0\n", err: ErrFilterFormat},
+		"number":   {input: "one\n6 0 0 0\n", err: ErrFilterFormat},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ImportFilter(tc.input)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil && !reflect.DeepEqual(got, want) {
+				t.Fatalf("unexpected filter\nwant: %v\ngot:  %v", want, got)
+			}
+		})
+	}
+}
+
+func TestCode2str(t *testing.T) {
+	tests := map[uint16]string{
+		0x00: "BPF_LD|BPF_IMM",
+		0x01: "BPF_LDX|BPF_IMM",
+		0x20: "BPF_LD|BPF_W|BPF_ABS",
+		0x30: "BPF_LD|BPF_B|BPF_ABS",
+		0x50: "BPF_LD|BPF_B|BPF_IND",
+		0xb1: "BPF_LDX|BPF_B|BPF_MSH",
+		0x15: "BPF_JMP|BPF_JEQ|BPF_K",
+		0x25: "BPF_JMP|BPF_JGT|BPF_K",
+		0x45: "BPF_JMP|BPF_JSET|BPF_K",
+		0x05: "BPF_JMP|BPF_JA",
+		0x54: "BPF_ALU|BPF_AND|BPF_K",
+		0x0c: "BPF_ALU|BPF_ADD|BPF_X",
+		0x84: "BPF_ALU|BPF_NEG",
+		0x06: "BPF_RET|BPF_K",
+		0x16: "BPF_RET|BPF_A",
+		0x07: "BPF_MISC|BPF_TAX",
+		0x87: "BPF_MISC|BPF_TXA",
+		0xff: "UNKNOWN_INSTRUCTION",
+		0xe0: "UNKNOWN_INSTRUCTION",
+	}
+	for op, want := range tests {
+		if got := code2str(op); got != want {
+			t.Errorf("code2str(0x%02x) = %s, want %s", op, got, want)
+		}
+	}
+}
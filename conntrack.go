@@ -3,15 +3,17 @@ package conntrack
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"reflect"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"github.com/florianl/go-conntrack/internal/unix"
 
 	"github.com/mdlayher/netlink"
-	"github.com/mdlayher/netlink/nlenc"
 )
 
 // Supported conntrack subsystems
@@ -72,44 +74,124 @@ func (devNull) Write(p []byte) (int, error) {
 func Open(config *Config) (*Nfct, error) {
 	var nfct Nfct
 
-	con, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: config.NetNS, DisableNSLockThread: config.DisableNSLockThread})
+	nfct.dial = func() (*netlink.Conn, error) {
+		var con *netlink.Conn
+		var err error
+		if config.Dial != nil {
+			con, err = config.Dial()
+		} else {
+			con, err = netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: config.NetNS, DisableNSLockThread: config.DisableNSLockThread})
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := configureCon(con, config); err != nil {
+			con.Close()
+			return nil, err
+		}
+		return con, nil
+	}
+
+	con, err := nfct.dial()
 	if err != nil {
 		return nil, err
 	}
 	nfct.Con = con
 
-	if config.Logger == nil {
-		nfct.logger = log.New(new(devNull), "", 0)
+	if config.LeveledLogger != nil {
+		nfct.logger = config.LeveledLogger
 	} else {
-		nfct.logger = config.Logger
+		nfct.logger = nfct.newDebugLogger(config.Logger)
 	}
 
 	if config.WriteTimeout > 0 {
-		nfct.setWriteTimeout = func() error {
+		nfct.setWriteTimeout = func(con *netlink.Conn) error {
 			deadline := time.Now().Add(config.WriteTimeout)
-			return nfct.Con.SetWriteDeadline(deadline)
+			return con.SetWriteDeadline(deadline)
 		}
 	} else {
-		nfct.setWriteTimeout = func() error { return nil }
+		nfct.setWriteTimeout = func(*netlink.Conn) error { return nil }
 	}
 
 	nfct.addConntrackInformation = config.AddConntrackInformation
+	nfct.sendUnknownAttributes = config.SendUnknownAttributes
+	nfct.poolSize = config.PoolSize
+	nfct.recorder = config.Recorder
+	nfct.trace = config.Trace
 
 	return &nfct, nil
 }
 
+// configureCon applies the socket options of config to con.
+func configureCon(con *netlink.Conn, config *Config) error {
+	if config.ReadBuffer > 0 {
+		if config.ForceReadBuffer {
+			if err := setReadBufferForce(con, config.ReadBuffer); err != nil {
+				return fmt.Errorf("could not set SO_RCVBUFFORCE: %w", err)
+			}
+		} else if err := con.SetReadBuffer(config.ReadBuffer); err != nil {
+			return fmt.Errorf("could not set SO_RCVBUF: %w", err)
+		}
+	}
+
+	options := []struct {
+		enable bool
+		option netlink.ConnOption
+		name   string
+	}{
+		{config.NoENOBUFS, netlink.NoENOBUFS, "NETLINK_NO_ENOBUFS"},
+		{config.BroadcastError, netlink.BroadcastError, "NETLINK_BROADCAST_ERROR"},
+		{config.StrictCheck, netlink.GetStrictCheck, "NETLINK_GET_STRICT_CHK"},
+		{config.ExtendedAcknowledge, netlink.ExtendedAcknowledge, "NETLINK_EXT_ACK"},
+	}
+	for _, opt := range options {
+		if !opt.enable {
+			continue
+		}
+		if err := con.SetOption(opt.option, true); err != nil {
+			return fmt.Errorf("could not set %s: %w", opt.name, err)
+		}
+	}
+	return nil
+}
+
+// setReadBufferForce sets the receive buffer of con with SO_RCVBUFFORCE.
+func setReadBufferForce(con *netlink.Conn, size int) error {
+	rc, err := con.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, size)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
 // Close the connection to the conntrack subsystem.
+// All active subscriptions are stopped.
 func (nfct *Nfct) Close() error {
-	if nfct.ctxCancel != nil {
-		nfct.ctxCancel()
+	nfct.subMu.Lock()
+	subs := make([]*Subscription, 0, len(nfct.subs))
+	for sub := range nfct.subs {
+		subs = append(subs, sub)
+	}
+	nfct.subMu.Unlock()
 
-		// Block until filters are removed and socket unsubscribed from groups
-		<-nfct.shutdown
+	for _, sub := range subs {
+		sub.Stop()
+	}
+	// Block until filters are removed and sockets unsubscribed from groups
+	for _, sub := range subs {
+		<-sub.Done()
 	}
 
 	if nfct.errChan != nil {
 		close(nfct.errChan)
 	}
+	nfct.closePool()
 	return nfct.Con.Close()
 }
 
@@ -120,6 +202,11 @@ func (nfct *Nfct) SetOption(o netlink.ConnOption, enable bool) error {
 
 // Flush a conntrack subsystem
 func (nfct *Nfct) Flush(t Table, f Family) error {
+	return nfct.FlushContext(context.Background(), t, f)
+}
+
+// FlushContext is like Flush, but the request is interrupted, once ctx is done.
+func (nfct *Nfct) FlushContext(ctx context.Context, t Table, f Family) error {
 	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, 0)
 	req := netlink.Message{
 		Header: netlink.Header{
@@ -137,11 +224,16 @@ func (nfct *Nfct) Flush(t Table, f Family) error {
 		return ErrUnknownCtTable
 	}
 
-	return nfct.execute(req)
+	return nfct.execute(ctx, req)
 }
 
 // Dump a conntrack subsystem
 func (nfct *Nfct) Dump(t Table, f Family) ([]Con, error) {
+	return nfct.DumpContext(context.Background(), t, f)
+}
+
+// DumpContext is like Dump, but the request is interrupted, once ctx is done.
+func (nfct *Nfct) DumpContext(ctx context.Context, t Table, f Family) ([]Con, error) {
 	data := putExtraHeader(uint8(f), unix.NFNETLINK_V0, 0)
 	req := netlink.Message{
 		Header: netlink.Header{
@@ -159,12 +251,22 @@ func (nfct *Nfct) Dump(t Table, f Family) ([]Con, error) {
 		return nil, ErrUnknownCtTable
 	}
 
-	return nfct.query(req)
+	return nfct.query(ctx, req)
 }
 
 // Create a new entry in the conntrack subsystem with certain attributes
 func (nfct *Nfct) Create(t Table, f Family, attributes Con) error {
-	query, err := nestAttributes(nfct.logger, &attributes)
+	return nfct.CreateContext(context.Background(), t, f, attributes)
+}
+
+// CreateContext is like Create, but the request is interrupted, once ctx is done.
+func (nfct *Nfct) CreateContext(ctx context.Context, t Table, f Family, attributes Con) error {
+	if t == Expected {
+		if err := checkExpect(&attributes); err != nil {
+			return err
+		}
+	}
+	query, err := nfct.changeAttributes(&attributes)
 	if err != nil {
 		return err
 	}
@@ -187,11 +289,16 @@ func (nfct *Nfct) Create(t Table, f Family, attributes Con) error {
 		return ErrUnknownCtTable
 	}
 
-	return nfct.execute(req)
+	return nfct.execute(ctx, req)
 }
 
 // Query conntrack subsystem with certain attributes
 func (nfct *Nfct) Query(t Table, f Family, filter FilterAttr) ([]Con, error) {
+	return nfct.QueryContext(context.Background(), t, f, filter)
+}
+
+// QueryContext is like Query, but the request is interrupted, once ctx is done.
+func (nfct *Nfct) QueryContext(ctx context.Context, t Table, f Family, filter FilterAttr) ([]Con, error) {
 	query, err := nestFilter(filter)
 	if err != nil {
 		return nil, err
@@ -214,11 +321,16 @@ func (nfct *Nfct) Query(t Table, f Family, filter FilterAttr) ([]Con, error) {
 	} else {
 		return nil, ErrUnknownCtTable
 	}
-	return nfct.query(req)
+	return nfct.query(ctx, req)
 }
 
 // Get returns matching conntrack entries with certain attributes
 func (nfct *Nfct) Get(t Table, f Family, match Con) ([]Con, error) {
+	return nfct.GetContext(context.Background(), t, f, match)
+}
+
+// GetContext is like Get, but the request is interrupted, once ctx is done.
+func (nfct *Nfct) GetContext(ctx context.Context, t Table, f Family, match Con) ([]Con, error) {
 	if t != Conntrack {
 		return nil, ErrUnknownCtTable
 	}
@@ -245,16 +357,21 @@ func (nfct *Nfct) Get(t Table, f Family, match Con) ([]Con, error) {
 		return []Con{}, ErrUnknownCtTable
 	}
 
-	return nfct.query(req)
+	return nfct.query(ctx, req)
 }
 
 // Update an existing conntrack entry
 func (nfct *Nfct) Update(t Table, f Family, attributes Con) error {
+	return nfct.UpdateContext(context.Background(), t, f, attributes)
+}
+
+// UpdateContext is like Update, but the request is interrupted, once ctx is done.
+func (nfct *Nfct) UpdateContext(ctx context.Context, t Table, f Family, attributes Con) error {
 	if t != Conntrack {
 		return ErrUnknownCtTable
 	}
 
-	query, err := nestAttributes(nfct.logger, &attributes)
+	query, err := nfct.changeAttributes(&attributes)
 	if err != nil {
 		return err
 	}
@@ -277,11 +394,16 @@ func (nfct *Nfct) Update(t Table, f Family, attributes Con) error {
 		return ErrUnknownCtTable
 	}
 
-	return nfct.execute(req)
+	return nfct.execute(ctx, req)
 }
 
 // Delete elements from the conntrack subsystem with certain attributes
 func (nfct *Nfct) Delete(t Table, f Family, filters Con) error {
+	return nfct.DeleteContext(context.Background(), t, f, filters)
+}
+
+// DeleteContext is like Delete, but the request is interrupted, once ctx is done.
+func (nfct *Nfct) DeleteContext(ctx context.Context, t Table, f Family, filters Con) error {
 	query, err := nestAttributes(nfct.logger, &filters)
 	if err != nil {
 		return err
@@ -305,11 +427,16 @@ func (nfct *Nfct) Delete(t Table, f Family, filters Con) error {
 		return ErrUnknownCtTable
 	}
 
-	return nfct.execute(req)
+	return nfct.execute(ctx, req)
 }
 
 // DumpCPUStats dumps per CPU statistics
 func (nfct *Nfct) DumpCPUStats(t Table) ([]CPUStat, error) {
+	return nfct.DumpCPUStatsContext(context.Background(), t)
+}
+
+// DumpCPUStatsContext is like DumpCPUStats, but the request is interrupted, once ctx is done.
+func (nfct *Nfct) DumpCPUStatsContext(ctx context.Context, t Table) ([]CPUStat, error) {
 	data := putExtraHeader(unix.AF_UNSPEC, unix.NFNETLINK_V0, 0)
 	req := netlink.Message{
 		Header: netlink.Header{
@@ -325,20 +452,58 @@ func (nfct *Nfct) DumpCPUStats(t Table) ([]CPUStat, error) {
 	} else {
 		return nil, ErrUnknownCtTable
 	}
-	return nfct.getCPUStats(req)
+	return nfct.getCPUStats(ctx, req)
 }
 
-// ParseAttributes extracts all the attributes from the given data
+// ParseAttributes extracts all the attributes from the given data.
+// Messages of all levels, e.g. about unknown attributes, are logged to logger.
 func ParseAttributes(logger *log.Logger, data []byte) (Con, error) {
 	// At least 2 bytes are needed for the header check
 	if len(data) < 2 {
 		return Con{}, ErrDataLength
 	}
 	c := Con{}
-	err := extractAttributes(logger, &c, data)
+	std := newStdLogger(logger)
+	std.debug = func() bool { return true }
+	err := extractAttributes(std, &c, data)
 	return c, err
 }
 
+// MarshalAttributes returns the netlink attributes of c, e.g. for NFQA_CT of
+// NFQUEUE. It is the counterpart of ParseAttributes and also encodes the
+// attributes of c.Unknown.
+func MarshalAttributes(c Con) ([]byte, error) {
+	return marshalAttributes(newStdLogger(nil), &c)
+}
+
+// MarshalExpectAttributes returns the netlink attributes of the expectation c,
+// e.g. for NFQA_EXP of NFQUEUE. Like Create, it requires the master, tuple and
+// mask of the expectation.
+func MarshalExpectAttributes(c Con) ([]byte, error) {
+	if err := checkExpect(&c); err != nil {
+		return nil, err
+	}
+	return marshalAttributes(newStdLogger(nil), &c)
+}
+
+// marshalAttributes returns the netlink attributes of c including c.Unknown.
+func marshalAttributes(logger LeveledLogger, c *Con) ([]byte, error) {
+	data, err := nestAttributes(logger, c)
+	if err != nil || len(c.Unknown) == 0 {
+		return data, err
+	}
+	return addUnknownAttributes(data, c.Unknown)
+}
+
+// changeAttributes returns the netlink attributes of c for Create and Update.
+// c.Unknown is only included, if SendUnknownAttributes was set.
+func (nfct *Nfct) changeAttributes(c *Con) ([]byte, error) {
+	if nfct.sendUnknownAttributes {
+		return marshalAttributes(nfct.logger, c)
+	}
+	return nestAttributes(nfct.logger, c)
+}
+
 // HookFunc is a function, that receives events from a Netlinkgroup.
 // Return something different than 0, to stop receiving messages.
 type HookFunc func(c Con) int
@@ -346,7 +511,8 @@ type HookFunc func(c Con) int
 // AttachErrChan creates and attaches an error channel to the Nfct object.
 // If an unexpected error is received this error will be reported via this
 // channel.
-// A call of (*Nfct).Close() will also close this channel.
+// A call of (*Nfct).Close() will also close this channel, once no more
+// errors can be reported.
 func (nfct *Nfct) AttachErrChan() <-chan error {
 	if nfct.errChan != nil {
 		return nfct.errChan
@@ -359,8 +525,11 @@ func (nfct *Nfct) AttachErrChan() <-chan error {
 // Register your function to receive events from a Netlinkgroup. If an unexpected error
 // is received it will stop from processing further events.
 // If your function returns something different than 0, it will stop.
+// Register does not return a handle of the subscription. Use Subscribe to
+// stop a single subscription, wait for it or get its error.
 func (nfct *Nfct) Register(ctx context.Context, t Table, group NetlinkGroup, fn HookFunc) error {
-	return nfct.register(ctx, t, group, []ConnAttr{}, fn)
+	_, err := nfct.subscribe(ctx, EventOptions{Table: t, Groups: group}, hookEvent(fn), nil)
+	return err
 }
 
 // RegisterFiltered registers your function to receive events from a Netlinkgroup and applies a filter.
@@ -371,115 +540,66 @@ func (nfct *Nfct) Register(ctx context.Context, t Table, group NetlinkGroup, fn
 // Note: When you add filters for IPv4 specific fields, it will automatically filter for IPv4-only events.
 // The same rule applies for IPv6. However, if you apply a filter for both IPv4- and IPv6-specific fields,
 // it will result in filtering out all events, meaning no event will match.
+// Large sets of values of an attribute are searched in a binary search. If the filter still
+// exceeds the limit of instructions of the kernel, the events are filtered in userspace.
+// For the Expected table, the AttrMaster types filter the master tuple, the AttrOrig types the
+// expected tuple and AttrHelperName, AttrZone, AttrTimeout and the AttrExp types the expectation.
+// RegisterFiltered does not return a handle of the subscription. Use Subscribe with
+// Filter of EventOptions to stop a single subscription, wait for it or get its error.
 func (nfct *Nfct) RegisterFiltered(ctx context.Context, t Table, group NetlinkGroup, filter []ConnAttr, fn HookFunc) error {
-	return nfct.register(ctx, t, group, filter, fn)
+	_, err := nfct.subscribe(ctx, EventOptions{Table: t, Groups: group, Filter: filter}, hookEvent(fn), nil)
+	return err
 }
 
-// EnableDebug print bpf filter for RegisterFiltered function
-func (nfct *Nfct) EnableDebug() {
-	nfct.debug = true
+// RegisterEvents registers your function to receive typed events from a Netlinkgroup.
+// Every received message is delivered as Event, that carries the kind of the event,
+// the table and details of the netlink header besides the connection itself.
+// The filter is applied in the same way as for RegisterFiltered and can be empty.
+// If your function returns something different than 0, it will stop.
+// RegisterEvents does not return a handle of the subscription. Subscribe is the
+// only way to get one, e.g. to stop a single subscription, wait for it or get its error.
+func (nfct *Nfct) RegisterEvents(ctx context.Context, t Table, group NetlinkGroup, filter []ConnAttr, fn EventFunc) error {
+	_, err := nfct.subscribe(ctx, EventOptions{Table: t, Groups: group, Filter: filter}, fn, nil)
+	return err
 }
 
-func (nfct *Nfct) register(ctx context.Context, t Table, groups NetlinkGroup, filter []ConnAttr, fn func(c Con) int) error {
-	nfct.ctx, nfct.ctxCancel = context.WithCancel(ctx)
-	nfct.shutdown = make(chan struct{})
-
-	if err := nfct.manageGroups(t, uint32(groups), true); err != nil {
-		return err
-	}
-	if err := nfct.attachFilter(t, filter); err != nil {
-		return err
-	}
+// EnableDebug print bpf filter for RegisterFiltered function and messages of
+// the debug level to Logger of Config.
+func (nfct *Nfct) EnableDebug() {
+	atomic.StoreUint32(&nfct.debug, 1)
+}
 
-	enricher := func(*Con, netlink.Header) {}
-	if nfct.addConntrackInformation {
-		enricher = func(c *Con, h netlink.Header) {
-			var group NetlinkGroup
+// newDebugLogger returns a LeveledLogger for logger, that logs messages of the
+// debug level, once EnableDebug was called or if Trace is set.
+func (nfct *Nfct) newDebugLogger(logger *log.Logger) LeveledLogger {
+	std := newStdLogger(logger)
+	std.debug = func() bool { return nfct.debugEnabled() || nfct.trace }
+	return std
+}
 
-			if h.Type&0xFF == ipctnlMsgCtNew {
-				if h.Flags&(netlink.Create|netlink.Excl) != 0 {
-					group = NetlinkCtNew
-				} else {
-					group = NetlinkCtUpdate
-				}
-			} else {
-				group = NetlinkCtDestroy
-			}
+// debugEnabled returns true, if EnableDebug was called.
+func (nfct *Nfct) debugEnabled() bool {
+	return atomic.LoadUint32(&nfct.debug) != 0
+}
 
-			info := InfoSource{
-				Table:        Table((h.Type & 0x300) >> 8),
-				NetlinkGroup: group,
-			}
-			c.Info = &info
-		}
+// hookEvent adapts a HookFunc to the EventFunc used internally.
+func hookEvent(fn HookFunc) EventFunc {
+	return func(e Event) int {
+		return fn(e.Con)
 	}
-
-	go func() {
-		go func() {
-			// block until context is done
-			<-nfct.ctx.Done()
-			// Set the read deadline to a point in the past to interrupt
-			// possible blocking Receive() calls.
-			nfct.Con.SetReadDeadline(time.Now().Add(-1 * time.Second))
-
-			if err := nfct.removeFilter(); err != nil {
-				nfct.logger.Printf("could not remove filter: %v", err)
-			}
-			if err := nfct.manageGroups(t, uint32(groups), false); err != nil {
-				nfct.logger.Printf("could not unsubscribe from group: %v", err)
-			}
-			close(nfct.shutdown)
-		}()
-
-		for {
-			reply, err := nfct.Con.Receive()
-			if err != nil {
-				if nfct.ctx.Err() != nil {
-					// TODO: Here we ignore internal/poll.ErrFileClosing which is expected after
-					//       nfct.ctx is done. Maybe improve graceful handling.
-					return
-				}
-				if opError, ok := err.(*netlink.OpError); ok {
-					if opError.Timeout() || opError.Temporary() {
-						continue
-					}
-				}
-				if nfct.errChan != nil {
-					nfct.errChan <- err
-				} else {
-					nfct.logger.Printf("receiving error: %v", err)
-				}
-				return
-			}
-
-			c := Con{}
-			for _, msg := range reply {
-				if err := parseConnectionMsg(nfct.logger, &c, msg, (int(msg.Header.Type)&0x300)>>8, int(msg.Header.Type)&0xF); err != nil {
-					nfct.logger.Printf("could not parse received message: %v", err)
-					continue
-				}
-				enricher(&c, msg.Header)
-				if ret := fn(c); ret != 0 {
-					return
-				}
-			}
-
-		}
-	}()
-	return nil
 }
 
-func (nfct *Nfct) manageGroups(t Table, groups uint32, join bool) error {
+func (nfct *Nfct) manageGroups(con *netlink.Conn, t Table, groups uint32, join bool) error {
 	var manage func(group uint32) error
 
 	if groups == 0 {
-		nfct.logger.Println("will not join group 0")
+		nfct.logger.Info("will not join group 0")
 		return nil
 	}
 
-	manage = nfct.Con.LeaveGroup
+	manage = con.LeaveGroup
 	if join {
-		manage = nfct.Con.JoinGroup
+		manage = con.JoinGroup
 	}
 
 	var mapping map[uint32]uint32
@@ -523,104 +643,214 @@ type ErrMsg struct {
 	Pid   uint32
 }
 
-func unmarschalErrMsg(b []byte) (ErrMsg, error) {
-	var msg ErrMsg
+// drainTimeout limits the time to discard the remaining replies of an
+// interrupted request.
+var drainTimeout = 100 * time.Millisecond
 
-	msg.Code = int(nlenc.Uint32(b[0:4]))
-	msg.Len = nlenc.Uint32(b[4:8])
-	msg.Type = nlenc.Uint16(b[8:10])
-	msg.Flags = nlenc.Uint16(b[10:12])
-	msg.Seq = nlenc.Uint32(b[12:16])
-	msg.Pid = nlenc.Uint32(b[16:20])
+// withContext calls fn and interrupts blocking operations on con, once ctx is done.
+func (nfct *Nfct) withContext(ctx context.Context, con *netlink.Conn, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline && ctx.Done() == nil {
+		return fn()
+	}
+	if hasDeadline {
+		if err := con.SetDeadline(deadline); err != nil {
+			nfct.logger.Warn("could not set deadline", "error", err)
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// Set the deadline to a point in the past to interrupt
+			// blocking Send() and Receive() calls.
+			if err := con.SetDeadline(time.Now().Add(-1 * time.Second)); err != nil {
+				nfct.logger.Warn("could not set deadline", "error", err)
+			}
+		case <-stop:
+		}
+	}()
+
+	err := fn()
+	close(stop)
+	<-stopped
 
-	return msg, nil
+	if err := con.SetDeadline(time.Time{}); err != nil {
+		nfct.logger.Warn("could not reset deadline", "error", err)
+	}
+	if err != nil && (ctx.Err() != nil || hasDeadline && !time.Now().Before(deadline)) {
+		// Replies to the interrupted request might still be pending.
+		nfct.drain(con)
+		nfct.abandonRequestCon(con)
+		if ctx.Err() == nil {
+			// The deadline of con expired before ctx is marked as done.
+			return context.DeadlineExceeded
+		}
+		return ctx.Err()
+	}
+	return err
 }
 
-func (nfct *Nfct) execute(req netlink.Message) error {
-	if err := nfct.setWriteTimeout(); err != nil {
-		nfct.logger.Printf("could not set write timeout: %v", err)
+// drain discards pending replies on con.
+func (nfct *Nfct) drain(con *netlink.Conn) {
+	if err := con.SetReadDeadline(time.Now().Add(drainTimeout)); err != nil {
+		return
 	}
-	reply, e := nfct.Con.Execute(req)
-	if e != nil {
-		return e
+	defer func() {
+		if err := con.SetReadDeadline(time.Time{}); err != nil {
+			nfct.logger.Warn("could not reset read deadline", "error", err)
+		}
+	}()
+	for {
+		msgs, err := con.Receive()
+		if err != nil || len(msgs) == 0 {
+			return
+		}
+		nfct.record(DirectionReceived, msgs)
 	}
-	if e := netlink.Validate(req, reply); e != nil {
-		return e
+}
+
+func (nfct *Nfct) execute(ctx context.Context, req netlink.Message) error {
+	con, release, err := nfct.acquireRequestCon(ctx)
+	if err != nil {
+		return err
 	}
-	for _, msg := range reply {
-		errMsg, err := unmarschalErrMsg(msg.Data)
+	defer release()
+	return nfct.withContext(ctx, con, func() error {
+		sent, err := nfct.send(con, req)
 		if err != nil {
 			return err
 		}
-		if errMsg.Code != 0 {
-			return fmt.Errorf("%#v", errMsg)
+		reply, err := nfct.receive(con, sent)
+		if err != nil {
+			return err
 		}
-	}
-	return nil
+		if err := netlink.Validate(sent, reply); err != nil {
+			return err
+		}
+		for _, msg := range reply {
+			if err := errorFromMsg(sent, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func (nfct *Nfct) send(req netlink.Message) error {
-	if err := nfct.setWriteTimeout(); err != nil {
-		nfct.logger.Printf("could not set write timeout: %v", err)
+// send req via con and return the message as it was sent.
+func (nfct *Nfct) send(con *netlink.Conn, req netlink.Message) (netlink.Message, error) {
+	if err := nfct.setWriteTimeout(con); err != nil {
+		nfct.logger.Warn("could not set write timeout", "error", err)
 	}
-	verify, err := nfct.Con.Send(req)
+	verify, err := con.Send(req)
 	if err != nil {
-		return err
+		return netlink.Message{}, err
 	}
 
 	if err := netlink.Validate(req, []netlink.Message{verify}); err != nil {
-		return err
+		return netlink.Message{}, err
 	}
+	nfct.record(DirectionSent, []netlink.Message{verify})
 
-	return nil
+	return verify, nil
 }
 
-func (nfct *Nfct) query(req netlink.Message) ([]Con, error) {
-	if err := nfct.send(req); err != nil {
-		return nil, err
+// receive returns the reply to req. Replies to previous requests are discarded.
+func (nfct *Nfct) receive(con *netlink.Conn, req netlink.Message) ([]netlink.Message, error) {
+	for {
+		reply, err := con.Receive()
+		if err != nil {
+			err = newError(req, err)
+			nfct.recordError(req, err)
+			return nil, err
+		}
+		nfct.record(DirectionReceived, reply)
+		if len(reply) > 0 && reply[0].Header.Sequence != req.Header.Sequence {
+			nfct.logger.Debug("discard reply to previous request", "sequence", reply[0].Header.Sequence)
+			continue
+		}
+		return reply, nil
 	}
+}
 
-	reply, err := nfct.Con.Receive()
+func (nfct *Nfct) query(ctx context.Context, req netlink.Message) ([]Con, error) {
+	con, release, err := nfct.acquireRequestCon(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
 
 	var conn []Con
-	for _, msg := range reply {
-		c := Con{}
-		if err := parseConnectionMsg(nfct.logger, &c, msg, (int(req.Header.Type)&0x300)>>8, int(req.Header.Type)&0xF); err != nil {
-			return nil, err
+	var interrupted bool
+	err = nfct.withContext(ctx, con, func() error {
+		sent, err := nfct.send(con, req)
+		if err != nil {
+			return err
 		}
-		// check if c is an empty struct
-		if (Con{}) == c {
-			continue
+		reply, err := nfct.receive(con, sent)
+		if err != nil {
+			return err
 		}
-		conn = append(conn, c)
+
+		for _, msg := range reply {
+			if msg.Header.Flags&netlink.DumpInterrupted != 0 {
+				interrupted = true
+			}
+			c := Con{}
+			if err := parseConnectionMsg(nfct.logger, &c, msg, (int(req.Header.Type)&0x300)>>8, int(req.Header.Type)&0xF); err != nil {
+				var e *Error
+				if errors.As(err, &e) {
+					e.Request = sent
+				}
+				return err
+			}
+			// check if c is an empty struct
+			if reflect.DeepEqual(Con{}, c) {
+				continue
+			}
+			conn = append(conn, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if interrupted {
+		return conn, ErrDumpInterrupted
 	}
 	return conn, nil
 }
 
-func (nfct *Nfct) getCPUStats(req netlink.Message) ([]CPUStat, error) {
+func (nfct *Nfct) getCPUStats(ctx context.Context, req netlink.Message) ([]CPUStat, error) {
 	var stats []CPUStat
-	if err := nfct.send(req); err != nil {
+	con, release, err := nfct.acquireRequestCon(ctx)
+	if err != nil {
 		return nil, err
 	}
-	reply, err := nfct.Con.Receive()
-	if err != nil {
+	defer release()
+	var reply []netlink.Message
+	if err := nfct.withContext(ctx, con, func() error {
+		sent, err := nfct.send(con, req)
+		if err != nil {
+			return err
+		}
+		reply, err = nfct.receive(con, sent)
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
 	for _, msg := range reply {
 		if msg.Header.Type == netlink.Error {
-			errMsg, err := unmarschalErrMsg(msg.Data)
-			if err != nil {
-				nfct.logger.Printf("could not unmarshal ErrMsg: %v", err)
-				continue
-			}
-			if errMsg.Code == 0 {
-				continue
+			if err := errorFromMsg(req, msg); err != nil {
+				nfct.logger.Warn("unknown error", "error", err)
 			}
-			nfct.logger.Printf("unknown error: %v", errMsg)
 			continue
 		}
 
@@ -629,12 +859,12 @@ func (nfct *Nfct) getCPUStats(req netlink.Message) ([]CPUStat, error) {
 		switch Table((int(req.Header.Type) & 0x300) >> 8) {
 		case Conntrack:
 			if err := extractCPUStats(&stat, nfct.logger, msg.Data[offset:]); err != nil {
-				nfct.logger.Printf("could not extract CPU stats: %v", err)
+				nfct.logger.Warn("could not extract CPU stats", "table", Conntrack, "error", err)
 				continue
 			}
 		case Expected:
 			if err := extractExpCPUStats(&stat, nfct.logger, msg.Data[offset:]); err != nil {
-				nfct.logger.Printf("could not extract CPU stats: %v", err)
+				nfct.logger.Warn("could not extract CPU stats", "table", Expected, "error", err)
 				continue
 			}
 		default:
@@ -653,19 +883,14 @@ func putExtraHeader(familiy, version uint8, resid uint16) []byte {
 	return append([]byte{familiy, version}, buf...)
 }
 
-type extractFunc func(*log.Logger, *Con, []byte) error
+type extractFunc func(LeveledLogger, *Con, []byte) error
 
-func parseConnectionMsg(logger *log.Logger, c *Con, msg netlink.Message, reqTable, reqType int) error {
+func parseConnectionMsg(logger LeveledLogger, c *Con, msg netlink.Message, reqTable, reqType int) error {
 	if msg.Header.Type == netlink.Error {
-		errMsg, err := unmarschalErrMsg(msg.Data)
-		if err != nil {
-			return err
-		}
-		if errMsg.Code == 0 {
-			return nil
-		}
-		return fmt.Errorf("%#v", errMsg)
+		return errorFromMsg(netlink.Message{}, msg)
 	}
+	name, _ := messageType(msg.Header.Type)
+	logger = withFields(logger, "table", reqTable, "message", name)
 
 	var fnMap map[int]extractFunc
 
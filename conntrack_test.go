@@ -1,8 +1,13 @@
 package conntrack
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/mdlayher/netlink"
 	"github.com/mdlayher/netlink/nltest"
@@ -204,3 +209,168 @@ func TestCreate(t *testing.T) {
 		})
 	}
 }
+
+// optionSocket records the socket options set on it.
+type optionSocket struct {
+	*eventSocket
+	options map[netlink.ConnOption]bool
+	refuse  map[netlink.ConnOption]bool
+}
+
+func (s *optionSocket) SetOption(option netlink.ConnOption, enable bool) error {
+	if s.refuse[option] {
+		return syscall.ENOPROTOOPT
+	}
+	s.options[option] = enable
+	return nil
+}
+
+func TestConfigureCon(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		refuse  netlink.ConnOption
+		options []netlink.ConnOption
+		err     bool
+	}{
+		{name: "noOptions"},
+		{
+			name:    "allOptions",
+			config:  Config{NoENOBUFS: true, BroadcastError: true, StrictCheck: true, ExtendedAcknowledge: true},
+			options: []netlink.ConnOption{netlink.NoENOBUFS, netlink.BroadcastError, netlink.GetStrictCheck, netlink.ExtendedAcknowledge},
+		},
+		{
+			name:   "refused",
+			config: Config{StrictCheck: true},
+			refuse: netlink.GetStrictCheck,
+			err:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sock := &optionSocket{
+				eventSocket: newEventSocket(),
+				options:     make(map[netlink.ConnOption]bool),
+				refuse:      map[netlink.ConnOption]bool{},
+			}
+			if tc.err {
+				sock.refuse[tc.refuse] = true
+			}
+			err := configureCon(netlink.NewConn(sock, 1), &tc.config)
+			if tc.err {
+				if !errors.Is(err, syscall.ENOPROTOOPT) {
+					t.Fatalf("expected refused option, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(sock.options) != len(tc.options) {
+				t.Fatalf("unexpected options: %v", sock.options)
+			}
+			for _, option := range tc.options {
+				if !sock.options[option] {
+					t.Fatalf("option %d is not set", option)
+				}
+			}
+		})
+	}
+}
+
+func TestDumpContext(t *testing.T) {
+	// entry returns a dumped conntrack entry with CTA_ID set to id.
+	entry := func(seq uint32, id byte) netlink.Message {
+		return netlink.Message{
+			// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_NEW
+			Header: netlink.Header{Type: netlink.HeaderType(1 << 8), Sequence: seq},
+			Data:   []byte{0x2, 0x0, 0x0, 0x0, 0x8, 0x0, 0xc, 0x0, 0x0, 0x0, 0x0, id},
+		}
+	}
+
+	sock := newEventSocket()
+	nfct := &Nfct{
+		Con:    netlink.NewConn(sock, 1),
+		logger: newStdLogger(nil),
+	}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	defer nfct.Close()
+
+	// The kernel does not reply to the first request.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := nfct.DumpContext(ctx, Conntrack, IPv4); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A late reply to a previous request is discarded.
+	sock.msgs <- []netlink.Message{entry(0, 1)}
+	sock.handler = func(req netlink.Message) []netlink.Message {
+		return []netlink.Message{entry(req.Header.Sequence, 2)}
+	}
+	cons, err := nfct.DumpContext(context.Background(), Conntrack, IPv4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cons) != 1 || cons[0].ID == nil || *cons[0].ID != 2 {
+		t.Fatalf("unexpected entries: %#v", cons)
+	}
+
+	// A cancelled context does not send the request.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := nfct.FlushContext(ctx, Conntrack, IPv4); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMarshalAttributes(t *testing.T) {
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	var proto uint8 = 6
+	var port, mark uint32 = 21, 0x10
+	sport := uint16(port)
+	tuple := &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, DstPort: &sport}}
+
+	data, err := MarshalAttributes(Con{Origin: tuple, Mark: &mark})
+	if err != nil {
+		t.Fatalf("could not marshal attributes: %v", err)
+	}
+	c, err := ParseAttributes(log.New(new(devNull), "", 0), data)
+	if err != nil {
+		t.Fatalf("could not parse attributes: %v", err)
+	}
+	if c.Mark == nil || *c.Mark != mark || c.Origin == nil || !c.Origin.Src.Equal(src) || *c.Origin.Proto.DstPort != sport {
+		t.Fatalf("unexpected connection: %#v", c)
+	}
+
+	tests := map[string]struct {
+		exp Con
+		err error
+	}{
+		"complete":         {exp: Con{Exp: &Exp{Master: tuple, Tuple: tuple, Mask: tuple}}},
+		"master as origin": {exp: Con{Origin: tuple, Exp: &Exp{Tuple: tuple, Mask: tuple}}},
+		"no expectation":   {exp: Con{Origin: tuple}, err: ErrAttrMissing},
+		"no master":        {exp: Con{Exp: &Exp{Tuple: tuple, Mask: tuple}}, err: ErrAttrMissing},
+		"no mask":          {exp: Con{Exp: &Exp{Master: tuple, Tuple: tuple}}, err: ErrAttrMissing},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := MarshalExpectAttributes(tc.exp)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.err == nil {
+				if len(data) == 0 {
+					t.Fatal("no attributes")
+				}
+				return
+			}
+			// Create rejects the expectation before sending it.
+			nfct := &Nfct{logger: newStdLogger(nil)}
+			if err := nfct.Create(Expected, IPv4, tc.exp); !errors.Is(err, tc.err) {
+				t.Fatalf("unexpected error of Create: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+// Package conntracktest provides an in-memory implementation of conntrack.Interface
+// and a fake kernel on the level of netlink messages to test code using
+// conntrack without the need of CAP_NET_ADMIN.
+package conntracktest
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/florianl/go-conntrack/internal/unix"
+)
+
+// defaultBufferSize is used for the event queues of registered functions.
+const defaultBufferSize = 64
+
+// Fake is an in-memory conntrack table. It mimics the behavior of the kernel
+// for requests and sends events to its subscribers. Filters of subscriptions
+// are evaluated by ct.Matcher. The zero value is not usable, use New instead.
+type Fake struct {
+	mu      sync.Mutex
+	entries map[ct.Table][]*entry
+	nextID  uint32
+	stats   ct.CPUStat
+	subs    map[*subscriber]struct{}
+}
+
+var _ ct.Interface = (*Fake)(nil)
+
+type entry struct {
+	family ct.Family
+	con    ct.Con
+}
+
+// New returns an empty Fake.
+func New() *Fake {
+	return &Fake{
+		entries: make(map[ct.Table][]*entry),
+		nextID:  1,
+		stats: ct.CPUStat{
+			Found:        new(uint32),
+			Insert:       new(uint32),
+			InsertFailed: new(uint32),
+			ExpCreate:    new(uint32),
+			ExpDelete:    new(uint32),
+		},
+		subs: make(map[*subscriber]struct{}),
+	}
+}
+
+// Close stops all subscriptions.
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	subs := make([]*subscriber, 0, len(f.subs))
+	for s := range f.subs {
+		subs = append(subs, s)
+	}
+	f.subs = make(map[*subscriber]struct{})
+	f.mu.Unlock()
+
+	for _, s := range subs {
+		s.stop()
+	}
+	return nil
+}
+
+// Flush removes all entries of the family from the table.
+func (f *Fake) Flush(t ct.Table, family ct.Family) error {
+	return f.FlushContext(context.Background(), t, family)
+}
+
+// FlushContext removes all entries of the family from the table.
+func (f *Fake) FlushContext(ctx context.Context, t ct.Table, family ct.Family) error {
+	if err := checkTable(ctx, t); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	var kept, removed []*entry
+	for _, e := range f.entries[t] {
+		if matchFamily(e, family) {
+			removed = append(removed, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	f.entries[t] = kept
+	for _, e := range removed {
+		f.emit(t, ct.EventDestroy, e.con)
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+// Dump returns all entries of the family.
+func (f *Fake) Dump(t ct.Table, family ct.Family) ([]ct.Con, error) {
+	return f.DumpContext(context.Background(), t, family)
+}
+
+// DumpContext returns all entries of the family.
+func (f *Fake) DumpContext(ctx context.Context, t ct.Table, family ct.Family) ([]ct.Con, error) {
+	if err := checkTable(ctx, t); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var cons []ct.Con
+	for _, e := range f.entries[t] {
+		if matchFamily(e, family) {
+			cons = append(cons, copyCon(e.con))
+		}
+	}
+	return cons, nil
+}
+
+// Create a new entry. ErrExists is returned, if an entry with the same tuple exists.
+func (f *Fake) Create(t ct.Table, family ct.Family, attributes ct.Con) error {
+	return f.CreateContext(context.Background(), t, family, attributes)
+}
+
+// CreateContext creates a new entry. ErrExists is returned, if an entry with the
+// same tuple exists.
+func (f *Fake) CreateContext(ctx context.Context, t ct.Table, family ct.Family, attributes ct.Con) error {
+	if err := checkTable(ctx, t); err != nil {
+		return err
+	}
+	con := copyCon(attributes)
+	con.Info = nil
+
+	f.mu.Lock()
+	switch t {
+	case ct.Conntrack:
+		if con.Origin == nil && con.Reply == nil {
+			f.mu.Unlock()
+			return kernelError(unix.EINVAL)
+		}
+		if con.Origin == nil {
+			con.Origin = invert(con.Reply)
+		}
+		if con.Reply == nil {
+			con.Reply = invert(con.Origin)
+		}
+		if f.lookup(t, con) != nil {
+			*f.stats.InsertFailed++
+			f.mu.Unlock()
+			return kernelError(unix.EEXIST)
+		}
+		id := f.nextID
+		con.ID = &id
+		*f.stats.Insert++
+	case ct.Expected:
+		if con.Exp == nil || con.Exp.Tuple == nil || con.Exp.Master == nil {
+			f.mu.Unlock()
+			return kernelError(unix.EINVAL)
+		}
+		if f.lookup(ct.Conntrack, ct.Con{Origin: con.Exp.Master}) == nil {
+			f.mu.Unlock()
+			return kernelError(unix.ENOENT)
+		}
+		if f.lookup(t, con) != nil {
+			f.mu.Unlock()
+			return kernelError(unix.EEXIST)
+		}
+		id := f.nextID
+		con.Exp.ID = &id
+		*f.stats.ExpCreate++
+	}
+	f.nextID++
+	f.entries[t] = append(f.entries[t], &entry{family: family, con: con})
+	f.emit(t, ct.EventNew, con)
+	f.mu.Unlock()
+	return nil
+}
+
+// Query returns the entries of the family, that match the mark in filter.
+func (f *Fake) Query(t ct.Table, family ct.Family, filter ct.FilterAttr) ([]ct.Con, error) {
+	return f.QueryContext(context.Background(), t, family, filter)
+}
+
+// QueryContext returns the entries of the family, that match the mark in filter.
+func (f *Fake) QueryContext(ctx context.Context, t ct.Table, family ct.Family, filter ct.FilterAttr) ([]ct.Con, error) {
+	if len(filter.Mark) != 4 || len(filter.MarkMask) != 4 {
+		return nil, ct.ErrFilterAttrLength
+	}
+	cons, err := f.DumpContext(ctx, t, family)
+	if err != nil || t != ct.Conntrack {
+		return cons, err
+	}
+	mark := binary.BigEndian.Uint32(filter.Mark)
+	mask := binary.BigEndian.Uint32(filter.MarkMask)
+
+	var matches []ct.Con
+	for _, c := range cons {
+		var m uint32
+		if c.Mark != nil {
+			m = *c.Mark
+		}
+		if m&mask == mark&mask {
+			matches = append(matches, c)
+		}
+	}
+	return matches, nil
+}
+
+// Get returns the entry with the tuple or ID of match. ErrNotFound is returned,
+// if there is no such entry.
+func (f *Fake) Get(t ct.Table, family ct.Family, match ct.Con) ([]ct.Con, error) {
+	return f.GetContext(context.Background(), t, family, match)
+}
+
+// GetContext returns the entry with the tuple or ID of match. ErrNotFound is
+// returned, if there is no such entry.
+func (f *Fake) GetContext(ctx context.Context, t ct.Table, family ct.Family, match ct.Con) ([]ct.Con, error) {
+	if t != ct.Conntrack {
+		return nil, ct.ErrUnknownCtTable
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	e := f.lookup(t, match)
+	if e == nil {
+		return nil, kernelError(unix.ENOENT)
+	}
+	*f.stats.Found++
+	return []ct.Con{copyCon(e.con)}, nil
+}
+
+// Update the entry with the tuple or ID of attributes. ErrNotFound is returned,
+// if there is no such entry.
+func (f *Fake) Update(t ct.Table, family ct.Family, attributes ct.Con) error {
+	return f.UpdateContext(context.Background(), t, family, attributes)
+}
+
+// UpdateContext updates the entry with the tuple or ID of attributes.
+// ErrNotFound is returned, if there is no such entry.
+func (f *Fake) UpdateContext(ctx context.Context, t ct.Table, family ct.Family, attributes ct.Con) error {
+	if t != ct.Conntrack {
+		return ct.ErrUnknownCtTable
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	e := f.lookup(t, attributes)
+	if e == nil {
+		f.mu.Unlock()
+		return kernelError(unix.ENOENT)
+	}
+	merge(&e.con, copyCon(attributes))
+	f.emit(t, ct.EventUpdate, e.con)
+	f.mu.Unlock()
+	return nil
+}
+
+// Delete the entry with the tuple or ID of filters. ErrNotFound is returned,
+// if there is no such entry.
+func (f *Fake) Delete(t ct.Table, family ct.Family, filters ct.Con) error {
+	return f.DeleteContext(context.Background(), t, family, filters)
+}
+
+// DeleteContext deletes the entry with the tuple or ID of filters.
+// ErrNotFound is returned, if there is no such entry.
+func (f *Fake) DeleteContext(ctx context.Context, t ct.Table, family ct.Family, filters ct.Con) error {
+	if err := checkTable(ctx, t); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	e := f.lookup(t, filters)
+	if e == nil {
+		f.mu.Unlock()
+		return kernelError(unix.ENOENT)
+	}
+	entries := f.entries[t][:0]
+	for _, other := range f.entries[t] {
+		if other != e {
+			entries = append(entries, other)
+		}
+	}
+	f.entries[t] = entries
+	if t == ct.Expected {
+		*f.stats.ExpDelete++
+	}
+	f.emit(t, ct.EventDestroy, e.con)
+	f.mu.Unlock()
+	return nil
+}
+
+// DumpCPUStats returns the statistics of a single CPU, which count the
+// operations on the table.
+func (f *Fake) DumpCPUStats(t ct.Table) ([]ct.CPUStat, error) {
+	return f.DumpCPUStatsContext(context.Background(), t)
+}
+
+// DumpCPUStatsContext returns the statistics of a single CPU, which count the
+// operations on the table. ExpNew is not set, as the Fake does not create
+// entries for expected connections.
+func (f *Fake) DumpCPUStatsContext(ctx context.Context, t ct.Table) ([]ct.CPUStat, error) {
+	if err := checkTable(ctx, t); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	u32 := func(v uint32) *uint32 { return &v }
+	var stat ct.CPUStat
+	switch t {
+	case ct.Conntrack:
+		stat.Found = u32(*f.stats.Found)
+		stat.Insert = u32(*f.stats.Insert)
+		stat.InsertFailed = u32(*f.stats.InsertFailed)
+	case ct.Expected:
+		stat.ExpCreate = u32(*f.stats.ExpCreate)
+		stat.ExpDelete = u32(*f.stats.ExpDelete)
+	}
+	return []ct.CPUStat{stat}, nil
+}
+
+// lookup returns the entry with the same tuple or ID as c. The caller must hold mu.
+func (f *Fake) lookup(t ct.Table, c ct.Con) *entry {
+	for _, e := range f.entries[t] {
+		if t == ct.Expected {
+			if c.Exp == nil {
+				continue
+			}
+			if c.Exp.ID != nil && *c.Exp.ID == *e.con.Exp.ID {
+				return e
+			}
+			if c.Exp.Tuple != nil && tupleKey(c.Exp.Tuple) == tupleKey(e.con.Exp.Tuple) {
+				return e
+			}
+			continue
+		}
+		if c.ID != nil && *c.ID == *e.con.ID {
+			return e
+		}
+		if c.Origin != nil && (tupleKey(c.Origin) == tupleKey(e.con.Origin) || tupleKey(c.Origin) == tupleKey(e.con.Reply)) {
+			return e
+		}
+		if c.Reply != nil && (tupleKey(c.Reply) == tupleKey(e.con.Reply) || tupleKey(c.Reply) == tupleKey(e.con.Origin)) {
+			return e
+		}
+	}
+	return nil
+}
+
+func checkTable(ctx context.Context, t ct.Table) error {
+	if t != ct.Conntrack && t != ct.Expected {
+		return ct.ErrUnknownCtTable
+	}
+	return ctx.Err()
+}
+
+func kernelError(errno syscall.Errno) error {
+	return &ct.Error{Errno: errno}
+}
+
+func matchFamily(e *entry, f ct.Family) bool {
+	return f == unix.AF_UNSPEC || e.family == unix.AF_UNSPEC || e.family == f
+}
+
+// invert returns the tuple of the opposite direction.
+func invert(t *ct.IPTuple) *ct.IPTuple {
+	inv := copyCon(ct.Con{Origin: t}).Origin
+	inv.Src, inv.Dst = inv.Dst, inv.Src
+	if p := inv.Proto; p != nil {
+		p.SrcPort, p.DstPort = p.DstPort, p.SrcPort
+	}
+	return inv
+}
+
+// tupleKey returns a comparable representation of t.
+func tupleKey(t *ct.IPTuple) string {
+	if t == nil {
+		return ""
+	}
+	ip := func(ip *net.IP) string {
+		if ip == nil {
+			return ""
+		}
+		return ip.String()
+	}
+	u8 := func(v *uint8) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprint(*v)
+	}
+	u16 := func(v *uint16) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprint(*v)
+	}
+	key := ip(t.Src) + ">" + ip(t.Dst) + "@" + u16(t.Zone)
+	if p := t.Proto; p != nil {
+		key += "/" + u8(p.Number) + "/" + u16(p.SrcPort) + "/" + u16(p.DstPort) + "/" + u16(p.IcmpID) + "/" + u16(p.Icmpv6ID)
+	}
+	return key
+}
+
+// merge sets all fields of dst, that are set in src, except the identifying ones.
+func merge(dst *ct.Con, src ct.Con) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src)
+	for i := 0; i < s.NumField(); i++ {
+		switch d.Type().Field(i).Name {
+		case "Info", "Origin", "Reply", "ID", "Exp":
+			continue
+		}
+		if !s.Field(i).IsZero() {
+			d.Field(i).Set(s.Field(i))
+		}
+	}
+}
+
+// copyCon returns a deep copy of c.
+func copyCon(c ct.Con) ct.Con {
+	return deepCopy(reflect.ValueOf(c)).Interface().(ct.Con)
+}
+
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		p := reflect.New(v.Elem().Type())
+		p.Elem().Set(deepCopy(v.Elem()))
+		return p
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return s
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			return v
+		}
+		s := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			s.Field(i).Set(deepCopy(v.Field(i)))
+		}
+		return s
+	}
+	return v
+}
@@ -0,0 +1,281 @@
+package conntracktest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+func testCon(src, dst string, sport, dport uint16) ct.Con {
+	srcIP := net.ParseIP(src)
+	dstIP := net.ParseIP(dst)
+	var tcp uint8 = 6
+	return ct.Con{
+		Origin: &ct.IPTuple{
+			Src:   &srcIP,
+			Dst:   &dstIP,
+			Proto: &ct.ProtoTuple{Number: &tcp, SrcPort: &sport, DstPort: &dport},
+		},
+	}
+}
+
+func TestFake(t *testing.T) {
+	fake := New()
+	defer fake.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errs := fake.Events(ctx, ct.EventOptions{
+		Table:      ct.Conntrack,
+		Groups:     ct.NetlinkCtNew | ct.NetlinkCtUpdate | ct.NetlinkCtDestroy,
+		BufferSize: 8,
+	})
+
+	con := testCon("1.1.1.1", "2.2.2.2", 1234, 80)
+	if err := fake.Create(ct.Conntrack, ct.IPv4, con); err != nil {
+		t.Fatalf("could not create entry: %v", err)
+	}
+	if err := fake.Create(ct.Conntrack, ct.IPv4, con); !errors.Is(err, ct.ErrExists) {
+		t.Fatalf("unexpected error for duplicate entry: %v", err)
+	}
+
+	// lookup by the tuple of the reply direction
+	reply := testCon("2.2.2.2", "1.1.1.1", 80, 1234)
+	cons, err := fake.Get(ct.Conntrack, ct.IPv4, reply)
+	if err != nil {
+		t.Fatalf("could not get entry: %v", err)
+	}
+	if len(cons) != 1 || cons[0].ID == nil || cons[0].Reply == nil {
+		t.Fatalf("unexpected entries: %#v", cons)
+	}
+
+	var mark uint32 = 42
+	update := testCon("1.1.1.1", "2.2.2.2", 1234, 80)
+	update.Mark = &mark
+	if err := fake.Update(ct.Conntrack, ct.IPv4, update); err != nil {
+		t.Fatalf("could not update entry: %v", err)
+	}
+	cons, err = fake.Query(ct.Conntrack, ct.IPv4, ct.FilterAttr{Mark: []byte{0, 0, 0, 42}, MarkMask: []byte{0xff, 0xff, 0xff, 0xff}})
+	if err != nil {
+		t.Fatalf("could not query entries: %v", err)
+	}
+	if len(cons) != 1 || *cons[0].Mark != mark {
+		t.Fatalf("unexpected entries: %#v", cons)
+	}
+
+	missing := testCon("3.3.3.3", "2.2.2.2", 1234, 80)
+	if err := fake.Update(ct.Conntrack, ct.IPv4, missing); !errors.Is(err, ct.ErrNotFound) {
+		t.Fatalf("unexpected error for missing entry: %v", err)
+	}
+	if err := fake.Delete(ct.Conntrack, ct.IPv4, con); err != nil {
+		t.Fatalf("could not delete entry: %v", err)
+	}
+	if _, err := fake.Get(ct.Conntrack, ct.IPv4, con); !errors.Is(err, ct.ErrNotFound) {
+		t.Fatalf("unexpected error for deleted entry: %v", err)
+	}
+
+	for _, kind := range []ct.EventKind{ct.EventNew, ct.EventUpdate, ct.EventDestroy} {
+		e := <-events
+		if e.Kind != kind || e.Table != ct.Conntrack || e.Con.Origin == nil {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+	if err, ok := <-errs; ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFakeExpected(t *testing.T) {
+	fake := New()
+	defer fake.Close()
+
+	master := testCon("1.1.1.1", "2.2.2.2", 1234, 21)
+	exp := testCon("1.1.1.1", "2.2.2.2", 0, 2000)
+	exp = ct.Con{Exp: &ct.Exp{Master: master.Origin, Tuple: exp.Origin}}
+
+	if err := fake.Create(ct.Expected, ct.IPv4, exp); !errors.Is(err, ct.ErrNotFound) {
+		t.Fatalf("unexpected error without master: %v", err)
+	}
+	if err := fake.Create(ct.Conntrack, ct.IPv4, master); err != nil {
+		t.Fatalf("could not create master: %v", err)
+	}
+	if err := fake.Create(ct.Expected, ct.IPv4, exp); err != nil {
+		t.Fatalf("could not create expectation: %v", err)
+	}
+	if cons, err := fake.Dump(ct.Expected, ct.IPv6); err != nil || len(cons) != 0 {
+		t.Fatalf("unexpected dump of IPv6: %v, %#v", err, cons)
+	}
+	if err := fake.Flush(ct.Expected, ct.IPv4); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	if cons, err := fake.Dump(ct.Expected, ct.IPv4); err != nil || len(cons) != 0 {
+		t.Fatalf("unexpected dump after flush: %v, %#v", err, cons)
+	}
+}
+
+func TestFakeFilteredEvents(t *testing.T) {
+	fake := New()
+	defer fake.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, _ := fake.Events(ctx, ct.EventOptions{
+		Table:      ct.Conntrack,
+		Groups:     ct.NetlinkCtNew,
+		Filter:     []ct.ConnAttr{{Type: ct.AttrOrigPortDst, Data: []byte{0, 80}}},
+		Expr:       ct.Range(ct.AttrOrigPortSrc, 1024, 65535),
+		BufferSize: 8,
+	})
+	for _, con := range []ct.Con{
+		testCon("1.1.1.1", "2.2.2.2", 1234, 22),
+		testCon("1.1.1.1", "2.2.2.2", 123, 80),
+		testCon("1.1.1.1", "2.2.2.2", 1234, 80),
+	} {
+		if err := fake.Create(ct.Conntrack, ct.IPv4, con); err != nil {
+			t.Fatalf("could not create entry: %v", err)
+		}
+	}
+	if e := <-events; *e.Con.Origin.Proto.SrcPort != 1234 || *e.Con.Origin.Proto.DstPort != 80 {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event: %#v", e)
+	default:
+	}
+
+	// The kind of the event is part of the filter.
+	destroyed, _ := fake.Events(ctx, ct.EventOptions{
+		Table:      ct.Conntrack,
+		Groups:     ct.NetlinkCtNew | ct.NetlinkCtDestroy,
+		Expr:       ct.EventKinds(ct.EventDestroy),
+		BufferSize: 8,
+	})
+	if err := fake.Create(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 1235, 80)); err != nil {
+		t.Fatalf("could not create entry: %v", err)
+	}
+	if err := fake.Flush(ct.Conntrack, ct.IPv4); err != nil {
+		t.Fatalf("could not flush table: %v", err)
+	}
+	if e := <-destroyed; e.Kind != ct.EventDestroy {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	_, errs := fake.Events(ctx, ct.EventOptions{
+		Table:  ct.Conntrack,
+		Groups: ct.NetlinkCtNew,
+		Expr:   ct.ConnAttr{Type: ct.AttrOrigPortDst, Data: []byte{80}},
+	})
+	if err := <-errs; !errors.Is(err, ct.ErrFilterAttributeLength) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFakeEventsDropped(t *testing.T) {
+	fake := New()
+	defer fake.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, _ := fake.Events(ctx, ct.EventOptions{
+		Table:      ct.Conntrack,
+		Groups:     ct.NetlinkCtNew,
+		BufferSize: 1,
+		Policy:     ct.EventDrop,
+	})
+	for _, port := range []uint16{1, 2, 3} {
+		if err := fake.Create(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", port, 80)); err != nil {
+			t.Fatalf("could not create entry: %v", err)
+		}
+	}
+	if e := <-events; *e.Con.Origin.Proto.SrcPort != 1 || e.Dropped != 0 {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if err := fake.Create(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 4, 80)); err != nil {
+		t.Fatalf("could not create entry: %v", err)
+	}
+	if e := <-events; *e.Con.Origin.Proto.SrcPort != 4 || e.Dropped != 2 {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+func TestFakeEventsUnbuffered(t *testing.T) {
+	fake := New()
+	defer fake.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, _ := fake.Events(ctx, ct.EventOptions{
+		Table:  ct.Conntrack,
+		Groups: ct.NetlinkCtNew | ct.NetlinkCtDestroy,
+	})
+	c := testCon("1.1.1.1", "2.2.2.2", 1, 80)
+	if err := fake.Create(ct.Conntrack, ct.IPv4, c); err != nil {
+		t.Fatalf("could not create entry: %v", err)
+	}
+	if err := fake.Delete(ct.Conntrack, ct.IPv4, c); err != nil {
+		t.Fatalf("could not delete entry: %v", err)
+	}
+	for _, kind := range []ct.EventKind{ct.EventNew, ct.EventDestroy} {
+		if e := <-events; e.Kind != kind {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestFakeEventsOrder(t *testing.T) {
+	fake := New()
+	defer fake.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, _ := fake.Events(ctx, ct.EventOptions{
+		Table:  ct.Conntrack,
+		Groups: ct.NetlinkCtNew | ct.NetlinkCtDestroy,
+	})
+	c := testCon("1.1.1.1", "2.2.2.2", 1, 80)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				// Errors are expected, as the goroutines change the same entry.
+				fake.Create(ct.Conntrack, ct.IPv4, c)
+				fake.Delete(ct.Conntrack, ct.IPv4, c)
+			}
+		}()
+	}
+	wg.Wait()
+	// The event of the marker is the last event.
+	if err := fake.Create(ct.Conntrack, ct.IPv4, testCon("3.3.3.3", "2.2.2.2", 1, 80)); err != nil {
+		t.Fatalf("could not create entry: %v", err)
+	}
+
+	want := ct.EventNew
+	for e := range events {
+		if e.Con.Origin.Src.Equal(net.ParseIP("3.3.3.3")) {
+			break
+		}
+		if e.Kind != want {
+			t.Fatalf("unexpected event %s, expected %s", e.Kind, want)
+		}
+		if want == ct.EventNew {
+			want = ct.EventDestroy
+		} else {
+			want = ct.EventNew
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package conntracktest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+// subscriber receives events of a table.
+type subscriber struct {
+	table  ct.Table
+	groups ct.NetlinkGroup
+	policy ct.EventPolicy
+	events chan ct.Event
+	// matcher evaluates the filter of the subscription, if it has one.
+	matcher *ct.Matcher
+
+	once sync.Once
+	done chan struct{}
+	// wake signals drain, that queue is not empty.
+	wake chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	// dropped counts the events, that were dropped since the last delivered
+	// event.
+	dropped uint64
+	// queue holds the events for EventBlock, that are not yet sent to events.
+	queue []ct.Event
+}
+
+// deliver e to the subscriber according to its policy. It does not block, so
+// that changes of the table are not delayed by subscribers, that do not read
+// their events, similar to the receive buffer of a netlink socket.
+func (s *subscriber) deliver(e ct.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if s.policy == ct.EventDrop {
+		e.Dropped = s.dropped
+		select {
+		case s.events <- e:
+			s.dropped = 0
+		default:
+			s.dropped++
+		}
+		return
+	}
+	s.queue = append(s.queue, e)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drain sends the queued events to the event channel, until the subscriber is
+// stopped. Then the event channel is closed.
+func (s *subscriber) drain() {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.queue = nil
+		close(s.events)
+	}()
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		e := s.queue[0]
+		s.queue[0] = ct.Event{}
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.events <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// stop the subscriber. Its event channel is closed by drain.
+func (s *subscriber) stop() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// emit sends an event about c to all subscribers of table t. The caller must
+// hold mu, so that the events of concurrent changes are delivered in the order
+// of the changes. deliver does not block, so that this is safe.
+func (f *Fake) emit(t ct.Table, kind ct.EventKind, c ct.Con) {
+	e := ct.Event{
+		Kind:  kind,
+		Table: t,
+		Con:   c,
+		Time:  time.Now(),
+	}
+	group := e.Group()
+
+	for s := range f.subs {
+		if s.table == t && s.groups&group != 0 && (s.matcher == nil || s.matcher.MatchEvent(e)) {
+			e.Con = copyCon(c)
+			s.deliver(e)
+		}
+	}
+}
+
+// Emit sends e to all subscribers without changing the table. It can be used
+// to simulate events, that are caused by traffic.
+func (f *Fake) Emit(e ct.Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.emit(e.Table, e.Kind, e.Con)
+}
+
+// subscribe registers a new subscriber, that is stopped once ctx is done.
+func (f *Fake) subscribe(ctx context.Context, opts ct.EventOptions) (*subscriber, error) {
+	s := &subscriber{
+		table:  opts.Table,
+		groups: opts.Groups,
+		policy: opts.Policy,
+		events: make(chan ct.Event, opts.BufferSize),
+		done:   make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+	}
+	if len(opts.Filter) > 0 || opts.Expr != nil {
+		matcher, err := ct.NewMatcher(opts.Table, opts.Filter, opts.Expr)
+		if err != nil {
+			return nil, err
+		}
+		s.matcher = matcher
+	}
+	f.mu.Lock()
+	f.subs[s] = struct{}{}
+	f.mu.Unlock()
+
+	go s.drain()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.done:
+		}
+		f.mu.Lock()
+		delete(f.subs, s)
+		f.mu.Unlock()
+		s.stop()
+	}()
+	return s, nil
+}
+
+// Events returns a stream of events from the Netlinkgroups specified in opts.
+// Filter and Expr of opts are evaluated by ct.Matcher, Resync is ignored.
+// With EventBlock, events are queued without limit, so that changes of the
+// table do not block until the events are read.
+func (f *Fake) Events(ctx context.Context, opts ct.EventOptions) (<-chan ct.Event, <-chan error) {
+	errs := make(chan error, 1)
+	fail := func(err error) (<-chan ct.Event, <-chan error) {
+		errs <- err
+		close(errs)
+		events := make(chan ct.Event)
+		close(events)
+		return events, errs
+	}
+	if opts.Table != ct.Conntrack && opts.Table != ct.Expected {
+		return fail(ct.ErrUnknownCtTable)
+	}
+
+	s, err := f.subscribe(ctx, opts)
+	if err != nil {
+		return fail(err)
+	}
+	go func() {
+		<-s.done
+		close(errs)
+	}()
+	return s.events, errs
+}
+
+// Register your function to receive events from Netlinkgroups.
+func (f *Fake) Register(ctx context.Context, t ct.Table, group ct.NetlinkGroup, fn ct.HookFunc) error {
+	return f.RegisterEvents(ctx, t, group, nil, func(e ct.Event) int {
+		return fn(e.Con)
+	})
+}
+
+// RegisterFiltered registers your function to receive events from Netlinkgroups.
+// The filter is evaluated by ct.Matcher.
+func (f *Fake) RegisterFiltered(ctx context.Context, t ct.Table, group ct.NetlinkGroup, filter []ct.ConnAttr, fn ct.HookFunc) error {
+	return f.RegisterEvents(ctx, t, group, filter, func(e ct.Event) int {
+		return fn(e.Con)
+	})
+}
+
+// RegisterEvents registers your function to receive typed events from Netlinkgroups.
+// The filter is evaluated by ct.Matcher.
+func (f *Fake) RegisterEvents(ctx context.Context, t ct.Table, group ct.NetlinkGroup, filter []ct.ConnAttr, fn ct.EventFunc) error {
+	if t != ct.Conntrack && t != ct.Expected {
+		return ct.ErrUnknownCtTable
+	}
+	s, err := f.subscribe(ctx, ct.EventOptions{
+		Table:      t,
+		Groups:     group,
+		Filter:     filter,
+		BufferSize: defaultBufferSize,
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		for e := range s.events {
+			if ret := fn(e); ret != 0 {
+				s.stop()
+				return
+			}
+		}
+	}()
+	return nil
+}
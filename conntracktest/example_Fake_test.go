@@ -0,0 +1,40 @@
+package conntracktest_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/florianl/go-conntrack/conntracktest"
+)
+
+// countEntries works with Nfct and Fake.
+func countEntries(nfct ct.Interface) (int, error) {
+	cons, err := nfct.Dump(ct.Conntrack, ct.IPv4)
+	return len(cons), err
+}
+
+func ExampleFake() {
+	fake := conntracktest.New()
+	defer fake.Close()
+
+	src := net.ParseIP("10.0.0.1")
+	dst := net.ParseIP("10.0.0.2")
+	var udp uint8 = 17
+	var sport, dport uint16 = 5353, 53
+	con := ct.Con{Origin: &ct.IPTuple{Src: &src, Dst: &dst, Proto: &ct.ProtoTuple{Number: &udp, SrcPort: &sport, DstPort: &dport}}}
+
+	if err := fake.Create(ct.Conntrack, ct.IPv4, con); err != nil {
+		fmt.Println("could not create entry:", err)
+		return
+	}
+	err := fake.Create(ct.Conntrack, ct.IPv4, con)
+	fmt.Println("exists:", errors.Is(err, ct.ErrExists))
+
+	n, _ := countEntries(fake)
+	fmt.Println("entries:", n)
+	// Output:
+	// exists: true
+	// entries: 1
+}
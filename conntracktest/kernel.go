@@ -0,0 +1,689 @@
+package conntracktest
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Message types of ctnetlink, that are understood by Kernel.
+const (
+	msgNew            = 0
+	msgGet            = 1
+	msgDelete         = 2
+	msgExpGetStatsCPU = 3
+	msgCtGetStatsCPU  = 4
+)
+
+const (
+	nfgenmsgLen   = 4
+	nlaHeaderLen  = 4
+	nlaFlagNested = 1 << 15
+	nlaTypeMask   = 0x3fff
+)
+
+// Attribute types of ctnetlink, that are interpreted by Kernel.
+const (
+	ctaTupleOrig   = 1
+	ctaTupleReply  = 2
+	ctaMark        = 8
+	ctaID          = 12
+	ctaMarkMask    = 21
+	ctaTupleIP     = 1
+	ctaTupleProto  = 2
+	ctaIPv4Src     = 1
+	ctaIPv4Dst     = 2
+	ctaIPv6Src     = 3
+	ctaIPv6Dst     = 4
+	ctaProtoSrc    = 2
+	ctaProtoDst    = 3
+	ctaExpMaster   = 1
+	ctaExpTuple    = 2
+	ctaExpID       = 5
+	ctaStatsFound  = 2
+	ctaStatsInsert = 8
+	ctaStatsExpNew = 1
+	ctaStatsExpCre = 2
+	ctaStatsExpDel = 3
+)
+
+// Kernel emulates ctnetlink of the Linux kernel on the level of netlink
+// messages. Requests are decoded from their wire format and answered with
+// encoded NEW, ACK, DONE and error messages in the same way as the kernel does.
+// Events are sent to sockets, that joined the corresponding Netlinkgroups,
+// after the BPF filter of the socket accepted them.
+// The zero value is not usable, use NewKernel instead.
+type Kernel struct {
+	// BatchSize limits the number of entries per part of a multipart dump.
+	// If not set, all entries are sent in a single part.
+	BatchSize int
+
+	// InterruptDumps marks all dumps with NLM_F_DUMP_INTR, as if the table
+	// changed during the dump.
+	InterruptDumps bool
+
+	mu      sync.Mutex
+	tables  map[uint8][]*kernelEntry
+	nextID  uint32
+	nextPID uint32
+	sockets map[*socket]struct{}
+	stats   map[uint16]uint32
+}
+
+// kernelEntry is an entry of a table with its top-level attributes.
+type kernelEntry struct {
+	family uint8
+	id     uint32
+	keys   []string
+	master string
+	attrs  []attribute
+}
+
+// attribute is a netlink attribute, whose type keeps the flags.
+type attribute struct {
+	typ  uint16
+	data []byte
+}
+
+// NewKernel returns a Kernel with empty tables.
+func NewKernel() *Kernel {
+	return &Kernel{
+		tables:  make(map[uint8][]*kernelEntry),
+		nextID:  1,
+		nextPID: 1,
+		sockets: make(map[*socket]struct{}),
+		stats:   make(map[uint16]uint32),
+	}
+}
+
+// Dial returns a new netlink connection to k. It can be used as
+// conntrack.Config.Dial.
+func (k *Kernel) Dial() (*netlink.Conn, error) {
+	k.mu.Lock()
+	s := newSocket(k, k.nextPID)
+	k.nextPID++
+	k.sockets[s] = struct{}{}
+	k.mu.Unlock()
+	return netlink.NewConn(s, s.pid), nil
+}
+
+// handle processes a single request of s and queues the replies on s.
+func (k *Kernel) handle(s *socket, req netlink.Message, raw []byte) error {
+	if req.Header.Flags&netlink.Request == 0 {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(req.Data) < nfgenmsgLen {
+		s.enqueue(encode(ack(req, raw, syscall.EINVAL)))
+		return nil
+	}
+	attrs, err := parseAttributes(req.Data[nfgenmsgLen:])
+	if err != nil {
+		s.enqueue(encode(ack(req, raw, syscall.EINVAL)))
+		return nil
+	}
+	subsys := uint8(req.Header.Type >> 8)
+	family := req.Data[0]
+
+	var parts [][]netlink.Message
+	var errno syscall.Errno
+	dump := req.Header.Flags&netlink.Dump == netlink.Dump
+	switch {
+	case subsys != unix.NFNL_SUBSYS_CTNETLINK && subsys != unix.NFNL_SUBSYS_CTNETLINK_EXP:
+		errno = syscall.EOPNOTSUPP
+	case req.Header.Type&0xff == msgNew:
+		errno = k.create(req, subsys, family, attrs)
+	case req.Header.Type&0xff == msgGet && dump:
+		parts = k.dump(req, k.matching(subsys, family, attrs))
+	case req.Header.Type&0xff == msgGet:
+		parts, errno = k.get(req, subsys, attrs)
+	case req.Header.Type&0xff == msgDelete:
+		errno = k.remove(req, subsys, family, attrs)
+	case subsys == unix.NFNL_SUBSYS_CTNETLINK && req.Header.Type&0xff == msgCtGetStatsCPU,
+		subsys == unix.NFNL_SUBSYS_CTNETLINK_EXP && req.Header.Type&0xff == msgExpGetStatsCPU:
+		parts = k.dump(req, []message{k.cpuStats(subsys)})
+	default:
+		errno = syscall.EOPNOTSUPP
+	}
+
+	for _, part := range parts {
+		s.enqueue(encode(part...))
+	}
+	if errno != 0 || (req.Header.Flags&netlink.Acknowledge != 0 && !dump) {
+		s.enqueue(encode(ack(req, raw, errno)))
+	}
+	return nil
+}
+
+// create adds a new entry or updates an existing one.
+func (k *Kernel) create(req netlink.Message, subsys, family uint8, attrs []attribute) syscall.Errno {
+	e, errno := k.lookup(subsys, attrs)
+	if errno != 0 && errno != syscall.ENOENT {
+		return errno
+	}
+	if e != nil {
+		if req.Header.Flags&(netlink.Create|netlink.Excl) == netlink.Create|netlink.Excl {
+			return syscall.EEXIST
+		}
+		for _, a := range attrs {
+			if isIdentity(subsys, a.typ) {
+				continue
+			}
+			e.set(a)
+		}
+		k.notify(req, subsys, e, netlink.HeaderType(msgNew), 0, 1)
+		return 0
+	}
+	if req.Header.Flags&netlink.Create == 0 {
+		return syscall.ENOENT
+	}
+
+	e = &kernelEntry{family: family, id: k.nextID}
+	if subsys == unix.NFNL_SUBSYS_CTNETLINK {
+		orig, hasOrig := findAttribute(attrs, ctaTupleOrig)
+		reply, hasReply := findAttribute(attrs, ctaTupleReply)
+		switch {
+		case !hasOrig && !hasReply:
+			return syscall.EINVAL
+		case !hasOrig:
+			orig = attribute{typ: ctaTupleOrig | nlaFlagNested, data: invertTuple(reply.data)}
+		case !hasReply:
+			reply = attribute{typ: ctaTupleReply | nlaFlagNested, data: invertTuple(orig.data)}
+		}
+		e.keys = []string{canonical(orig.data), canonical(reply.data)}
+		e.attrs = []attribute{orig, reply}
+		k.stats[ctaStatsInsert]++
+	} else {
+		tuple, hasTuple := findAttribute(attrs, ctaExpTuple)
+		master, hasMaster := findAttribute(attrs, ctaExpMaster)
+		if !hasTuple || !hasMaster {
+			return syscall.EINVAL
+		}
+		e.master = canonical(master.data)
+		if k.find(unix.NFNL_SUBSYS_CTNETLINK, func(c *kernelEntry) bool { return c.hasKey(e.master) }) == nil {
+			return syscall.ENOENT
+		}
+		e.keys = []string{canonical(tuple.data)}
+		e.attrs = []attribute{master, tuple}
+		// CTA_STATS_EXP_NEW counts the expectations, that were fulfilled by
+		// new connections, and is therefore not changed here.
+		k.stats[ctaStatsExpCre]++
+	}
+	for _, a := range attrs {
+		if isIdentity(subsys, a.typ) {
+			continue
+		}
+		e.set(a)
+	}
+	k.nextID++
+	k.tables[subsys] = append(k.tables[subsys], e)
+	k.notify(req, subsys, e, netlink.HeaderType(msgNew), netlink.Create|netlink.Excl, 0)
+	return 0
+}
+
+// get returns the entry, that is identified by attrs.
+func (k *Kernel) get(req netlink.Message, subsys uint8, attrs []attribute) ([][]netlink.Message, syscall.Errno) {
+	e, errno := k.lookup(subsys, attrs)
+	if errno != 0 {
+		return nil, errno
+	}
+	if subsys == unix.NFNL_SUBSYS_CTNETLINK {
+		k.stats[ctaStatsFound]++
+	}
+	m := e.message(subsys)
+	return [][]netlink.Message{{reply(req, m, 0)}}, 0
+}
+
+// remove deletes the entry, that is identified by attrs, or all entries of
+// family, if attrs do not identify an entry.
+func (k *Kernel) remove(req netlink.Message, subsys, family uint8, attrs []attribute) syscall.Errno {
+	identified := false
+	for _, a := range attrs {
+		if isIdentity(subsys, a.typ) {
+			identified = true
+		}
+	}
+	if !identified {
+		for _, e := range k.matching(subsys, family, nil) {
+			k.destroy(req, subsys, e.entry)
+		}
+		return 0
+	}
+	e, errno := k.lookup(subsys, attrs)
+	if errno != 0 {
+		return errno
+	}
+	k.destroy(req, subsys, e)
+	return 0
+}
+
+// destroy removes e and the expectations, that depend on it.
+func (k *Kernel) destroy(req netlink.Message, subsys uint8, e *kernelEntry) {
+	entries := k.tables[subsys]
+	for i := range entries {
+		if entries[i] == e {
+			k.tables[subsys] = append(entries[:i:i], entries[i+1:]...)
+			break
+		}
+	}
+	k.notify(req, subsys, e, netlink.HeaderType(msgDelete), 0, 2)
+
+	if subsys != unix.NFNL_SUBSYS_CTNETLINK {
+		k.stats[ctaStatsExpDel]++
+		return
+	}
+	for _, exp := range append([]*kernelEntry(nil), k.tables[unix.NFNL_SUBSYS_CTNETLINK_EXP]...) {
+		if e.hasKey(exp.master) {
+			k.destroy(req, unix.NFNL_SUBSYS_CTNETLINK_EXP, exp)
+		}
+	}
+}
+
+// message is the content of a reply without the netlink header.
+type message struct {
+	typ   netlink.HeaderType
+	data  []byte
+	entry *kernelEntry
+}
+
+// matching returns the entries of family, that pass the mark filter in attrs.
+func (k *Kernel) matching(subsys, family uint8, attrs []attribute) []message {
+	mark, hasMark := findAttribute(attrs, ctaMark)
+	mask, hasMask := findAttribute(attrs, ctaMarkMask)
+	filterMark := subsys == unix.NFNL_SUBSYS_CTNETLINK && hasMark && hasMask &&
+		len(mark.data) == 4 && len(mask.data) == 4
+
+	var msgs []message
+	for _, e := range k.tables[subsys] {
+		if family != unix.AF_UNSPEC && e.family != family {
+			continue
+		}
+		if filterMark {
+			var value uint32
+			if a, ok := findAttribute(e.attrs, ctaMark); ok && len(a.data) == 4 {
+				value = binary.BigEndian.Uint32(a.data)
+			}
+			if value&binary.BigEndian.Uint32(mask.data) != binary.BigEndian.Uint32(mark.data) {
+				continue
+			}
+		}
+		msgs = append(msgs, e.message(subsys))
+	}
+	return msgs
+}
+
+// dump splits msgs into the parts of a multipart message, that is terminated
+// by NLMSG_DONE.
+func (k *Kernel) dump(req netlink.Message, msgs []message) [][]netlink.Message {
+	flags := netlink.Multi
+	if k.InterruptDumps {
+		flags |= netlink.DumpInterrupted
+	}
+	size := k.BatchSize
+	if size <= 0 {
+		size = len(msgs)
+	}
+
+	var parts [][]netlink.Message
+	var part []netlink.Message
+	for _, m := range msgs {
+		if len(part) == size {
+			parts = append(parts, part)
+			part = nil
+		}
+		part = append(part, reply(req, m, flags))
+	}
+	done := netlink.Message{
+		Header: netlink.Header{
+			Type:     netlink.Done,
+			Flags:    flags,
+			Sequence: req.Header.Sequence,
+			PID:      req.Header.PID,
+		},
+		Data: make([]byte, 4),
+	}
+	return append(parts, append(part, done))
+}
+
+// cpuStats returns the statistics of the only emulated CPU.
+func (k *Kernel) cpuStats(subsys uint8) message {
+	types := []uint16{ctaStatsFound, ctaStatsInsert}
+	typ := netlink.HeaderType(msgCtGetStatsCPU)
+	if subsys == unix.NFNL_SUBSYS_CTNETLINK_EXP {
+		types = []uint16{ctaStatsExpNew, ctaStatsExpCre, ctaStatsExpDel}
+		typ = netlink.HeaderType(msgExpGetStatsCPU)
+	}
+	var attrs []attribute
+	for _, t := range types {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, k.stats[t])
+		attrs = append(attrs, attribute{typ: t, data: data})
+	}
+	return message{
+		typ:  netlink.HeaderType(subsys)<<8 | typ,
+		data: append(nfgenmsg(unix.AF_UNSPEC), marshalAttributes(attrs)...),
+	}
+}
+
+// notify sends an event about e to all sockets, that joined the group. The
+// group is the offset to the NEW group of the subsystem.
+func (k *Kernel) notify(req netlink.Message, subsys uint8, e *kernelEntry, typ netlink.HeaderType, flags netlink.HeaderFlags, group uint32) {
+	group++
+	if subsys == unix.NFNL_SUBSYS_CTNETLINK_EXP {
+		group += 3
+	}
+	m := e.message(subsys)
+	event := encode(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(subsys)<<8 | typ,
+			Flags: flags,
+			PID:   req.Header.PID,
+		},
+		Data: m.data,
+	})
+	for s := range k.sockets {
+		s.deliver(group, event)
+	}
+}
+
+// lookup returns the entry of the table, that is identified by attrs.
+func (k *Kernel) lookup(subsys uint8, attrs []attribute) (*kernelEntry, syscall.Errno) {
+	idType := uint16(ctaID)
+	tupleTypes := []uint16{ctaTupleOrig, ctaTupleReply}
+	if subsys == unix.NFNL_SUBSYS_CTNETLINK_EXP {
+		idType = ctaExpID
+		tupleTypes = []uint16{ctaExpTuple}
+	}
+
+	var keys []string
+	for _, t := range tupleTypes {
+		if a, ok := findAttribute(attrs, t); ok {
+			keys = append(keys, canonical(a.data))
+		}
+	}
+	id, hasID := findAttribute(attrs, idType)
+	if hasID && len(id.data) != 4 {
+		return nil, syscall.EINVAL
+	}
+	if len(keys) == 0 && !hasID {
+		return nil, syscall.EINVAL
+	}
+
+	e := k.find(subsys, func(e *kernelEntry) bool {
+		if hasID && e.id != binary.BigEndian.Uint32(id.data) {
+			return false
+		}
+		for _, key := range keys {
+			if !e.hasKey(key) {
+				return false
+			}
+		}
+		return true
+	})
+	if e == nil {
+		return nil, syscall.ENOENT
+	}
+	return e, 0
+}
+
+// find returns the first entry of the table, for which match returns true.
+func (k *Kernel) find(subsys uint8, match func(*kernelEntry) bool) *kernelEntry {
+	for _, e := range k.tables[subsys] {
+		if match(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+// idle does nothing, as events are sent, when the table changes.
+func (k *Kernel) idle(s *socket) {}
+
+// closeSocket removes s from the sockets, that receive events.
+func (k *Kernel) closeSocket(s *socket) {
+	k.mu.Lock()
+	delete(k.sockets, s)
+	k.mu.Unlock()
+}
+
+// hasKey reports whether e is identified by the canonical tuple key.
+func (e *kernelEntry) hasKey(key string) bool {
+	for _, k := range e.keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// set replaces the attribute of the same type or adds a.
+func (e *kernelEntry) set(a attribute) {
+	for i := range e.attrs {
+		if e.attrs[i].typ&nlaTypeMask == a.typ&nlaTypeMask {
+			e.attrs[i] = a
+			return
+		}
+	}
+	e.attrs = append(e.attrs, a)
+}
+
+// message returns the representation of e, as it is sent by the kernel.
+func (e *kernelEntry) message(subsys uint8) message {
+	idType := uint16(ctaID)
+	if subsys == unix.NFNL_SUBSYS_CTNETLINK_EXP {
+		idType = ctaExpID
+	}
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, e.id)
+	attrs := append(append([]attribute(nil), e.attrs...), attribute{typ: idType, data: id})
+
+	return message{
+		typ:   netlink.HeaderType(subsys)<<8 | msgNew,
+		data:  append(nfgenmsg(e.family), marshalAttributes(attrs)...),
+		entry: e,
+	}
+}
+
+// isIdentity reports whether the attribute identifies an entry of the table.
+func isIdentity(subsys uint8, typ uint16) bool {
+	if subsys == unix.NFNL_SUBSYS_CTNETLINK_EXP {
+		switch typ & nlaTypeMask {
+		case ctaExpMaster, ctaExpTuple, ctaExpID:
+			return true
+		}
+		return false
+	}
+	switch typ & nlaTypeMask {
+	case ctaTupleOrig, ctaTupleReply, ctaID:
+		return true
+	}
+	return false
+}
+
+// reply returns m as answer to req.
+func reply(req netlink.Message, m message, flags netlink.HeaderFlags) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:     m.typ,
+			Flags:    flags,
+			Sequence: req.Header.Sequence,
+			PID:      req.Header.PID,
+		},
+		Data: m.data,
+	}
+}
+
+// ack returns the acknowledgement of req. The original request is only
+// included, if it failed.
+func ack(req netlink.Message, raw []byte, errno syscall.Errno) netlink.Message {
+	var flags netlink.HeaderFlags
+	data := make([]byte, 4)
+	nlenc.PutInt32(data, -int32(errno))
+	if errno == 0 {
+		flags = netlink.Capped
+		data = append(data, raw[:16]...)
+	} else {
+		data = append(data, raw...)
+	}
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:     netlink.Error,
+			Flags:    flags,
+			Sequence: req.Header.Sequence,
+			PID:      req.Header.PID,
+		},
+		Data: data,
+	}
+}
+
+// nfgenmsg returns the header of netfilter messages.
+func nfgenmsg(family uint8) []byte {
+	return []byte{family, unix.NFNETLINK_V0, 0, 0}
+}
+
+// encode returns the wire format of msgs.
+func encode(msgs ...netlink.Message) []byte {
+	var b []byte
+	for _, m := range msgs {
+		data := make([]byte, nlaAlign(len(m.Data)))
+		copy(data, m.Data)
+		m.Data = data
+		m.Header.Length = uint32(16 + len(data))
+		// The length is set and aligned, so the message can always be marshaled.
+		mb, _ := m.MarshalBinary()
+		b = append(b, mb...)
+	}
+	return b
+}
+
+// decode returns the messages contained in b.
+func decode(b []byte) ([]netlink.Message, error) {
+	var msgs []netlink.Message
+	for len(b) > 0 {
+		if len(b) < 16 {
+			return nil, errors.New("short netlink message")
+		}
+		length := nlaAlign(int(nlenc.Uint32(b[0:4])))
+		if length < 16 || length > len(b) {
+			return nil, errors.New("invalid length of netlink message")
+		}
+		var m netlink.Message
+		if err := m.UnmarshalBinary(b[:length]); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+		b = b[length:]
+	}
+	return msgs, nil
+}
+
+// parseAttributes decodes attributes without removing the flags of their types.
+func parseAttributes(b []byte) ([]attribute, error) {
+	var attrs []attribute
+	for len(b) >= nlaHeaderLen {
+		length := int(nlenc.Uint16(b[0:2]))
+		if length < nlaHeaderLen || length > len(b) {
+			return nil, errors.New("invalid length of attribute")
+		}
+		attrs = append(attrs, attribute{
+			typ:  nlenc.Uint16(b[2:4]),
+			data: append([]byte(nil), b[nlaHeaderLen:length]...),
+		})
+		if nlaAlign(length) >= len(b) {
+			break
+		}
+		b = b[nlaAlign(length):]
+	}
+	return attrs, nil
+}
+
+// marshalAttributes encodes attrs with padding.
+func marshalAttributes(attrs []attribute) []byte {
+	var b []byte
+	for _, a := range attrs {
+		hdr := make([]byte, nlaHeaderLen)
+		nlenc.PutUint16(hdr[0:2], uint16(nlaHeaderLen+len(a.data)))
+		nlenc.PutUint16(hdr[2:4], a.typ)
+		b = append(b, hdr...)
+		b = append(b, a.data...)
+		b = append(b, make([]byte, nlaAlign(len(a.data))-len(a.data))...)
+	}
+	return b
+}
+
+// findAttribute returns the first attribute of type typ.
+func findAttribute(attrs []attribute, typ uint16) (attribute, bool) {
+	for _, a := range attrs {
+		if a.typ&nlaTypeMask == typ {
+			return a, true
+		}
+	}
+	return attribute{}, false
+}
+
+// canonical returns a key for nested attributes, that does not depend on the
+// order of the attributes.
+func canonical(b []byte) string {
+	attrs, err := parseAttributes(b)
+	if err != nil {
+		return hex.EncodeToString(b)
+	}
+	parts := make([]string, 0, len(attrs))
+	for _, a := range attrs {
+		t := a.typ & nlaTypeMask
+		if a.typ&nlaFlagNested != 0 {
+			parts = append(parts, strconv.Itoa(int(t))+"("+canonical(a.data)+")")
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(t))+"="+hex.EncodeToString(a.data))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// invertTuple swaps source and destination of a tuple.
+func invertTuple(b []byte) []byte {
+	swap := map[uint16]map[uint16]uint16{
+		ctaTupleIP: {
+			ctaIPv4Src: ctaIPv4Dst, ctaIPv4Dst: ctaIPv4Src,
+			ctaIPv6Src: ctaIPv6Dst, ctaIPv6Dst: ctaIPv6Src,
+		},
+		ctaTupleProto: {ctaProtoSrc: ctaProtoDst, ctaProtoDst: ctaProtoSrc},
+	}
+	attrs, err := parseAttributes(b)
+	if err != nil {
+		return b
+	}
+	for i, a := range attrs {
+		types, ok := swap[a.typ&nlaTypeMask]
+		if !ok {
+			continue
+		}
+		nested, err := parseAttributes(a.data)
+		if err != nil {
+			continue
+		}
+		for j, n := range nested {
+			if t, ok := types[n.typ&nlaTypeMask]; ok {
+				nested[j].typ = n.typ&^nlaTypeMask | t
+			}
+		}
+		attrs[i].data = marshalAttributes(nested)
+	}
+	return marshalAttributes(attrs)
+}
+
+func nlaAlign(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,195 @@
+package conntracktest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+func openKernel(t *testing.T, k *Kernel) *ct.Nfct {
+	t.Helper()
+	nfct, err := ct.Open(&ct.Config{Dial: k.Dial, PoolSize: 2})
+	if err != nil {
+		t.Fatalf("could not open fake kernel: %v", err)
+	}
+	t.Cleanup(func() { nfct.Close() })
+	return nfct
+}
+
+func TestKernel(t *testing.T) {
+	k := NewKernel()
+	// split dumps into multiple parts
+	k.BatchSize = 2
+	nfct := openKernel(t, k)
+
+	for _, port := range []uint16{80, 443, 8080} {
+		if err := nfct.Create(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 1234, port)); err != nil {
+			t.Fatalf("could not create entry: %v", err)
+		}
+	}
+	if err := nfct.Create(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 1234, 80)); !errors.Is(err, ct.ErrExists) {
+		t.Fatalf("unexpected error for duplicate entry: %v", err)
+	}
+
+	cons, err := nfct.Dump(ct.Conntrack, ct.IPv4)
+	if err != nil {
+		t.Fatalf("could not dump: %v", err)
+	}
+	if len(cons) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(cons))
+	}
+	for _, c := range cons {
+		if c.ID == nil || c.Reply == nil || c.Reply.Src == nil || !c.Reply.Src.Equal(*c.Origin.Dst) {
+			t.Fatalf("unexpected entry: %#v", c)
+		}
+	}
+	if cons, err := nfct.Dump(ct.Conntrack, ct.IPv6); err != nil || len(cons) != 0 {
+		t.Fatalf("unexpected dump of IPv6: %v, %#v", err, cons)
+	}
+
+	// lookup by the tuple of the reply direction
+	cons, err = nfct.Get(ct.Conntrack, ct.IPv4, testCon("2.2.2.2", "1.1.1.1", 443, 1234))
+	if err != nil {
+		t.Fatalf("could not get entry: %v", err)
+	}
+	if len(cons) != 1 || *cons[0].Origin.Proto.DstPort != 443 {
+		t.Fatalf("unexpected entries: %#v", cons)
+	}
+
+	var mark uint32 = 42
+	update := testCon("1.1.1.1", "2.2.2.2", 1234, 443)
+	update.Mark = &mark
+	if err := nfct.Update(ct.Conntrack, ct.IPv4, update); err != nil {
+		t.Fatalf("could not update entry: %v", err)
+	}
+	missing := testCon("1.1.1.1", "2.2.2.2", 1234, 22)
+	missing.Mark = &mark
+	if err := nfct.Update(ct.Conntrack, ct.IPv4, missing); !errors.Is(err, ct.ErrNotFound) {
+		t.Fatalf("unexpected error for update of missing entry: %v", err)
+	}
+	cons, err = nfct.Query(ct.Conntrack, ct.IPv4, ct.FilterAttr{
+		Mark:     []byte{0x0, 0x0, 0x0, 0x2a},
+		MarkMask: []byte{0xff, 0xff, 0xff, 0xff},
+	})
+	if err != nil {
+		t.Fatalf("could not query: %v", err)
+	}
+	if len(cons) != 1 || cons[0].Mark == nil || *cons[0].Mark != mark {
+		t.Fatalf("unexpected entries: %#v", cons)
+	}
+
+	if err := nfct.Delete(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 1234, 8080)); err != nil {
+		t.Fatalf("could not delete entry: %v", err)
+	}
+	if _, err := nfct.Get(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 1234, 8080)); !errors.Is(err, ct.ErrNotFound) {
+		t.Fatalf("unexpected error for deleted entry: %v", err)
+	}
+
+	stats, err := nfct.DumpCPUStats(ct.Conntrack)
+	if err != nil {
+		t.Fatalf("could not dump CPU stats: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Insert == nil || *stats[0].Insert != 3 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+
+	if err := nfct.Flush(ct.Conntrack, ct.IPv4); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	if cons, err := nfct.Dump(ct.Conntrack, ct.IPv4); err != nil || len(cons) != 0 {
+		t.Fatalf("unexpected dump after flush: %v, %#v", err, cons)
+	}
+}
+
+func TestKernelExpected(t *testing.T) {
+	nfct := openKernel(t, NewKernel())
+
+	master := testCon("1.1.1.1", "2.2.2.2", 1234, 21)
+	exp := testCon("1.1.1.1", "2.2.2.2", 0, 2000)
+	exp = ct.Con{Exp: &ct.Exp{Master: master.Origin, Tuple: exp.Origin, Mask: exp.Origin}}
+
+	if err := nfct.Create(ct.Expected, ct.IPv4, exp); !errors.Is(err, ct.ErrNotFound) {
+		t.Fatalf("unexpected error without master: %v", err)
+	}
+	if err := nfct.Create(ct.Conntrack, ct.IPv4, master); err != nil {
+		t.Fatalf("could not create master: %v", err)
+	}
+	if err := nfct.Create(ct.Expected, ct.IPv4, exp); err != nil {
+		t.Fatalf("could not create expectation: %v", err)
+	}
+	cons, err := nfct.Dump(ct.Expected, ct.IPv4)
+	if err != nil {
+		t.Fatalf("could not dump: %v", err)
+	}
+	if len(cons) != 1 || cons[0].Exp == nil || cons[0].Exp.ID == nil || cons[0].Exp.Tuple == nil {
+		t.Fatalf("unexpected entries: %#v", cons)
+	}
+
+	// expectations are removed together with their master
+	if err := nfct.Delete(ct.Conntrack, ct.IPv4, master); err != nil {
+		t.Fatalf("could not delete master: %v", err)
+	}
+	if cons, err := nfct.Dump(ct.Expected, ct.IPv4); err != nil || len(cons) != 0 {
+		t.Fatalf("unexpected dump after delete of master: %v, %#v", err, cons)
+	}
+}
+
+func TestKernelDumpInterrupted(t *testing.T) {
+	k := NewKernel()
+	nfct := openKernel(t, k)
+	if err := nfct.Create(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 1234, 80)); err != nil {
+		t.Fatalf("could not create entry: %v", err)
+	}
+
+	k.mu.Lock()
+	k.InterruptDumps = true
+	k.mu.Unlock()
+
+	cons, err := nfct.Dump(ct.Conntrack, ct.IPv4)
+	if !errors.Is(err, ct.ErrDumpInterrupted) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cons) != 1 {
+		t.Fatalf("expected the received entry, got %#v", cons)
+	}
+}
+
+func TestKernelEvents(t *testing.T) {
+	k := NewKernel()
+	nfct := openKernel(t, k)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, errs := nfct.Events(ctx, ct.EventOptions{
+		Table:  ct.Conntrack,
+		Groups: ct.NetlinkCtNew | ct.NetlinkCtDestroy,
+		// only events for port 80 pass the BPF filter
+		Filter:     []ct.ConnAttr{{Type: ct.AttrOrigPortDst, Data: []byte{0x0, 0x50}}},
+		BufferSize: 8,
+	})
+
+	for _, port := range []uint16{443, 80} {
+		if err := nfct.Create(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 1234, port)); err != nil {
+			t.Fatalf("could not create entry: %v", err)
+		}
+	}
+	if err := nfct.Delete(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 1234, 80)); err != nil {
+		t.Fatalf("could not delete entry: %v", err)
+	}
+
+	for _, kind := range []ct.EventKind{ct.EventNew, ct.EventDestroy} {
+		select {
+		case e := <-events:
+			if e.Kind != kind || *e.Con.Origin.Proto.DstPort != 80 {
+				t.Fatalf("unexpected event: %v %#v", e.Kind, e.Con)
+			}
+		case err := <-errs:
+			t.Fatalf("unexpected error: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("missing event %v", kind)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package conntracktest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/florianl/go-conntrack/internal/unix"
+	"github.com/mdlayher/netlink"
+)
+
+// ErrNotRecorded is returned by sockets of Replay for requests, that are not
+// part of the recording.
+var ErrNotRecorded = errors.New("request was not recorded")
+
+// Replay answers requests with the replies of a recording, e.g. of
+// conntrack.ReadPcap. Recorded events are sent to sockets, once they joined
+// the Netlinkgroup of the event. This reproduces the processing of recorded
+// traffic without access to the kernel.
+type Replay struct {
+	mu       sync.Mutex
+	requests []*recordedRequest
+	events   []netlink.Message
+	nextPID  uint32
+	notified map[*socket]bool
+}
+
+// recordedRequest is a request with its recorded replies.
+type recordedRequest struct {
+	req     netlink.Message
+	replies []netlink.Message
+	used    bool
+}
+
+// NewReplay returns a Replay of msgs. Received messages are assigned to the
+// sent request with the same sequence number and port ID. All other received
+// messages are events.
+func NewReplay(msgs []ct.RecordedMessage) *Replay {
+	r := &Replay{
+		nextPID:  1,
+		notified: make(map[*socket]bool),
+	}
+	for _, m := range msgs {
+		if m.Direction == ct.DirectionSent {
+			r.requests = append(r.requests, &recordedRequest{req: m.Message})
+			continue
+		}
+		if req := r.requestOf(m.Message); req != nil {
+			req.replies = append(req.replies, m.Message)
+			continue
+		}
+		r.events = append(r.events, m.Message)
+	}
+	return r
+}
+
+// requestOf returns the latest request, that msg replies to.
+func (r *Replay) requestOf(msg netlink.Message) *recordedRequest {
+	if msg.Header.Sequence == 0 {
+		return nil
+	}
+	for i := len(r.requests) - 1; i >= 0; i-- {
+		h := r.requests[i].req.Header
+		if h.Sequence == msg.Header.Sequence && h.PID == msg.Header.PID {
+			return r.requests[i]
+		}
+	}
+	return nil
+}
+
+// Dial returns a new netlink connection to r. It can be used as
+// conntrack.Config.Dial.
+func (r *Replay) Dial() (*netlink.Conn, error) {
+	r.mu.Lock()
+	s := newSocket(r, r.nextPID)
+	r.nextPID++
+	r.mu.Unlock()
+	return netlink.NewConn(s, s.pid), nil
+}
+
+// handle answers req with the replies of the first unused recorded request,
+// that is equal to req. If there is no such request, the first unused one of
+// the same type is used.
+func (r *Replay) handle(s *socket, req netlink.Message, raw []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var match *recordedRequest
+	for _, rec := range r.requests {
+		if rec.used || rec.req.Header.Type != req.Header.Type {
+			continue
+		}
+		if rec.req.Header.Flags == req.Header.Flags && bytes.Equal(rec.req.Data, req.Data) {
+			match = rec
+			break
+		}
+		if match == nil {
+			match = rec
+		}
+	}
+	if match == nil {
+		return fmt.Errorf("%w: message type 0x%04x", ErrNotRecorded, uint16(req.Header.Type))
+	}
+	match.used = true
+
+	var part []netlink.Message
+	for _, m := range match.replies {
+		m.Header.Sequence = req.Header.Sequence
+		m.Header.PID = req.Header.PID
+		if m.Header.Flags&netlink.Multi == 0 {
+			s.enqueue(encode(m))
+			continue
+		}
+		part = append(part, m)
+		if m.Header.Type == netlink.Done {
+			s.enqueue(encode(part...))
+			part = nil
+		}
+	}
+	if len(part) > 0 {
+		// The recording ends within a multipart message.
+		s.enqueue(encode(append(part, netlink.Message{
+			Header: netlink.Header{
+				Type:     netlink.Done,
+				Flags:    netlink.Multi,
+				Sequence: req.Header.Sequence,
+				PID:      req.Header.PID,
+			},
+			Data: make([]byte, 4),
+		})...))
+	}
+	return nil
+}
+
+// idle sends the recorded events to s, once it joined a Netlinkgroup.
+func (r *Replay) idle(s *socket) {
+	if !s.joined() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.notified[s] {
+		return
+	}
+	r.notified[s] = true
+	for _, e := range r.events {
+		s.deliver(eventGroup(e), encode(e))
+	}
+}
+
+// closeSocket forgets s.
+func (r *Replay) closeSocket(s *socket) {
+	r.mu.Lock()
+	delete(r.notified, s)
+	r.mu.Unlock()
+}
+
+// eventGroup returns the Netlinkgroup, the event was sent to.
+func eventGroup(e netlink.Message) uint32 {
+	var group uint32 = 2 // NFNLGRP_CONNTRACK_UPDATE
+	switch {
+	case e.Header.Type&0xff == msgDelete:
+		group = 3 // NFNLGRP_CONNTRACK_DESTROY
+	case e.Header.Flags&(netlink.Create|netlink.Excl) != 0:
+		group = 1 // NFNLGRP_CONNTRACK_NEW
+	}
+	if uint8(e.Header.Type>>8) == unix.NFNL_SUBSYS_CTNETLINK_EXP {
+		group += 3
+	}
+	return group
+}
@@ -0,0 +1,95 @@
+package conntracktest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+func TestReplay(t *testing.T) {
+	// Record the traffic of a session with the fake kernel.
+	var capture bytes.Buffer
+	pw, err := ct.NewPcapWriter(&capture)
+	if err != nil {
+		t.Fatalf("could not create pcap writer: %v", err)
+	}
+	k := NewKernel()
+	k.BatchSize = 1
+	nfct, err := ct.Open(&ct.Config{Dial: k.Dial, Recorder: pw})
+	if err != nil {
+		t.Fatalf("could not open fake kernel: %v", err)
+	}
+
+	session := func(nfct *ct.Nfct, create bool) ([]ct.Event, []ct.Con) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		events, _ := nfct.Events(ctx, ct.EventOptions{
+			Table:      ct.Conntrack,
+			Groups:     ct.NetlinkCtNew,
+			BufferSize: 8,
+		})
+		if create {
+			for _, port := range []uint16{80, 443} {
+				if err := nfct.Create(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 1234, port)); err != nil {
+					t.Fatalf("could not create entry: %v", err)
+				}
+			}
+		}
+		var received []ct.Event
+		for len(received) < 2 {
+			select {
+			case e := <-events:
+				received = append(received, e)
+			case <-ctx.Done():
+				t.Fatalf("missing events, got %d", len(received))
+			}
+		}
+		cons, err := nfct.Dump(ct.Conntrack, ct.IPv4)
+		if err != nil {
+			t.Fatalf("could not dump: %v", err)
+		}
+		if err := nfct.Delete(ct.Conntrack, ct.IPv4, testCon("1.1.1.1", "2.2.2.2", 1234, 22)); !errors.Is(err, ct.ErrNotFound) {
+			t.Fatalf("unexpected error for missing entry: %v", err)
+		}
+		return received, cons
+	}
+
+	events, cons := session(nfct, true)
+	nfct.Close()
+
+	recorded, err := ct.ReadPcap(&capture)
+	if err != nil {
+		t.Fatalf("could not read recording: %v", err)
+	}
+	replay := NewReplay(recorded)
+	nfct, err = ct.Open(&ct.Config{Dial: replay.Dial})
+	if err != nil {
+		t.Fatalf("could not open replay: %v", err)
+	}
+	defer nfct.Close()
+
+	// The requests to create the entries are not replayed, but their events are.
+	replayedEvents, replayedCons := session(nfct, false)
+	if len(replayedCons) != len(cons) {
+		t.Fatalf("expected %d entries, got %d", len(cons), len(replayedCons))
+	}
+	for i := range cons {
+		if *cons[i].ID != *replayedCons[i].ID {
+			t.Fatalf("unexpected entry %d: %#v", i, replayedCons[i])
+		}
+	}
+	for i := range events {
+		if events[i].Kind != replayedEvents[i].Kind || *events[i].Con.ID != *replayedEvents[i].Con.ID {
+			t.Fatalf("unexpected event %d: %#v", i, replayedEvents[i])
+		}
+	}
+
+	if _, err := nfct.Dump(ct.Expected, ct.IPv4); !errors.Is(err, ErrNotRecorded) {
+		t.Fatalf("unexpected error for request, that was not recorded: %v", err)
+	}
+}
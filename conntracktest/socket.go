@@ -0,0 +1,245 @@
+package conntracktest
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/florianl/go-conntrack/internal/bpfvm"
+	"github.com/florianl/go-conntrack/internal/unix"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/net/bpf"
+)
+
+// handler answers the requests of sockets.
+type handler interface {
+	// handle processes req, whose wire format is raw, and queues the
+	// replies on s.
+	handle(s *socket, req netlink.Message, raw []byte) error
+	// idle is called, when Receive of s waits for messages.
+	idle(s *socket)
+	// closeSocket is called, when s is closed.
+	closeSocket(s *socket)
+}
+
+// socket is a netlink socket connected to a handler.
+type socket struct {
+	h   handler
+	pid uint32
+
+	mu        sync.Mutex
+	wake      chan struct{}
+	queue     [][]byte
+	queued    int
+	rcvbuf    int
+	overrun   bool
+	noENOBUFS bool
+	closed    bool
+	deadline  time.Time
+	groups    map[uint32]bool
+	filter    *bpfvm.VM
+}
+
+var _ netlink.Socket = (*socket)(nil)
+
+func newSocket(h handler, pid uint32) *socket {
+	return &socket{
+		h:      h,
+		pid:    pid,
+		wake:   make(chan struct{}),
+		groups: make(map[uint32]bool),
+	}
+}
+
+// signal wakes up a waiting Receive. The caller must hold mu.
+func (s *socket) signal() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// enqueue a datagram, that is returned by Receive.
+func (s *socket) enqueue(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, b)
+	s.queued += len(b)
+	s.signal()
+}
+
+// deliver an event to s, if s joined group and the filter of s accepts it. If
+// the receive buffer is full, the event is dropped and the next Receive
+// reports ENOBUFS.
+func (s *socket) deliver(group uint32, b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || !s.groups[group] {
+		return
+	}
+	if s.filter != nil && s.filter.Run(b) == 0 {
+		return
+	}
+	if s.rcvbuf > 0 && s.queued+len(b) > s.rcvbuf {
+		if !s.noENOBUFS {
+			s.overrun = true
+			s.signal()
+		}
+		return
+	}
+	s.queue = append(s.queue, b)
+	s.queued += len(b)
+	s.signal()
+}
+
+func (s *socket) Close() error {
+	s.h.closeSocket(s)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	s.closed = true
+	s.signal()
+	return nil
+}
+
+func (s *socket) Send(m netlink.Message) error {
+	return s.SendMessages([]netlink.Message{m})
+}
+
+func (s *socket) SendMessages(msgs []netlink.Message) error {
+	for _, m := range msgs {
+		raw, err := m.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		reqs, err := decode(raw)
+		if err != nil {
+			return err
+		}
+		for _, req := range reqs {
+			if err := s.h.handle(s, req, raw); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *socket) Receive() ([]netlink.Message, error) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 && !s.closed {
+			s.mu.Unlock()
+			s.h.idle(s)
+			s.mu.Lock()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return nil, os.ErrClosed
+		}
+		if s.overrun {
+			s.overrun = false
+			s.mu.Unlock()
+			return nil, os.NewSyscallError("recvmsg", unix.ENOBUFS)
+		}
+		if len(s.queue) > 0 {
+			b := s.queue[0]
+			s.queue = s.queue[1:]
+			s.queued -= len(b)
+			s.mu.Unlock()
+			return decode(b)
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !s.deadline.IsZero() {
+			d := time.Until(s.deadline)
+			if d <= 0 {
+				s.mu.Unlock()
+				return nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		wake := s.wake
+		s.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// joined reports whether s joined any Netlinkgroup.
+func (s *socket) joined() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.groups) > 0
+}
+
+func (s *socket) JoinGroup(group uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[group] = true
+	return nil
+}
+
+func (s *socket) LeaveGroup(group uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.groups, group)
+	return nil
+}
+
+func (s *socket) SetBPF(filter []bpf.RawInstruction) error {
+	vm, err := bpfvm.New(filter)
+	if err != nil {
+		return os.NewSyscallError("setsockopt", unix.EINVAL)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter = vm
+	return nil
+}
+
+func (s *socket) RemoveBPF() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter = nil
+	return nil
+}
+
+func (s *socket) SetOption(option netlink.ConnOption, enable bool) error {
+	if option == netlink.NoENOBUFS {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.noENOBUFS = enable
+	}
+	return nil
+}
+
+func (s *socket) SetReadBuffer(bytes int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rcvbuf = bytes
+	return nil
+}
+
+func (s *socket) SetWriteBuffer(bytes int) error { return nil }
+
+func (s *socket) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *socket) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadline = t
+	s.signal()
+	return nil
+}
+
+func (s *socket) SetWriteDeadline(t time.Time) error { return nil }
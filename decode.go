@@ -0,0 +1,458 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// attrKind describes how the payload of an attribute is printed.
+type attrKind int
+
+const (
+	kindBytes attrKind = iota
+	kindNested
+	kindU8
+	kindU16
+	kindU32
+	kindU64
+	kindHex32
+	kindIP
+	kindString
+	kindStatus
+	kindL4Proto
+)
+
+// attrDesc describes an attribute of ctnetlink.
+type attrDesc struct {
+	name   string
+	kind   attrKind
+	nested map[uint16]attrDesc
+}
+
+var (
+	decodeIPAttrs = map[uint16]attrDesc{
+		ctaIPv4Src: {"CTA_IP_V4_SRC", kindIP, nil},
+		ctaIPv4Dst: {"CTA_IP_V4_DST", kindIP, nil},
+		ctaIPv6Src: {"CTA_IP_V6_SRC", kindIP, nil},
+		ctaIPv6Dst: {"CTA_IP_V6_DST", kindIP, nil},
+	}
+	decodeProtoAttrs = map[uint16]attrDesc{
+		ctaProtoNum:        {"CTA_PROTO_NUM", kindL4Proto, nil},
+		ctaProtoSrcPort:    {"CTA_PROTO_SRC_PORT", kindU16, nil},
+		ctaProtoDstPort:    {"CTA_PROTO_DST_PORT", kindU16, nil},
+		ctaProtoIcmpID:     {"CTA_PROTO_ICMP_ID", kindU16, nil},
+		ctaProtoIcmpType:   {"CTA_PROTO_ICMP_TYPE", kindU8, nil},
+		ctaProtoIcmpCode:   {"CTA_PROTO_ICMP_CODE", kindU8, nil},
+		ctaProtoIcmpv6ID:   {"CTA_PROTO_ICMPV6_ID", kindU16, nil},
+		ctaProtoIcmpv6Type: {"CTA_PROTO_ICMPV6_TYPE", kindU8, nil},
+		ctaProtoIcmpv6Code: {"CTA_PROTO_ICMPV6_CODE", kindU8, nil},
+	}
+	decodeTupleAttrs = map[uint16]attrDesc{
+		ctaTupleIP:    {"CTA_TUPLE_IP", kindNested, decodeIPAttrs},
+		ctaTupleProto: {"CTA_TUPLE_PROTO", kindNested, decodeProtoAttrs},
+		ctaTupleZone:  {"CTA_TUPLE_ZONE", kindU16, nil},
+	}
+	decodeProtoinfoAttrs = map[uint16]attrDesc{
+		ctaProtoinfoTCP: {"CTA_PROTOINFO_TCP", kindNested, map[uint16]attrDesc{
+			ctaProtoinfoTCPState:      {"CTA_PROTOINFO_TCP_STATE", kindU8, nil},
+			ctaProtoinfoTCPWScaleOrig: {"CTA_PROTOINFO_TCP_WSCALE_ORIGINAL", kindU8, nil},
+			ctaProtoinfoTCPWScaleRepl: {"CTA_PROTOINFO_TCP_WSCALE_REPLY", kindU8, nil},
+			ctaProtoinfoTCPFlagsOrig:  {"CTA_PROTOINFO_TCP_FLAGS_ORIGINAL", kindBytes, nil},
+			ctaProtoinfoTCPFlagsRepl:  {"CTA_PROTOINFO_TCP_FLAGS_REPLY", kindBytes, nil},
+		}},
+		ctaProtoinfoDCCP: {"CTA_PROTOINFO_DCCP", kindNested, map[uint16]attrDesc{
+			ctaProtoinfoDCCPState:        {"CTA_PROTOINFO_DCCP_STATE", kindU8, nil},
+			ctaProtoinfoDCCPRole:         {"CTA_PROTOINFO_DCCP_ROLE", kindU8, nil},
+			ctaProtoinfoDCCPHandshakeSeq: {"CTA_PROTOINFO_DCCP_HANDSHAKE_SEQ", kindU64, nil},
+		}},
+		ctaProtoinfoSCTP: {"CTA_PROTOINFO_SCTP", kindNested, map[uint16]attrDesc{
+			ctaProtoinfoSCTPState:        {"CTA_PROTOINFO_SCTP_STATE", kindU8, nil},
+			ctaProtoinfoSCTPVTagOriginal: {"CTA_PROTOINFO_SCTP_VTAG_ORIGINAL", kindU32, nil},
+			ctaProtoinfoSCTPVTagReply:    {"CTA_PROTOINFO_SCTP_VTAG_REPLY", kindU32, nil},
+		}},
+	}
+	decodeCounterAttrs = map[uint16]attrDesc{
+		ctaCounterPackets:   {"CTA_COUNTERS_PACKETS", kindU64, nil},
+		ctaCounterBytes:     {"CTA_COUNTERS_BYTES", kindU64, nil},
+		ctaCounter32Packets: {"CTA_COUNTERS32_PACKETS", kindU32, nil},
+		ctaCounter32Bytes:   {"CTA_COUNTERS32_BYTES", kindU32, nil},
+	}
+	decodeSeqAdjAttrs = map[uint16]attrDesc{
+		ctaSeqAdjCorrPos:      {"CTA_SEQADJ_CORRECTION_POS", kindU32, nil},
+		ctaSeqAdjOffsetBefore: {"CTA_SEQADJ_OFFSET_BEFORE", kindU32, nil},
+		ctaSeqAdjOffsetAfter:  {"CTA_SEQADJ_OFFSET_AFTER", kindU32, nil},
+	}
+	decodeNatAttrs = map[uint16]attrDesc{
+		ctaNatV4MinIP: {"CTA_NAT_V4_MINIP", kindIP, nil},
+		ctaNatV4MaxIP: {"CTA_NAT_V4_MAXIP", kindIP, nil},
+		ctaNatProto: {"CTA_NAT_PROTO", kindNested, map[uint16]attrDesc{
+			1: {"CTA_PROTONAT_PORT_MIN", kindU16, nil},
+			2: {"CTA_PROTONAT_PORT_MAX", kindU16, nil},
+		}},
+		ctaNatV6MinIP: {"CTA_NAT_V6_MINIP", kindIP, nil},
+		ctaNatV6MaxIP: {"CTA_NAT_V6_MAXIP", kindIP, nil},
+	}
+
+	decodeCtAttrs = map[uint16]attrDesc{
+		ctaTupleOrig:     {"CTA_TUPLE_ORIG", kindNested, decodeTupleAttrs},
+		ctaTupleReply:    {"CTA_TUPLE_REPLY", kindNested, decodeTupleAttrs},
+		ctaStatus:        {"CTA_STATUS", kindStatus, nil},
+		ctaProtoinfo:     {"CTA_PROTOINFO", kindNested, decodeProtoinfoAttrs},
+		ctaHelp:          {"CTA_HELP", kindNested, map[uint16]attrDesc{ctaHelpName: {"CTA_HELP_NAME", kindString, nil}, ctaHelpInfo: {"CTA_HELP_INFO", kindBytes, nil}}},
+		ctaNatSrc:        {"CTA_NAT_SRC", kindNested, decodeNatAttrs},
+		ctaTimeout:       {"CTA_TIMEOUT", kindU32, nil},
+		ctaMark:          {"CTA_MARK", kindHex32, nil},
+		ctaCountersOrig:  {"CTA_COUNTERS_ORIG", kindNested, decodeCounterAttrs},
+		ctaCountersReply: {"CTA_COUNTERS_REPLY", kindNested, decodeCounterAttrs},
+		ctaUse:           {"CTA_USE", kindU32, nil},
+		ctaID:            {"CTA_ID", kindU32, nil},
+		ctaNatDst:        {"CTA_NAT_DST", kindNested, decodeNatAttrs},
+		ctaTupleMaster:   {"CTA_TUPLE_MASTER", kindNested, decodeTupleAttrs},
+		ctaSeqAdjOrig:    {"CTA_SEQ_ADJ_ORIG", kindNested, decodeSeqAdjAttrs},
+		ctaSeqAdjRepl:    {"CTA_SEQ_ADJ_REPLY", kindNested, decodeSeqAdjAttrs},
+		ctaSecmark:       {"CTA_SECMARK", kindU32, nil},
+		ctaZone:          {"CTA_ZONE", kindU16, nil},
+		ctaSecCtx:        {"CTA_SECCTX", kindNested, map[uint16]attrDesc{ctaSecCtxName: {"CTA_SECCTX_NAME", kindString, nil}}},
+		ctaTimestamp:     {"CTA_TIMESTAMP", kindNested, map[uint16]attrDesc{ctaTimestampStart: {"CTA_TIMESTAMP_START", kindU64, nil}, ctaTimestampStop: {"CTA_TIMESTAMP_STOP", kindU64, nil}}},
+		ctaMarkMask:      {"CTA_MARK_MASK", kindHex32, nil},
+		ctaLables:        {"CTA_LABELS", kindBytes, nil},
+		ctaLablesMask:    {"CTA_LABELS_MASK", kindBytes, nil},
+		ctaSynProxy: {"CTA_SYNPROXY", kindNested, map[uint16]attrDesc{
+			1: {"CTA_SYNPROXY_ISN", kindU32, nil},
+			2: {"CTA_SYNPROXY_ITS", kindU32, nil},
+			3: {"CTA_SYNPROXY_TSOFF", kindU32, nil},
+		}},
+		ctaFilter: {"CTA_FILTER", kindNested, map[uint16]attrDesc{
+			1: {"CTA_FILTER_ORIG_FLAGS", kindHex32, nil},
+			2: {"CTA_FILTER_REPLY_FLAGS", kindHex32, nil},
+		}},
+		ctaStatusMask: {"CTA_STATUS_MASK", kindStatus, nil},
+	}
+
+	decodeExpAttrs = map[uint16]attrDesc{
+		ctaExpMaster:   {"CTA_EXPECT_MASTER", kindNested, decodeTupleAttrs},
+		ctaExpTuple:    {"CTA_EXPECT_TUPLE", kindNested, decodeTupleAttrs},
+		ctaExpMask:     {"CTA_EXPECT_MASK", kindNested, decodeTupleAttrs},
+		ctaExpTimeout:  {"CTA_EXPECT_TIMEOUT", kindU32, nil},
+		ctaExpID:       {"CTA_EXPECT_ID", kindU32, nil},
+		ctaExpHelpName: {"CTA_EXPECT_HELP_NAME", kindString, nil},
+		ctaExpZone:     {"CTA_EXPECT_ZONE", kindU16, nil},
+		ctaExpFlags:    {"CTA_EXPECT_FLAGS", kindHex32, nil},
+		ctaExpClass:    {"CTA_EXPECT_CLASS", kindU32, nil},
+		ctaExpNat: {"CTA_EXPECT_NAT", kindNested, map[uint16]attrDesc{
+			ctaExpNatDir:   {"CTA_EXPECT_NAT_DIR", kindU32, nil},
+			ctaExpNatTuple: {"CTA_EXPECT_NAT_TUPLE", kindNested, decodeTupleAttrs},
+		}},
+		ctaExpFn: {"CTA_EXPECT_FN", kindString, nil},
+	}
+
+	decodeCtStatsAttrs = map[uint16]attrDesc{
+		ctaStatsSearched:      {"CTA_STATS_SEARCHED", kindU32, nil},
+		ctaStatsFound:         {"CTA_STATS_FOUND", kindU32, nil},
+		ctaStatsNew:           {"CTA_STATS_NEW", kindU32, nil},
+		ctaStatsInvalid:       {"CTA_STATS_INVALID", kindU32, nil},
+		ctaStatsIgnore:        {"CTA_STATS_IGNORE", kindU32, nil},
+		ctaStatsDelete:        {"CTA_STATS_DELETE", kindU32, nil},
+		ctaStatsDeleteList:    {"CTA_STATS_DELETE_LIST", kindU32, nil},
+		ctaStatsInsert:        {"CTA_STATS_INSERT", kindU32, nil},
+		ctaStatsInsertFailed:  {"CTA_STATS_INSERT_FAILED", kindU32, nil},
+		ctaStatsDrop:          {"CTA_STATS_DROP", kindU32, nil},
+		ctaStatsEarlyDrop:     {"CTA_STATS_EARLY_DROP", kindU32, nil},
+		ctaStatsError:         {"CTA_STATS_ERROR", kindU32, nil},
+		ctaStatsSearchRestart: {"CTA_STATS_SEARCH_RESTART", kindU32, nil},
+	}
+
+	decodeExpStatsAttrs = map[uint16]attrDesc{
+		ctaStatsExpNew:    {"CTA_STATS_EXP_NEW", kindU32, nil},
+		ctaStatsExpCreate: {"CTA_STATS_EXP_CREATE", kindU32, nil},
+		ctaStatsExpDelete: {"CTA_STATS_EXP_DELETE", kindU32, nil},
+	}
+)
+
+var ctMsgNames = []string{
+	"IPCTNL_MSG_CT_NEW",
+	"IPCTNL_MSG_CT_GET",
+	"IPCTNL_MSG_CT_DELETE",
+	"IPCTNL_MSG_CT_GET_CTRZERO",
+	"IPCTNL_MSG_CT_GET_STATS_CPU",
+	"IPCTNL_MSG_CT_GET_STATS",
+	"IPCTNL_MSG_CT_GET_DYING",
+	"IPCTNL_MSG_CT_GET_UNCONFIRMED",
+}
+
+var expMsgNames = []string{
+	"IPCTNL_MSG_EXP_NEW",
+	"IPCTNL_MSG_EXP_GET",
+	"IPCTNL_MSG_EXP_DELETE",
+	"IPCTNL_MSG_EXP_GET_STATS_CPU",
+}
+
+// statusNames are the bits of CTA_STATUS (enum ip_conntrack_status).
+var statusNames = []string{
+	"EXPECTED", "SEEN_REPLY", "ASSURED", "CONFIRMED", "SRC_NAT", "DST_NAT",
+	"SEQ_ADJUST", "SRC_NAT_DONE", "DST_NAT_DONE", "DYING", "FIXED_TIMEOUT",
+	"TEMPLATE", "UNTRACKED", "HELPER", "OFFLOAD", "HW_OFFLOAD",
+}
+
+// l4ProtoNames are the names of common layer 4 protocols.
+var l4ProtoNames = map[uint8]string{1: "icmp", 6: "tcp", 17: "udp", 33: "dccp", 58: "icmpv6", 132: "sctp", 136: "udplite"}
+
+// DecodeMessage returns a human-readable tree of a ctnetlink or ctnetlink_exp
+// message, that shows the netlink header, the nfgenmsg header and the nested
+// CTA_* attributes with their names. Attributes, that are unknown, are marked
+// as such. For error messages the rejected request is decoded, if available.
+func DecodeMessage(msg netlink.Message) string {
+	var b strings.Builder
+	decodeMessage(&b, msg, "")
+	return b.String()
+}
+
+func decodeMessage(b *strings.Builder, msg netlink.Message, indent string) {
+	h := msg.Header
+	switch h.Type {
+	case netlink.Error:
+		fmt.Fprintf(b, "%sNLMSG_ERROR seq=%d pid=%d flags=%s\n", indent, h.Sequence, h.PID, decodeFlags(h))
+		decodeError(b, msg, indent+"  ")
+		return
+	case netlink.Done:
+		fmt.Fprintf(b, "%sNLMSG_DONE seq=%d pid=%d flags=%s\n", indent, h.Sequence, h.PID, decodeFlags(h))
+		return
+	case netlink.Noop, netlink.Overrun:
+		fmt.Fprintf(b, "%s%s seq=%d pid=%d\n", indent, h.Type, h.Sequence, h.PID)
+		return
+	}
+
+	name, attrs := messageType(h.Type)
+	fmt.Fprintf(b, "%s%s seq=%d pid=%d flags=%s\n", indent, name, h.Sequence, h.PID, decodeFlags(h))
+	if len(msg.Data) < 4 {
+		fmt.Fprintf(b, "%s  truncated nfgenmsg: %s\n", indent, hex.EncodeToString(msg.Data))
+		return
+	}
+	fmt.Fprintf(b, "%s  nfgenmsg family=%s version=%d res_id=%d\n", indent,
+		familyName(msg.Data[0]), msg.Data[1], binary.BigEndian.Uint16(msg.Data[2:4]))
+	decodeAttributes(b, msg.Data[4:], attrs, indent+"  ")
+}
+
+// messageType returns the name of the message type and the attributes of
+// its payload.
+func messageType(t netlink.HeaderType) (string, map[uint16]attrDesc) {
+	subsys, msgType := int(t>>8), int(t&0xff)
+	switch subsys {
+	case unix.NFNL_SUBSYS_CTNETLINK:
+		if msgType < len(ctMsgNames) {
+			attrs := decodeCtAttrs
+			switch msgType {
+			case ipctnlMsgCtGetStatsCPU:
+				attrs = decodeCtStatsAttrs
+			case ipctnlMsgCtGetStats:
+				attrs = map[uint16]attrDesc{
+					1: {"CTA_STATS_GLOBAL_ENTRIES", kindU32, nil},
+					2: {"CTA_STATS_GLOBAL_MAX_ENTRIES", kindU32, nil},
+				}
+			}
+			return ctMsgNames[msgType], attrs
+		}
+	case unix.NFNL_SUBSYS_CTNETLINK_EXP:
+		if msgType < len(expMsgNames) {
+			if msgType == ipctnlMsgExpGetStatsCPU {
+				return expMsgNames[msgType], decodeExpStatsAttrs
+			}
+			return expMsgNames[msgType], decodeExpAttrs
+		}
+	}
+	return fmt.Sprintf("unknown message type 0x%04x", uint16(t)), nil
+}
+
+// decodeFlags returns the names of the flags in h. The meaning of some flags
+// depends on the message type.
+func decodeFlags(h netlink.Header) string {
+	names := []string{"REQUEST", "MULTI", "ACK", "ECHO", "DUMP_INTR", "DUMP_FILTERED"}
+	var special []string
+	switch {
+	case h.Type == netlink.Error:
+		special = []string{"CAPPED", "ACK_TLVS"}
+	case isNewMessage(h.Type):
+		special = []string{"REPLACE", "EXCL", "CREATE", "APPEND"}
+	case h.Flags&netlink.Request != 0:
+		special = []string{"ROOT", "MATCH", "ATOMIC"}
+	}
+	names = append(names, "", "")
+	names = append(names, special...)
+
+	var set []string
+	for i := 0; i < 16; i++ {
+		bit := netlink.HeaderFlags(1 << i)
+		if h.Flags&bit == 0 {
+			continue
+		}
+		if i < len(names) && names[i] != "" {
+			set = append(set, names[i])
+		} else {
+			set = append(set, fmt.Sprintf("0x%x", uint16(bit)))
+		}
+	}
+	if len(set) == 0 {
+		return "0"
+	}
+	return strings.Join(set, "|")
+}
+
+// isNewMessage reports whether t is IPCTNL_MSG_CT_NEW or IPCTNL_MSG_EXP_NEW.
+func isNewMessage(t netlink.HeaderType) bool {
+	subsys := t >> 8
+	return (subsys == unix.NFNL_SUBSYS_CTNETLINK || subsys == unix.NFNL_SUBSYS_CTNETLINK_EXP) &&
+		t&0xff == ipctnlMsgCtNew
+}
+
+func familyName(family uint8) string {
+	switch family {
+	case unix.AF_UNSPEC:
+		return "AF_UNSPEC"
+	case unix.AF_INET:
+		return "AF_INET"
+	case unix.AF_INET6:
+		return "AF_INET6"
+	}
+	return fmt.Sprintf("%d", family)
+}
+
+// decodeError prints the content of a NLMSG_ERROR message.
+func decodeError(b *strings.Builder, msg netlink.Message, indent string) {
+	if len(msg.Data) < 4 {
+		fmt.Fprintf(b, "%struncated error: %s\n", indent, hex.EncodeToString(msg.Data))
+		return
+	}
+	code := int32(nlenc.Uint32(msg.Data[0:4]))
+	if code == 0 {
+		fmt.Fprintf(b, "%serror=0 (acknowledgement)\n", indent)
+	} else {
+		fmt.Fprintf(b, "%serror=%d (%v)\n", indent, code, syscall.Errno(-code))
+	}
+	if len(msg.Data) < 4+16 {
+		return
+	}
+
+	var req netlink.Message
+	length := int(nlenc.Uint32(msg.Data[4:8]))
+	capped := msg.Header.Flags&netlink.Capped != 0
+	if capped || length < 16 || 4+length > len(msg.Data) {
+		// only the header of the request is included
+		length = 16
+	}
+	if err := req.UnmarshalBinary(append([]byte{}, msg.Data[4:4+length]...)); err != nil {
+		// The payload of the request is missing.
+		req.Header.Type = netlink.HeaderType(nlenc.Uint16(msg.Data[8:10]))
+		req.Header.Flags = netlink.HeaderFlags(nlenc.Uint16(msg.Data[10:12]))
+		req.Header.Sequence = nlenc.Uint32(msg.Data[12:16])
+		req.Header.PID = nlenc.Uint32(msg.Data[16:20])
+		name, _ := messageType(req.Header.Type)
+		fmt.Fprintf(b, "%srequest %s seq=%d pid=%d flags=%s\n", indent, name,
+			req.Header.Sequence, req.Header.PID, decodeFlags(req.Header))
+	} else {
+		fmt.Fprintf(b, "%srequest:\n", indent)
+		decodeMessage(b, req, indent+"  ")
+	}
+
+	if msg.Header.Flags&netlink.AcknowledgeTLVs == 0 || 4+length > len(msg.Data) {
+		return
+	}
+	// extended acknowledgement
+	ad, err := netlink.NewAttributeDecoder(msg.Data[4+netlinkAlign(length):])
+	if err != nil {
+		return
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case 1: // NLMSGERR_ATTR_MSG
+			fmt.Fprintf(b, "%sNLMSGERR_ATTR_MSG %q\n", indent, ad.String())
+		case 2: // NLMSGERR_ATTR_OFFS
+			fmt.Fprintf(b, "%sNLMSGERR_ATTR_OFFS %d\n", indent, ad.Uint32())
+		default:
+			fmt.Fprintf(b, "%sNLMSGERR_ATTR %d: %s\n", indent, ad.Type(), hex.EncodeToString(ad.Bytes()))
+		}
+	}
+}
+
+// decodeAttributes prints the attributes in data, that are described by descs.
+func decodeAttributes(b *strings.Builder, data []byte, descs map[uint16]attrDesc, indent string) {
+	for len(data) >= 4 {
+		length := int(nlenc.Uint16(data[0:2]))
+		attrType := nlenc.Uint16(data[2:4])
+		if length < 4 || length > len(data) {
+			fmt.Fprintf(b, "%sinvalid attribute: %s\n", indent, hex.EncodeToString(data))
+			return
+		}
+		payload := data[4:length]
+		t := attrType &^ (nlafNested | 1<<14)
+
+		desc, ok := descs[t]
+		switch {
+		case !ok:
+			fmt.Fprintf(b, "%sunknown attribute %d (len %d): %s\n", indent, t, len(payload), hex.EncodeToString(payload))
+		case desc.kind == kindNested:
+			fmt.Fprintf(b, "%s%s\n", indent, desc.name)
+			decodeAttributes(b, payload, desc.nested, indent+"  ")
+		default:
+			fmt.Fprintf(b, "%s%s %s\n", indent, desc.name, decodeValue(desc.kind, payload))
+		}
+
+		if netlinkAlign(length) >= len(data) {
+			return
+		}
+		data = data[netlinkAlign(length):]
+	}
+	if len(data) > 0 {
+		fmt.Fprintf(b, "%strailing bytes: %s\n", indent, hex.EncodeToString(data))
+	}
+}
+
+// decodeValue returns the payload of an attribute as text.
+func decodeValue(kind attrKind, data []byte) string {
+	sizes := map[attrKind]int{kindU8: 1, kindU16: 2, kindU32: 4, kindU64: 8, kindHex32: 4, kindStatus: 4, kindL4Proto: 1}
+	if size, ok := sizes[kind]; ok && len(data) != size {
+		return fmt.Sprintf("%s (invalid length %d)", hex.EncodeToString(data), len(data))
+	}
+	switch kind {
+	case kindU8:
+		return fmt.Sprintf("%d", data[0])
+	case kindU16:
+		return fmt.Sprintf("%d", binary.BigEndian.Uint16(data))
+	case kindU32:
+		return fmt.Sprintf("%d", binary.BigEndian.Uint32(data))
+	case kindU64:
+		return fmt.Sprintf("%d", binary.BigEndian.Uint64(data))
+	case kindHex32:
+		return fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(data))
+	case kindIP:
+		if len(data) != 4 && len(data) != 16 {
+			return fmt.Sprintf("%s (invalid length %d)", hex.EncodeToString(data), len(data))
+		}
+		return net.IP(data).String()
+	case kindString:
+		return fmt.Sprintf("%q", strings.TrimRight(string(data), "\x00"))
+	case kindStatus:
+		status := binary.BigEndian.Uint32(data)
+		var set []string
+		for i, name := range statusNames {
+			if status&(1<<uint(i)) != 0 {
+				set = append(set, name)
+			}
+		}
+		return fmt.Sprintf("0x%08x %s", status, strings.Join(set, "|"))
+	case kindL4Proto:
+		if name, ok := l4ProtoNames[data[0]]; ok {
+			return fmt.Sprintf("%d (%s)", data[0], name)
+		}
+		return fmt.Sprintf("%d", data[0])
+	}
+	return hex.EncodeToString(data)
+}
@@ -0,0 +1,113 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	src, dst := net.ParseIP("1.1.1.1"), net.ParseIP("2.2.2.2")
+	var proto uint8 = 6
+	var sport, dport uint16 = 1234, 80
+	var mark uint32 = 42
+	c := Con{
+		Origin: &IPTuple{Src: &src, Dst: &dst, Proto: &ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+		Mark:   &mark,
+	}
+	attrs, err := nestAttributes(newStdLogger(nil), &c)
+	if err != nil {
+		t.Fatalf("could not nest attributes: %v", err)
+	}
+	// nfgenmsg, attributes and an unknown attribute of type 99
+	data := append(append([]byte{0x2, 0x0, 0x0, 0x0}, attrs...), 0x8, 0x0, 0x63, 0x0, 0x1, 0x2, 0x3, 0x4)
+	create := netlink.Message{
+		Header: netlink.Header{
+			Length:   uint32(16 + len(data)),
+			Type:     netlink.HeaderType(Conntrack<<8 | ipctnlMsgCtNew),
+			Flags:    netlink.Request | netlink.Acknowledge | netlink.Create | netlink.Excl,
+			Sequence: 7,
+			PID:      1,
+		},
+		Data: data,
+	}
+	ack := netlink.Message{
+		Header: netlink.Header{Type: netlink.Error, Flags: netlink.Capped, Sequence: 7, PID: 1},
+		// error code 0 and the header of the request
+		Data: []byte{0x0, 0x0, 0x0, 0x0, 0x48, 0x0, 0x0, 0x0, 0x0, 0x1, 0x5, 0x6, 0x7, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0},
+	}
+
+	tests := map[string]struct {
+		msg  netlink.Message
+		want string
+	}{
+		"create": {
+			msg: create,
+			want: `IPCTNL_MSG_CT_NEW seq=7 pid=1 flags=REQUEST|ACK|EXCL|CREATE
+  nfgenmsg family=AF_INET version=0 res_id=0
+  CTA_TUPLE_ORIG
+    CTA_TUPLE_IP
+      CTA_IP_V4_SRC 1.1.1.1
+      CTA_IP_V4_DST 2.2.2.2
+    CTA_TUPLE_PROTO
+      CTA_PROTO_NUM 6 (tcp)
+      CTA_PROTO_SRC_PORT 1234
+      CTA_PROTO_DST_PORT 80
+  CTA_MARK 0x0000002a
+  unknown attribute 99 (len 4): 01020304
+`,
+		},
+		"error": {
+			msg: errorMessage(create, 17),
+			want: `NLMSG_ERROR seq=7 pid=1 flags=0
+  error=-17 (file exists)
+  request:
+    IPCTNL_MSG_CT_NEW seq=7 pid=1 flags=REQUEST|ACK|EXCL|CREATE
+      nfgenmsg family=AF_INET version=0 res_id=0
+      CTA_TUPLE_ORIG
+        CTA_TUPLE_IP
+          CTA_IP_V4_SRC 1.1.1.1
+          CTA_IP_V4_DST 2.2.2.2
+        CTA_TUPLE_PROTO
+          CTA_PROTO_NUM 6 (tcp)
+          CTA_PROTO_SRC_PORT 1234
+          CTA_PROTO_DST_PORT 80
+      CTA_MARK 0x0000002a
+      unknown attribute 99 (len 4): 01020304
+`,
+		},
+		"ack": {
+			msg: ack,
+			want: `NLMSG_ERROR seq=7 pid=1 flags=CAPPED
+  error=0 (acknowledgement)
+  request IPCTNL_MSG_CT_NEW seq=7 pid=1 flags=REQUEST|ACK|EXCL|CREATE
+`,
+		},
+		"done": {
+			msg: netlink.Message{
+				Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi | netlink.DumpInterrupted, Sequence: 3},
+				Data:   []byte{0x0, 0x0, 0x0, 0x0},
+			},
+			want: "NLMSG_DONE seq=3 pid=0 flags=MULTI|DUMP_INTR\n",
+		},
+		"expectation with invalid length": {
+			msg: netlink.Message{
+				Header: netlink.Header{Type: netlink.HeaderType(Expected<<8 | ipctnlMsgExpNew)},
+				Data:   []byte{0xa, 0x0, 0x0, 0x0, 0x6, 0x0, 0x5, 0x0, 0x1, 0x2, 0x0, 0x0},
+			},
+			want: `IPCTNL_MSG_EXP_NEW seq=0 pid=0 flags=0
+  nfgenmsg family=AF_INET6 version=0 res_id=0
+  CTA_EXPECT_ID 0102 (invalid length 2)
+`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := DecodeMessage(tc.msg); got != tc.want {
+				t.Fatalf("unexpected output:\n%s\nexpected:\n%s", got, tc.want)
+			}
+		})
+	}
+}
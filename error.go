@@ -0,0 +1,157 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Errors, that can be checked with errors.Is against an Error returned by the kernel.
+var (
+	ErrNotFound     = errors.New("entry not found")
+	ErrExists       = errors.New("entry already exists")
+	ErrPermission   = errors.New("operation not permitted")
+	ErrNotSupported = errors.New("operation not supported")
+)
+
+// ErrDumpInterrupted is returned together with the received entries, if the
+// table changed during a dump (NLM_F_DUMP_INTR). The entries might be
+// inconsistent and the dump should be repeated.
+var ErrDumpInterrupted = errors.New("dump was interrupted")
+
+// Error is returned, if the kernel rejects a request.
+type Error struct {
+	// Errno returned by the kernel.
+	Errno syscall.Errno
+
+	// Request, that was rejected. It is empty, if the request is not known.
+	Request netlink.Message
+
+	// Message and Offset are only set, if the kernel provides an extended
+	// acknowledgement. Offset points into Request and is 0, if not provided.
+	Message string
+	Offset  int
+
+	// Path lists the types of the attributes, that lead to the attribute
+	// Offset points to. It is empty, if Offset is not provided.
+	Path []uint16
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Errno.Error())
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	if len(e.Path) > 0 {
+		path := make([]string, 0, len(e.Path))
+		for _, t := range e.Path {
+			path = append(path, fmt.Sprintf("%d", t))
+		}
+		fmt.Fprintf(&b, " (attribute %s)", strings.Join(path, "/"))
+	}
+	return b.String()
+}
+
+// Unwrap returns the errno of the error.
+func (e *Error) Unwrap() error {
+	return e.Errno
+}
+
+// Is reports whether the error matches one of the sentinel errors of this package.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Errno == unix.ENOENT
+	case ErrExists:
+		return e.Errno == unix.EEXIST
+	case ErrPermission:
+		return e.Errno == unix.EPERM || e.Errno == unix.EACCES
+	case ErrNotSupported:
+		return e.Errno == unix.EOPNOTSUPP || e.Errno == unix.ENOTSUPP
+	}
+	return false
+}
+
+// newError turns errors of the kernel into Error and returns all other errors unchanged.
+func newError(req netlink.Message, err error) error {
+	var opErr *netlink.OpError
+	if !errors.As(err, &opErr) {
+		return err
+	}
+	errno, ok := opErr.Err.(syscall.Errno)
+	if !ok {
+		return err
+	}
+	e := &Error{
+		Errno:   errno,
+		Request: req,
+		Message: opErr.Message,
+		Offset:  opErr.Offset,
+	}
+	e.Path = attributePath(req, e.Offset)
+	return e
+}
+
+// errorFromMsg returns an Error for the content of a NLMSG_ERROR message or
+// nil, if the message acknowledges a request.
+func errorFromMsg(req netlink.Message, msg netlink.Message) error {
+	if len(msg.Data) < 4 {
+		return ErrDataLength
+	}
+	code := int32(nlenc.Uint32(msg.Data[0:4]))
+	if code == 0 {
+		return nil
+	}
+	return &Error{
+		Errno:   syscall.Errno(-code),
+		Request: req,
+	}
+}
+
+// attributePath returns the types of the nested attributes of req, that
+// contain the byte at offset. offset includes the netlink header.
+func attributePath(req netlink.Message, offset int) []uint16 {
+	// netlink header and struct nfgenmsg
+	offset -= 16 + 4
+	if offset < 0 || len(req.Data) < 4 {
+		return nil
+	}
+	var path []uint16
+	data := req.Data[4:]
+	for len(data) >= 4 {
+		length := int(nlenc.Uint16(data[0:2]))
+		attrType := nlenc.Uint16(data[2:4])
+		if length < 4 || length > len(data) {
+			return path
+		}
+		if offset >= length {
+			aligned := netlinkAlign(length)
+			if offset < aligned || aligned > len(data) {
+				// offset points to padding
+				return path
+			}
+			offset -= aligned
+			data = data[aligned:]
+			continue
+		}
+		path = append(path, attrType&^nlafNested)
+		if attrType&nlafNested == 0 || offset < 4 {
+			return path
+		}
+		offset -= 4
+		data = data[4:length]
+	}
+	return path
+}
+
+// netlinkAlign rounds length up to the alignment of netlink attributes.
+func netlinkAlign(length int) int {
+	return (length + 3) &^ 3
+}
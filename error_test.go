@@ -0,0 +1,112 @@
+package conntrack
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+func TestErrorIs(t *testing.T) {
+	tests := []struct {
+		errno syscall.Errno
+		match error
+	}{
+		{errno: unix.ENOENT, match: ErrNotFound},
+		{errno: unix.EEXIST, match: ErrExists},
+		{errno: unix.EPERM, match: ErrPermission},
+		{errno: unix.EACCES, match: ErrPermission},
+		{errno: unix.EOPNOTSUPP, match: ErrNotSupported},
+		{errno: unix.ENOTSUPP, match: ErrNotSupported},
+	}
+	sentinels := []error{ErrNotFound, ErrExists, ErrPermission, ErrNotSupported}
+
+	for _, tc := range tests {
+		t.Run(tc.errno.Error(), func(t *testing.T) {
+			err := error(&Error{Errno: tc.errno})
+			for _, sentinel := range sentinels {
+				if got := errors.Is(err, sentinel); got != (sentinel == tc.match) {
+					t.Fatalf("errors.Is(%v, %v) = %t", err, sentinel, got)
+				}
+			}
+			if !errors.Is(err, tc.errno) {
+				t.Fatalf("errno %v is not wrapped", tc.errno)
+			}
+		})
+	}
+}
+
+func TestKernelError(t *testing.T) {
+	nfct := &Nfct{}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	nfct.Con = nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+		if len(reqs) == 0 {
+			return nil, nil
+		}
+		return nltest.Error(int(unix.ENOENT), reqs)
+	})
+	defer nfct.Con.Close()
+
+	err := nfct.Delete(Conntrack, IPv4, Con{})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("unexpected type of error: %T", err)
+	}
+	// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_DELETE
+	if e.Request.Header.Type != netlink.HeaderType(1<<8|2) {
+		t.Fatalf("unexpected request: %#v", e.Request)
+	}
+}
+
+func TestAttributePath(t *testing.T) {
+	srcIP := net.ParseIP("1.1.1.1")
+	dstIP := net.ParseIP("2.2.2.2")
+	var udp uint8 = 17
+	var srcPort uint16 = 22
+	var dstPort uint16 = 10
+	data, err := nestAttributes(nil, &Con{
+		Origin: &IPTuple{Src: &srcIP, Dst: &dstIP, Proto: &ProtoTuple{Number: &udp, SrcPort: &srcPort, DstPort: &dstPort}},
+		Reply:  &IPTuple{Src: &dstIP, Dst: &srcIP, Proto: &ProtoTuple{Number: &udp, SrcPort: &dstPort, DstPort: &srcPort}},
+	})
+	if err != nil {
+		t.Fatalf("could not marshal attributes: %v", err)
+	}
+	req := netlink.Message{Data: append([]byte{0x2, 0x0, 0x0, 0x0}, data...)}
+
+	tests := []struct {
+		name   string
+		offset int
+		path   []uint16
+	}{
+		{name: "noOffset", offset: 0},
+		{name: "header", offset: 8},
+		{name: "origin", offset: 20, path: []uint16{ctaTupleOrig}},
+		{name: "origin src", offset: 28, path: []uint16{ctaTupleOrig, ctaTupleIP, ctaIPv4Src}},
+		{name: "origin src value", offset: 32, path: []uint16{ctaTupleOrig, ctaTupleIP, ctaIPv4Src}},
+		{name: "origin proto", offset: 44, path: []uint16{ctaTupleOrig, ctaTupleProto}},
+		{name: "reply", offset: 72, path: []uint16{ctaTupleReply}},
+		{name: "behind", offset: 500},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := attributePath(req, tc.offset)
+			if len(path) != len(tc.path) {
+				t.Fatalf("unexpected path:\n- want: %v\n-  got: %v", tc.path, path)
+			}
+			for i := range path {
+				if path[i] != tc.path[i] {
+					t.Fatalf("unexpected path:\n- want: %v\n-  got: %v", tc.path, path)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package conntrack
+
+import (
+	"context"
+	"time"
+
+	"github.com/mdlayher/netlink"
+)
+
+// EventKind classifies a message received from a Netlinkgroup.
+type EventKind uint8
+
+// Supported kinds of events
+const (
+	// EventUnknown is used for messages that could not be classified.
+	EventUnknown EventKind = iota
+	// EventNew reports a newly created entry.
+	EventNew
+	// EventUpdate reports a change of an existing entry.
+	EventUpdate
+	// EventDestroy reports the removal of an entry.
+	EventDestroy
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventNew:
+		return "new"
+	case EventUpdate:
+		return "update"
+	case EventDestroy:
+		return "destroy"
+	}
+	return "unknown"
+}
+
+// Event represents a single message received from a Netlinkgroup.
+type Event struct {
+	// Kind of the event.
+	Kind EventKind
+
+	// Table the event originates from.
+	Table Table
+
+	// Con holds the attributes of the entry.
+	Con Con
+
+	// Sequence and PID of the netlink header of the message.
+	Sequence uint32
+	PID      uint32
+
+	// Time the message was received.
+	Time time.Time
+
+	// Synthetic is set for events, that were created by a resynchronization
+	// and not received from the kernel.
+	Synthetic bool
+
+	// Dropped is the number of events, that were dropped by EventDrop
+	// before this event, because the buffer of the event channel was full.
+	Dropped uint64
+}
+
+// Group returns the NetlinkGroup the event was sent to.
+func (e Event) Group() NetlinkGroup {
+	var groups [3]NetlinkGroup
+	switch e.Table {
+	case Conntrack:
+		groups = [3]NetlinkGroup{NetlinkCtNew, NetlinkCtUpdate, NetlinkCtDestroy}
+	case Expected:
+		groups = [3]NetlinkGroup{NetlinkCtExpectedNew, NetlinkCtExpectedUpdate, NetlinkCtExpectedDestroy}
+	default:
+		return 0
+	}
+
+	switch e.Kind {
+	case EventNew:
+		return groups[0]
+	case EventUpdate:
+		return groups[1]
+	case EventDestroy:
+		return groups[2]
+	}
+	return 0
+}
+
+// EventFunc is a function, that receives events from a Netlinkgroup.
+// Return something different than 0, to stop receiving messages.
+type EventFunc func(e Event) int
+
+// classifyEvent returns the table and kind of event of a message received
+// from a Netlinkgroup.
+func classifyEvent(h netlink.Header) (Table, EventKind) {
+	t := Table((h.Type & 0x300) >> 8)
+	msgType := int(h.Type) & 0xF
+
+	var newType, deleteType int
+	switch t {
+	case Conntrack:
+		newType, deleteType = ipctnlMsgCtNew, ipctnlMsgCtDelete
+	case Expected:
+		newType, deleteType = ipctnlMsgExpNew, ipctnlMsgExpDelete
+	default:
+		return t, EventUnknown
+	}
+
+	switch msgType {
+	case newType:
+		// The kernel sets NLM_F_CREATE|NLM_F_EXCL only for new entries.
+		if h.Flags&(netlink.Create|netlink.Excl) != 0 {
+			return t, EventNew
+		}
+		return t, EventUpdate
+	case deleteType:
+		return t, EventDestroy
+	}
+	return t, EventUnknown
+}
+
+// newEvent creates an Event for the received message.
+func newEvent(msg netlink.Message, c Con, received time.Time) Event {
+	t, kind := classifyEvent(msg.Header)
+	return Event{
+		Kind:     kind,
+		Table:    t,
+		Con:      c,
+		Sequence: msg.Header.Sequence,
+		PID:      msg.Header.PID,
+		Time:     received,
+	}
+}
+
+// EventPolicy defines how an event stream handles a full buffer.
+type EventPolicy int
+
+// Supported policies for event streams
+const (
+	// EventBlock blocks the processing of further messages until there is
+	// space in the buffer.
+	EventBlock EventPolicy = iota
+	// EventDrop drops events, if the buffer is full. The number of dropped
+	// events is reported in Dropped of the next delivered event.
+	EventDrop
+)
+
+// EventOptions configure the event stream returned by Events.
+type EventOptions struct {
+	// Table to receive events from.
+	Table Table
+
+	// Groups to subscribe to.
+	Groups NetlinkGroup
+
+	// Filter is applied in the same way as for RegisterFiltered and can be empty.
+	Filter []ConnAttr
+
+	// Expr is a filter expression, that is compiled into the BPF filter of
+	// the subscription. If Filter is set as well, both have to match.
+	// If the filter exceeds the limit of instructions of the kernel, the
+	// received messages are filtered in userspace instead.
+	Expr FilterExpr
+
+	// BufferSize of the returned event channel.
+	BufferSize int
+
+	// Policy defines the behavior, if the buffer of the event channel is full.
+	Policy EventPolicy
+
+	// Resync enables the resynchronization after the kernel dropped events.
+	// The table is dumped and synthetic EventNew and EventDestroy events are
+	// emitted for the differences to the previously known state.
+	// To detect the differences, all entries of the table, that pass Filter
+	// and Expr, are kept in memory.
+	Resync bool
+
+	// Family of the entries that are dumped for a resynchronization. If not
+	// set, entries of all families are dumped.
+	Family Family
+}
+
+// Events returns a stream of events from the Netlinkgroups specified in opts.
+// Unexpected errors are reported via the returned error channel and end the stream.
+// Both channels are closed, once ctx is done or the stream ended otherwise.
+func (nfct *Nfct) Events(ctx context.Context, opts EventOptions) (<-chan Event, <-chan error) {
+	events := make(chan Event, opts.BufferSize)
+	errs := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	// dropped is only accessed by the goroutine, that receives the events.
+	var dropped uint64
+	fn := func(e Event) int {
+		if opts.Policy == EventDrop {
+			e.Dropped = dropped
+			select {
+			case events <- e:
+				dropped = 0
+			default:
+				dropped++
+			}
+			return 0
+		}
+		select {
+		case events <- e:
+			return 0
+		case <-ctx.Done():
+			return 1
+		}
+	}
+	errFn := func(err error) {
+		errs <- err
+		cancel()
+	}
+
+	sub, err := nfct.subscribe(ctx, opts, fn, errFn)
+	if err != nil {
+		cancel()
+		errs <- err
+		close(errs)
+		close(events)
+		return events, errs
+	}
+
+	go func() {
+		<-sub.Done()
+		cancel()
+		close(events)
+		close(errs)
+	}()
+
+	return events, errs
+}
@@ -0,0 +1,325 @@
+package conntrack
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-conntrack/internal/bpfvm"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/net/bpf"
+)
+
+func TestClassifyEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header netlink.Header
+		table  Table
+		kind   EventKind
+		group  NetlinkGroup
+	}{
+		{
+			name: "conntrack new",
+			// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_NEW
+			header: netlink.Header{Type: netlink.HeaderType(1 << 8), Flags: netlink.Create | netlink.Excl},
+			table:  Conntrack, kind: EventNew, group: NetlinkCtNew,
+		},
+		{
+			name:   "conntrack update",
+			header: netlink.Header{Type: netlink.HeaderType(1 << 8)},
+			table:  Conntrack, kind: EventUpdate, group: NetlinkCtUpdate,
+		},
+		{
+			name: "conntrack destroy",
+			// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_DELETE
+			header: netlink.Header{Type: netlink.HeaderType(1<<8 | 2)},
+			table:  Conntrack, kind: EventDestroy, group: NetlinkCtDestroy,
+		},
+		{
+			name: "expected new",
+			// NFNL_SUBSYS_CTNETLINK_EXP<<8|IPCTNL_MSG_EXP_NEW
+			header: netlink.Header{Type: netlink.HeaderType(2 << 8), Flags: netlink.Create | netlink.Excl},
+			table:  Expected, kind: EventNew, group: NetlinkCtExpectedNew,
+		},
+		{
+			name:   "expected update",
+			header: netlink.Header{Type: netlink.HeaderType(2 << 8)},
+			table:  Expected, kind: EventUpdate, group: NetlinkCtExpectedUpdate,
+		},
+		{
+			name: "expected destroy",
+			// NFNL_SUBSYS_CTNETLINK_EXP<<8|IPCTNL_MSG_EXP_DELETE
+			header: netlink.Header{Type: netlink.HeaderType(2<<8 | 2)},
+			table:  Expected, kind: EventDestroy, group: NetlinkCtExpectedDestroy,
+		},
+		{
+			name: "conntrack get",
+			// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_GET
+			header: netlink.Header{Type: netlink.HeaderType(1<<8 | 1)},
+			table:  Conntrack, kind: EventUnknown,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			table, kind := classifyEvent(tc.header)
+			if table != tc.table {
+				t.Fatalf("unexpected table:\n- want: %d\n-  got: %d", tc.table, table)
+			}
+			if kind != tc.kind {
+				t.Fatalf("unexpected kind:\n- want: %s\n-  got: %s", tc.kind, kind)
+			}
+			e := Event{Table: table, Kind: kind}
+			if e.Group() != tc.group {
+				t.Fatalf("unexpected group:\n- want: %d\n-  got: %d", tc.group, e.Group())
+			}
+		})
+	}
+}
+
+// eventSocket is a netlink.Socket that emulates a multicast subscription.
+// If handler is set, its replies to sent messages can be received. If
+// filtering is set, received messages are checked by the attached BPF filter.
+type eventSocket struct {
+	msgs      chan []netlink.Message
+	errs      chan error
+	handler   func(req netlink.Message) []netlink.Message
+	filtering bool
+
+	mu       sync.Mutex
+	groups   map[uint32]bool
+	deadline chan struct{}
+	timer    *time.Timer
+	filter   *bpfvm.VM
+	closed   bool
+}
+
+func newEventSocket() *eventSocket {
+	return &eventSocket{
+		msgs:     make(chan []netlink.Message, 16),
+		errs:     make(chan error, 1),
+		groups:   make(map[uint32]bool),
+		deadline: make(chan struct{}),
+	}
+}
+
+func (s *eventSocket) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *eventSocket) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *eventSocket) SetBPF(filter []bpf.RawInstruction) error {
+	vm, err := bpfvm.New(filter)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter = vm
+	return nil
+}
+
+func (s *eventSocket) RemoveBPF() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter = nil
+	return nil
+}
+
+func (s *eventSocket) attached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filter != nil
+}
+
+func (s *eventSocket) SetOption(netlink.ConnOption, bool) error { return nil }
+func (s *eventSocket) SetDeadline(t time.Time) error            { return s.SetReadDeadline(t) }
+func (s *eventSocket) SetWriteDeadline(t time.Time) error       { return nil }
+func (s *eventSocket) JoinGroup(group uint32) error             { return s.manage(group, true) }
+func (s *eventSocket) LeaveGroup(group uint32) error            { return s.manage(group, false) }
+
+func (s *eventSocket) Send(m netlink.Message) error {
+	return s.SendMessages([]netlink.Message{m})
+}
+
+func (s *eventSocket) SendMessages(msgs []netlink.Message) error {
+	if s.handler == nil {
+		return nil
+	}
+	for _, m := range msgs {
+		if reply := s.handler(m); len(reply) > 0 {
+			s.msgs <- reply
+		}
+	}
+	return nil
+}
+
+func (s *eventSocket) manage(group uint32, join bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[group] = join
+	return nil
+}
+
+func (s *eventSocket) joined(group uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.groups[group]
+}
+
+func (s *eventSocket) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	select {
+	case <-s.deadline:
+		s.deadline = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return nil
+	}
+	deadline := s.deadline
+	s.timer = time.AfterFunc(time.Until(t), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-deadline:
+		default:
+			close(deadline)
+		}
+	})
+	return nil
+}
+
+func (s *eventSocket) Receive() ([]netlink.Message, error) {
+	s.mu.Lock()
+	deadline := s.deadline
+	s.mu.Unlock()
+
+	select {
+	case msgs := <-s.msgs:
+		return s.filterMessages(msgs), nil
+	case err := <-s.errs:
+		return nil, err
+	case <-deadline:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// filterMessages returns the messages, that pass the attached BPF filter.
+func (s *eventSocket) filterMessages(msgs []netlink.Message) []netlink.Message {
+	s.mu.Lock()
+	filter := s.filter
+	s.mu.Unlock()
+	if !s.filtering || filter == nil {
+		return msgs
+	}
+	var passed []netlink.Message
+	for _, msg := range msgs {
+		if filter.Run(messagePacket(msg)) != bpfVerdictReject {
+			passed = append(passed, msg)
+		}
+	}
+	return passed
+}
+
+func TestEvents(t *testing.T) {
+	sock := newEventSocket()
+	nfct := &Nfct{
+		Con:    netlink.NewConn(sock, 1),
+		logger: newStdLogger(nil),
+	}
+
+	// NFNL_SUBSYS_CTNETLINK_EXP<<8|IPCTNL_MSG_EXP_NEW
+	sock.msgs <- []netlink.Message{{
+		Header: netlink.Header{Type: netlink.HeaderType(2 << 8), Flags: netlink.Create | netlink.Excl, Sequence: 42},
+		Data:   []byte{0x2, 0x0, 0x0, 0x0},
+	}}
+	// NFNL_SUBSYS_CTNETLINK_EXP<<8|IPCTNL_MSG_EXP_DELETE
+	sock.msgs <- []netlink.Message{{
+		Header: netlink.Header{Type: netlink.HeaderType(2<<8 | 2), Sequence: 43},
+		Data:   []byte{0x2, 0x0, 0x0, 0x0},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, errs := nfct.Events(ctx, EventOptions{
+		Table:  Expected,
+		Groups: NetlinkCtExpectedNew | NetlinkCtExpectedDestroy,
+	})
+
+	for _, want := range []struct {
+		kind EventKind
+		seq  uint32
+	}{{EventNew, 42}, {EventDestroy, 43}} {
+		e := <-events
+		if e.Table != Expected || e.Kind != want.kind || e.Sequence != want.seq {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	}
+
+	if !sock.joined(4) || !sock.joined(6) || sock.joined(5) {
+		t.Fatalf("unexpected groups: %v", sock.groups)
+	}
+
+	cancel()
+	for range events {
+	}
+	if err, ok := <-errs; ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sock.joined(4) || sock.joined(6) {
+		t.Fatalf("groups were not left: %v", sock.groups)
+	}
+}
+
+func TestEventsDropped(t *testing.T) {
+	sock := newEventSocket()
+	// Without a buffer, a send returns once the previous batch of messages
+	// is processed.
+	sock.msgs = make(chan []netlink.Message)
+	nfct := &Nfct{
+		Con:    netlink.NewConn(sock, 1),
+		logger: newStdLogger(nil),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, _ := nfct.Events(ctx, EventOptions{
+		Table:      Conntrack,
+		Groups:     NetlinkCtUpdate,
+		BufferSize: 1,
+		Policy:     EventDrop,
+	})
+
+	// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_NEW
+	msg := func(seq uint32) netlink.Message {
+		return netlink.Message{
+			Header: netlink.Header{Type: netlink.HeaderType(1 << 8), Sequence: seq},
+			Data:   []byte{0x2, 0x0, 0x0, 0x0},
+		}
+	}
+	sock.msgs <- []netlink.Message{msg(1), msg(2), msg(3)}
+	sock.msgs <- nil
+	if e := <-events; e.Sequence != 1 || e.Dropped != 0 {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	sock.msgs <- []netlink.Message{msg(4)}
+	if e := <-events; e.Sequence != 4 || e.Dropped != 2 {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
@@ -0,0 +1,45 @@
+package conntrack_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+)
+
+func ExampleNfct_Subscribe() {
+	nfct, err := ct.Open(&ct.Config{})
+	if err != nil {
+		fmt.Println("could not create nfct:", err)
+		return
+	}
+	defer nfct.Close()
+
+	monitor := func(e ct.Event) int {
+		fmt.Printf("[%s] %#v\n", e.Kind, e.Con)
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Subscriptions to different tables can be active at the same time.
+	conntrack, err := nfct.Subscribe(ctx, ct.EventOptions{Table: ct.Conntrack, Groups: ct.NetlinkCtNew | ct.NetlinkCtDestroy}, monitor)
+	if err != nil {
+		fmt.Println("could not subscribe to conntrack events:", err)
+		return
+	}
+	expected, err := nfct.Subscribe(ctx, ct.EventOptions{Table: ct.Expected, Groups: ct.NetlinkCtExpectedNew}, monitor)
+	if err != nil {
+		fmt.Println("could not subscribe to expected events:", err)
+		return
+	}
+
+	if err := conntrack.Wait(); err != nil {
+		fmt.Println("conntrack subscription failed:", err)
+	}
+	if err := expected.Wait(); err != nil {
+		fmt.Println("expected subscription failed:", err)
+	}
+}
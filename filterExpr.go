@@ -0,0 +1,235 @@
+package conntrack
+
+import (
+	"errors"
+
+	"github.com/mdlayher/netlink"
+)
+
+// ErrFilterExprNotAttrs is returned by FilterAttrs, if the FilterExpr can not
+// be expressed as []ConnAttr.
+var ErrFilterExprNotAttrs = errors.New("filter expression can not be expressed as []ConnAttr")
+
+// FilterExpr is a boolean expression over the attributes of a connection and
+// the message, that reports it. It is compiled into the BPF filter of a
+// subscription. ConnAttr, Compare, MessageFlags and Sample are the leaves of
+// an expression and FilterExpr are combined by And, Or and Not.
+type FilterExpr interface {
+	filterExpr()
+}
+
+type andExpr []FilterExpr
+
+type orExpr []FilterExpr
+
+type notExpr struct {
+	expr FilterExpr
+}
+
+func (andExpr) filterExpr() {}
+
+func (orExpr) filterExpr() {}
+
+func (notExpr) filterExpr() {}
+
+// A ConnAttr as FilterExpr matches, if the attribute exists and its value is
+// equal to Data. If Mask is set, both values are masked before the comparison.
+// Negate inverts the result.
+func (ConnAttr) filterExpr() {}
+
+// CompareOp is the operator of a Compare.
+type CompareOp uint8
+
+// Operators of Compare
+const (
+	// CompareEq matches, if the value of the attribute is equal to Value.
+	CompareEq CompareOp = iota
+	// CompareGt matches, if the value of the attribute is greater than Value.
+	CompareGt
+	// CompareGe matches, if the value of the attribute is greater than or
+	// equal to Value.
+	CompareGe
+	// CompareLt matches, if the value of the attribute is less than Value.
+	CompareLt
+	// CompareLe matches, if the value of the attribute is less than or equal
+	// to Value.
+	CompareLe
+	// CompareAnySet matches, if at least one of the bits of Value is set in
+	// the value of the attribute.
+	CompareAnySet
+)
+
+// Compare is a FilterExpr, that compares the value of an attribute with Value.
+// The value of the attribute is an unsigned integer of 1, 2, 4 or 8 bytes in
+// network byte order, like ports, Timeout, Use, Status or the counters.
+type Compare struct {
+	Type  ConnAttrType
+	Op    CompareOp
+	Value uint64
+}
+
+func (Compare) filterExpr() {}
+
+// Range returns a FilterExpr, that matches if the value of the attribute typ
+// is between min and max, including both.
+func Range(typ ConnAttrType, min, max uint64) FilterExpr {
+	return andExpr{
+		Compare{Type: typ, Op: CompareGe, Value: min},
+		Compare{Type: typ, Op: CompareLe, Value: max},
+	}
+}
+
+// MessageFlags is a FilterExpr, that matches if at least one of Flags is set
+// in the netlink header of the message. The kernel sets netlink.Create and
+// netlink.Excl for new entries.
+type MessageFlags struct {
+	Flags netlink.HeaderFlags
+}
+
+func (MessageFlags) filterExpr() {}
+
+// msgTypeExpr matches messages, whose type in the subsystem (IPCTNL_MSG_* or
+// IPCTNL_MSG_EXP_*) is equal to its value.
+type msgTypeExpr uint8
+
+func (msgTypeExpr) filterExpr() {}
+
+// EventKinds returns a FilterExpr, that matches the messages of events of
+// kinds. EventUnknown is ignored.
+func EventKinds(kinds ...EventKind) FilterExpr {
+	// The types of the messages are the same for both subsystems.
+	created := MessageFlags{Flags: netlink.Create | netlink.Excl}
+	var or orExpr
+	for _, kind := range kinds {
+		switch kind {
+		case EventNew:
+			or = append(or, andExpr{msgTypeExpr(ipctnlMsgCtNew), created})
+		case EventUpdate:
+			or = append(or, andExpr{msgTypeExpr(ipctnlMsgCtNew), notExpr{expr: created}})
+		case EventDestroy:
+			or = append(or, msgTypeExpr(ipctnlMsgCtDelete))
+		}
+	}
+	return or
+}
+
+// Sample is a FilterExpr, that matches one of N messages. If Tuple is set,
+// the messages are selected by a hash of the original tuple, so either all or
+// none of the events of a connection match. Otherwise the messages are
+// selected randomly. If N is 0 or 1, every message matches.
+type Sample struct {
+	N     uint32
+	Tuple bool
+}
+
+func (Sample) filterExpr() {}
+
+// And returns a FilterExpr, that matches if all of exprs match. Without exprs
+// it matches every connection.
+func And(exprs ...FilterExpr) FilterExpr {
+	return andExpr(exprs)
+}
+
+// Or returns a FilterExpr, that matches if at least one of exprs matches.
+// Without exprs it matches no connection.
+func Or(exprs ...FilterExpr) FilterExpr {
+	return orExpr(exprs)
+}
+
+// Not returns a FilterExpr, that matches if expr does not match.
+func Not(expr FilterExpr) FilterExpr {
+	return notExpr{expr: expr}
+}
+
+// filterToExpr returns the FilterExpr of filters, as they are used by
+// RegisterFiltered. ConnAttr of the same type are linked by Or and ConnAttr
+// of different types by And.
+func filterToExpr(filters []ConnAttr) (FilterExpr, error) {
+	groups := make(map[ConnAttrType][]FilterExpr)
+	negate := make(map[ConnAttrType]bool)
+	var order []ConnAttrType
+	for _, filter := range filters {
+		if _, ok := groups[filter.Type]; !ok {
+			order = append(order, filter.Type)
+			negate[filter.Type] = filter.Negate
+		} else if negate[filter.Type] != filter.Negate {
+			return nil, ErrFilterAttributeNegateMix
+		}
+		filter.Negate = false
+		groups[filter.Type] = append(groups[filter.Type], filter)
+	}
+
+	var and andExpr
+	for _, t := range order {
+		var expr FilterExpr = orExpr(groups[t])
+		if negate[t] {
+			expr = notExpr{expr: expr}
+		}
+		and = append(and, expr)
+	}
+	return and, nil
+}
+
+// FilterAttrs returns the []ConnAttr of expr for RegisterFiltered. This is
+// only possible, if expr is an And of ConnAttr or Or of ConnAttr of the same
+// type, which can be negated as a whole, and each type is used only once.
+// Otherwise ErrFilterExprNotAttrs is returned.
+func FilterAttrs(expr FilterExpr) ([]ConnAttr, error) {
+	var filters []ConnAttr
+	seen := make(map[ConnAttrType]bool)
+	add := func(group []ConnAttr) error {
+		if seen[group[0].Type] {
+			return ErrFilterExprNotAttrs
+		}
+		seen[group[0].Type] = true
+		filters = append(filters, group...)
+		return nil
+	}
+
+	terms := []FilterExpr{expr}
+	if and, ok := expr.(andExpr); ok {
+		terms = and
+	}
+	for _, term := range terms {
+		group, err := attrGroup(term)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(group); err != nil {
+			return nil, err
+		}
+	}
+	return filters, nil
+}
+
+// attrGroup returns the ConnAttr of the same type, that are linked by an OR
+// operation in expr.
+func attrGroup(expr FilterExpr) ([]ConnAttr, error) {
+	negate := false
+	if not, ok := expr.(notExpr); ok {
+		negate, expr = true, not.expr
+	}
+	var group []ConnAttr
+	switch e := expr.(type) {
+	case ConnAttr:
+		group = []ConnAttr{e}
+	case orExpr:
+		for _, sub := range e {
+			attr, ok := sub.(ConnAttr)
+			if !ok || attr.Negate {
+				return nil, ErrFilterExprNotAttrs
+			}
+			group = append(group, attr)
+		}
+	}
+	if len(group) == 0 {
+		return nil, ErrFilterExprNotAttrs
+	}
+	for i := range group {
+		if group[i].Type != group[0].Type || (negate && group[i].Negate) {
+			return nil, ErrFilterExprNotAttrs
+		}
+		group[i].Negate = group[i].Negate || negate
+	}
+	return group, nil
+}
@@ -0,0 +1,623 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mdlayher/netlink"
+)
+
+// ErrFilterSyntax is wrapped by the errors of ParseFilter.
+var ErrFilterSyntax = errors.New("invalid filter")
+
+// FilterSyntaxError describes the position of an error in a textual filter.
+type FilterSyntaxError struct {
+	// Offset of the offending token in bytes.
+	Offset int
+	// Token, that caused the error. It is empty at the end of the filter.
+	Token string
+	Msg   string
+}
+
+func (e *FilterSyntaxError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%v at offset %d: %s", ErrFilterSyntax, e.Offset, e.Msg)
+	}
+	return fmt.Sprintf("%v at offset %d near %q: %s", ErrFilterSyntax, e.Offset, e.Token, e.Msg)
+}
+
+func (e *FilterSyntaxError) Unwrap() error {
+	return ErrFilterSyntax
+}
+
+type fieldKind int
+
+const (
+	fieldUint fieldKind = iota
+	fieldIP
+	fieldString
+)
+
+// filterField describes a field of the textual filter language.
+type filterField struct {
+	kind fieldKind
+	// typ is the type of the attribute, typ6 the type for IPv6 addresses.
+	typ, typ6 ConnAttrType
+	// size of unsigned values in bytes
+	size int
+	// names of values
+	names map[string]uint64
+	// flags marks bit fields. Without an operator, the clause matches if one
+	// of the bits is set.
+	flags bool
+}
+
+var (
+	l4ProtoValues = func() map[string]uint64 {
+		names := make(map[string]uint64, len(l4ProtoNames))
+		for proto, name := range l4ProtoNames {
+			names[name] = uint64(proto)
+		}
+		return names
+	}()
+	familyValues   = map[string]uint64{"ipv4": uint64(IPv4), "ipv6": uint64(IPv6)}
+	tcpStateValues = map[string]uint64{
+		"none": 0, "syn_sent": 1, "syn_recv": 2, "established": 3, "fin_wait": 4,
+		"close_wait": 5, "last_ack": 6, "time_wait": 7, "close": 8, "syn_sent2": 9,
+	}
+	eventValues   = map[string]EventKind{"new": EventNew, "update": EventUpdate, "destroy": EventDestroy}
+	msgFlagValues = map[string]uint64{
+		"multi": uint64(netlink.Multi), "replace": uint64(netlink.Replace), "excl": uint64(netlink.Excl),
+		"create": uint64(netlink.Create), "append": uint64(netlink.Append),
+	}
+	statusValues = func() map[string]uint64 {
+		names := make(map[string]uint64, len(statusNames))
+		for i, name := range statusNames {
+			names[strings.ToLower(name)] = 1 << uint(i)
+		}
+		return names
+	}()
+)
+
+// filterFields are the fields of the textual filter language.
+var filterFields = map[string]filterField{
+	"orig.src":      {kind: fieldIP, typ: AttrOrigIPv4Src, typ6: AttrOrigIPv6Src},
+	"orig.dst":      {kind: fieldIP, typ: AttrOrigIPv4Dst, typ6: AttrOrigIPv6Dst},
+	"reply.src":     {kind: fieldIP, typ: AttrReplIPv4Src, typ6: AttrReplIPv6Src},
+	"reply.dst":     {kind: fieldIP, typ: AttrReplIPv4Dst, typ6: AttrReplIPv6Dst},
+	"master.src":    {kind: fieldIP, typ: AttrMasterIPv4Src, typ6: AttrMasterIPv6Src},
+	"master.dst":    {kind: fieldIP, typ: AttrMasterIPv4Dst, typ6: AttrMasterIPv6Dst},
+	"snat":          {kind: fieldIP, typ: AttrSNatIPv4, typ6: AttrSNatIPv6},
+	"dnat":          {kind: fieldIP, typ: AttrDNatIPv4, typ6: AttrDNatIPv6},
+	"orig.sport":    {typ: AttrOrigPortSrc, size: 2},
+	"orig.dport":    {typ: AttrOrigPortDst, size: 2},
+	"reply.sport":   {typ: AttrReplPortSrc, size: 2},
+	"reply.dport":   {typ: AttrReplPortDst, size: 2},
+	"master.sport":  {typ: AttrMasterPortSrc, size: 2},
+	"master.dport":  {typ: AttrMasterPortDst, size: 2},
+	"snat.port":     {typ: AttrSNatPort, size: 2},
+	"dnat.port":     {typ: AttrDNatPort, size: 2},
+	"proto":         {typ: AttrOrigL4Proto, size: 1, names: l4ProtoValues},
+	"orig.proto":    {typ: AttrOrigL4Proto, size: 1, names: l4ProtoValues},
+	"reply.proto":   {typ: AttrReplL4Proto, size: 1, names: l4ProtoValues},
+	"master.proto":  {typ: AttrMasterL4Proto, size: 1, names: l4ProtoValues},
+	"family":        {typ: AttrOrigL3Proto, size: 1, names: familyValues},
+	"master.family": {typ: AttrMasterL3Proto, size: 1, names: familyValues},
+	"icmp.type":     {typ: AttrIcmpType, size: 1},
+	"icmp.code":     {typ: AttrIcmpCode, size: 1},
+	"icmp.id":       {typ: AttrIcmpID, size: 2},
+	"icmpv6.type":   {typ: AttrIcmpv6Type, size: 1},
+	"icmpv6.code":   {typ: AttrIcmpv6Code, size: 1},
+	"icmpv6.id":     {typ: AttrIcmpv6ID, size: 2},
+	"tcp.state":     {typ: AttrTCPState, size: 1, names: tcpStateValues},
+	"sctp.state":    {typ: AttrSctpState, size: 1},
+	"dccp.state":    {typ: AttrDccpState, size: 1},
+	"status":        {typ: AttrStatus, size: 4, names: statusValues, flags: true},
+	"mark":          {typ: AttrMark, size: 4},
+	"secmark":       {typ: AttrSecmark, size: 4},
+	"timeout":       {typ: AttrTimeout, size: 4},
+	"use":           {typ: AttrUse, size: 4},
+	"id":            {typ: AttrID, size: 4},
+	"zone":          {typ: AttrZone, size: 2},
+	"orig.zone":     {typ: AttrOrigzone, size: 2},
+	"reply.zone":    {typ: AttrReplzone, size: 2},
+	"orig.packets":  {typ: AttrOrigCounterPackets, size: 8},
+	"orig.bytes":    {typ: AttrOrigCounterBytes, size: 8},
+	"reply.packets": {typ: AttrReplCounterPackets, size: 8},
+	"reply.bytes":   {typ: AttrReplCounterBytes, size: 8},
+	"helper":        {kind: fieldString, typ: AttrHelperName},
+	"secctx":        {kind: fieldString, typ: AttrSecCtx},
+	"exp.id":        {typ: AttrExpID, size: 4},
+	"exp.flags":     {typ: AttrExpFlags, size: 4, flags: true},
+	"exp.class":     {typ: AttrExpClass, size: 4},
+	"exp.natdir":    {typ: AttrExpNATDir, size: 4},
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	off  int
+}
+
+// isWordChar returns true for the characters of field names and values like
+// addresses and numbers.
+func isWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._:/", r)
+}
+
+// tokenize splits s into tokens.
+func tokenize(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		r := rune(s[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, &FilterSyntaxError{Offset: i, Token: s[i:], Msg: "unterminated string"}
+			}
+			toks = append(toks, token{kind: tokString, text: s[i+1 : i+1+end], off: i})
+			i += end + 2
+		case isWordChar(r):
+			start := i
+			for i < len(s) && isWordChar(rune(s[i])) {
+				i++
+			}
+			toks = append(toks, token{kind: tokWord, text: s[start:i], off: start})
+		default:
+			op := punctAt(s[i:])
+			if op == "" {
+				return nil, &FilterSyntaxError{Offset: i, Token: string(r), Msg: "unexpected character"}
+			}
+			toks = append(toks, token{kind: tokPunct, text: op, off: i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, off: len(s)}), nil
+}
+
+// punctAt returns the operator or punctuation at the start of s.
+func punctAt(s string) string {
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "&", "|", "(", ")", "{", "}", ",", "-"} {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+type filterParser struct {
+	toks []token
+	pos  int
+}
+
+func (p *filterParser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *filterParser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword returns true and consumes the next token, if it is the keyword kw.
+func (p *filterParser) keyword(kw string) bool {
+	if tok := p.peek(); tok.kind == tokWord && strings.EqualFold(tok.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// punct returns true and consumes the next token, if it is op.
+func (p *filterParser) punct(op string) bool {
+	if tok := p.peek(); tok.kind == tokPunct && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func errorAt(tok token, format string, args ...interface{}) error {
+	return &FilterSyntaxError{Offset: tok.off, Token: tok.text, Msg: fmt.Sprintf(format, args...)}
+}
+
+// ParseFilter returns the FilterExpr of a textual filter like
+//
+//	proto tcp and orig.dst in 10.0.0.0/8 and status assured and not mark & 0xff == 0x1
+//
+// Clauses are combined by and, or, not and parentheses. A clause compares a
+// field with ==, !=, <, <=, > or >=, or tests if the value of a field is in a
+// CIDR, a range like 1024-65535 or a set like {22, 80, 1024-2048}. Without an
+// operator a field is compared for equality, except status and exp.flags,
+// which match if one of the given bits like assured|seen_reply is set. A mask
+// is applied with &, for example mark & 0xff == 0x1. Strings with special
+// characters are quoted.
+//
+// The messages of events are selected by event new|update|destroy and by the
+// flags of the netlink header like msg.flags create. sample 100 matches one of
+// 100 messages randomly and sample tuple 100 by the hash of the tuple, see
+// Sample.
+//
+// The returned FilterExpr can be used in EventOptions, by NewMatcher to filter
+// the results of Dump or Query and, if possible, is converted by FilterAttrs
+// for RegisterFiltered. Errors are of the type *FilterSyntaxError.
+func ParseFilter(s string) (FilterExpr, error) {
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	if p.peek().kind == tokEOF {
+		return nil, errorAt(p.peek(), "empty filter")
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, errorAt(tok, "expected and, or or the end of the filter")
+	}
+	return expr, nil
+}
+
+func (p *filterParser) parseOr() (FilterExpr, error) {
+	expr, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := orExpr{expr}
+	for p.keyword("or") {
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, expr)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *filterParser) parseAnd() (FilterExpr, error) {
+	expr, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	and := andExpr{expr}
+	for p.keyword("and") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, expr)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *filterParser) parseUnary() (FilterExpr, error) {
+	if p.keyword("not") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr: expr}, nil
+	}
+	if open := p.peek(); p.punct("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.punct(")") {
+			return nil, errorAt(p.peek(), "missing ) for ( at offset %d", open.off)
+		}
+		return expr, nil
+	}
+	return p.parseClause()
+}
+
+func (p *filterParser) parseClause() (FilterExpr, error) {
+	tok := p.next()
+	if tok.kind != tokWord {
+		return nil, errorAt(tok, "expected a field")
+	}
+	name := strings.ToLower(tok.text)
+	switch name {
+	case "event":
+		return p.parseEvent(name)
+	case "msg.flags":
+		return p.parseMsgFlags(name)
+	case "sample":
+		return p.parseSample(name)
+	}
+	field, ok := filterFields[name]
+	if !ok {
+		return nil, errorAt(tok, "unknown field %q", tok.text)
+	}
+
+	var mask []byte
+	if amp := p.peek(); p.punct("&") {
+		if field.kind != fieldUint {
+			return nil, errorAt(amp, "masks are only supported for numeric fields")
+		}
+		value, err := p.parseUint(field, name)
+		if err != nil {
+			return nil, err
+		}
+		mask = field.encode(value)
+	}
+
+	op := p.peek()
+	switch {
+	case op.kind == tokPunct && (op.text == "==" || op.text == "!="):
+		p.pos++
+		expr, err := p.parseEqual(field, name, mask)
+		if err != nil {
+			return nil, err
+		}
+		if op.text == "!=" {
+			return notExpr{expr: expr}, nil
+		}
+		return expr, nil
+	case op.kind == tokPunct && (op.text == "<" || op.text == "<=" || op.text == ">" || op.text == ">="):
+		p.pos++
+		if field.kind != fieldUint || mask != nil {
+			return nil, errorAt(op, "%s is only supported for numeric fields without a mask", op.text)
+		}
+		value, err := p.parseUint(field, name)
+		if err != nil {
+			return nil, err
+		}
+		cmp := map[string]CompareOp{"<": CompareLt, "<=": CompareLe, ">": CompareGt, ">=": CompareGe}[op.text]
+		return Compare{Type: field.typ, Op: cmp, Value: value}, nil
+	case op.kind == tokWord && strings.EqualFold(op.text, "in"):
+		p.pos++
+		if mask != nil {
+			return nil, errorAt(op, "in is not supported with a mask")
+		}
+		if p.punct("{") {
+			return p.parseSet(field, name)
+		}
+		return p.parseElement(field, name)
+	case op.kind == tokWord || op.kind == tokString:
+		if isKeyword(op) {
+			return nil, errorAt(op, "missing value for %s", name)
+		}
+		if field.flags && mask == nil {
+			return p.parseFlags(field, name)
+		}
+		return p.parseEqual(field, name, mask)
+	}
+	return nil, errorAt(op, "missing value for %s", name)
+}
+
+func isKeyword(tok token) bool {
+	if tok.kind != tokWord {
+		return false
+	}
+	switch strings.ToLower(tok.text) {
+	case "and", "or", "not", "in":
+		return true
+	}
+	return false
+}
+
+// parseFlags parses bits like assured|seen_reply, of which one has to be set.
+func (p *filterParser) parseFlags(field filterField, name string) (FilterExpr, error) {
+	bits, err := p.parseBits(field, name)
+	if err != nil {
+		return nil, err
+	}
+	return Compare{Type: field.typ, Op: CompareAnySet, Value: bits}, nil
+}
+
+// parseBits returns the bits of values like assured|seen_reply.
+func (p *filterParser) parseBits(field filterField, name string) (uint64, error) {
+	var bits uint64
+	for {
+		value, err := p.parseUint(field, name)
+		if err != nil {
+			return 0, err
+		}
+		bits |= value
+		if !p.punct("|") {
+			return bits, nil
+		}
+	}
+}
+
+// parseEvent parses the kinds of events like new|update or in {new, destroy}.
+func (p *filterParser) parseEvent(name string) (FilterExpr, error) {
+	sep, end := "|", ""
+	if p.keyword("in") {
+		if !p.punct("{") {
+			return nil, errorAt(p.peek(), "expected {")
+		}
+		sep, end = ",", "}"
+	} else {
+		p.punct("==")
+	}
+	var kinds []EventKind
+	for {
+		tok := p.next()
+		if tok.kind != tokWord || isKeyword(tok) {
+			return nil, errorAt(tok, "missing value for %s", name)
+		}
+		kind, ok := eventValues[strings.ToLower(tok.text)]
+		if !ok {
+			return nil, errorAt(tok, "unknown event %q", tok.text)
+		}
+		kinds = append(kinds, kind)
+		if p.punct(sep) {
+			continue
+		}
+		if end != "" && !p.punct(end) {
+			return nil, errorAt(p.peek(), "expected %s or %s", sep, end)
+		}
+		return EventKinds(kinds...), nil
+	}
+}
+
+// parseMsgFlags parses flags of the netlink header like create|excl, of
+// which one has to be set.
+func (p *filterParser) parseMsgFlags(name string) (FilterExpr, error) {
+	flags, err := p.parseBits(filterField{size: 2, names: msgFlagValues}, name)
+	if err != nil {
+		return nil, err
+	}
+	return MessageFlags{Flags: netlink.HeaderFlags(flags)}, nil
+}
+
+// parseSample parses the rate of a sample like 100 or tuple 100.
+func (p *filterParser) parseSample(name string) (FilterExpr, error) {
+	tuple := p.keyword("tuple")
+	n, err := p.parseUint(filterField{size: 4}, name)
+	if err != nil {
+		return nil, err
+	}
+	return Sample{N: uint32(n), Tuple: tuple}, nil
+}
+
+// parseEqual parses the value of a comparison for equality.
+func (p *filterParser) parseEqual(field filterField, name string, mask []byte) (FilterExpr, error) {
+	switch field.kind {
+	case fieldIP:
+		return p.parseIP(field, name)
+	case fieldString:
+		tok := p.next()
+		if tok.kind != tokWord && tok.kind != tokString {
+			return nil, errorAt(tok, "missing value for %s", name)
+		}
+		return ConnAttr{Type: field.typ, Data: []byte(tok.text)}, nil
+	}
+	value, err := p.parseUint(field, name)
+	if err != nil {
+		return nil, err
+	}
+	return field.attr(value, mask), nil
+}
+
+// parseSet parses the elements of a set up to the closing brace.
+func (p *filterParser) parseSet(field filterField, name string) (FilterExpr, error) {
+	var or orExpr
+	for {
+		expr, err := p.parseElement(field, name)
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, expr)
+		if p.punct("}") {
+			return or, nil
+		}
+		if !p.punct(",") {
+			return nil, errorAt(p.peek(), "expected , or }")
+		}
+	}
+}
+
+// parseElement parses a value, a CIDR or a range.
+func (p *filterParser) parseElement(field filterField, name string) (FilterExpr, error) {
+	if field.kind != fieldUint {
+		return p.parseEqual(field, name, nil)
+	}
+	lo, err := p.parseUint(field, name)
+	if err != nil {
+		return nil, err
+	}
+	if dash := p.peek(); p.punct("-") {
+		hi, err := p.parseUint(field, name)
+		if err != nil {
+			return nil, err
+		}
+		if hi < lo {
+			return nil, errorAt(dash, "empty range %d-%d", lo, hi)
+		}
+		return Range(field.typ, lo, hi), nil
+	}
+	return field.attr(lo, nil), nil
+}
+
+func (p *filterParser) parseUint(field filterField, name string) (uint64, error) {
+	tok := p.next()
+	if tok.kind != tokWord || isKeyword(tok) {
+		return 0, errorAt(tok, "missing value for %s", name)
+	}
+	if value, ok := field.names[strings.ToLower(tok.text)]; ok {
+		return value, nil
+	}
+	value, err := strconv.ParseUint(tok.text, 0, 8*field.size)
+	if err != nil {
+		return 0, errorAt(tok, "invalid value for %s", name)
+	}
+	return value, nil
+}
+
+func (p *filterParser) parseIP(field filterField, name string) (FilterExpr, error) {
+	tok := p.next()
+	if tok.kind != tokWord || isKeyword(tok) {
+		return nil, errorAt(tok, "missing address for %s", name)
+	}
+	var ip net.IP
+	var mask net.IPMask
+	if strings.Contains(tok.text, "/") {
+		var ipnet *net.IPNet
+		var err error
+		if _, ipnet, err = net.ParseCIDR(tok.text); err != nil {
+			return nil, errorAt(tok, "invalid CIDR for %s", name)
+		}
+		ip, mask = ipnet.IP, ipnet.Mask
+	} else if ip = net.ParseIP(tok.text); ip == nil {
+		return nil, errorAt(tok, "invalid address for %s", name)
+	}
+
+	attr := ConnAttr{Type: field.typ, Data: ip.To4()}
+	if attr.Data == nil {
+		attr.Type, attr.Data = field.typ6, ip.To16()
+	}
+	if mask == nil && filterCheck[attr.Type].mask {
+		mask = net.CIDRMask(8*len(attr.Data), 8*len(attr.Data))
+	}
+	if mask != nil {
+		attr.Mask = []byte(mask)
+	}
+	return attr, nil
+}
+
+// encode returns value as data of an attribute in network byte order.
+func (f filterField) encode(value uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, value)
+	return b[8-f.size:]
+}
+
+// attr returns the ConnAttr, that compares the field with value. Attributes,
+// that require a mask for RegisterFiltered, get a full mask, if mask is nil.
+func (f filterField) attr(value uint64, mask []byte) ConnAttr {
+	if mask == nil && filterCheck[f.typ].mask {
+		mask = f.encode(1<<(8*uint(f.size)) - 1)
+	}
+	return ConnAttr{Type: f.typ, Data: f.encode(value), Mask: mask}
+}
@@ -0,0 +1,210 @@
+package conntrack
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	assured, other := testCon("10.0.0.1", 22, 0x202), testCon("10.0.0.1", 22, 0x202)
+	status := uint32(0x4 | 0x8)
+	assured.Status = &status
+	tests := map[string]struct {
+		filter string
+		con    Con
+		want   bool
+	}{
+		"example":   {filter: "proto tcp and orig.dst in 192.0.2.0/24 and status assured and not mark & 0xff == 0x1", con: assured, want: true},
+		"status":    {filter: "status assured", con: other},
+		"flags":     {filter: "status seen_reply|assured", con: assured, want: true},
+		"mask":      {filter: "mark & 0xff == 0x2", con: assured, want: true},
+		"not equal": {filter: "orig.dport != 22", con: assured},
+		"compare":   {filter: "orig.dport < 1024 and orig.sport >= 1024", con: assured, want: true},
+		"range":     {filter: "orig.sport in 1024-65535", con: assured, want: true},
+		"set":       {filter: "orig.dport in {80, 443, 20-23}", con: assured, want: true},
+		"set miss":  {filter: "orig.dport in {80, 443}", con: assured},
+		"address":   {filter: "orig.src == 10.0.0.1", con: assured, want: true},
+		"ipv6":      {filter: "orig.src in 2001:db8::/32", con: assured},
+		"or":        {filter: "orig.dport 80 or (orig.dport 22 and proto tcp)", con: assured, want: true},
+		"not":       {filter: "not (orig.dport 80 or orig.dport 22)", con: assured},
+		"family":    {filter: "family ipv4", con: assured, want: true},
+		"helper":    {filter: `helper "ftp"`, con: assured},
+		"case":      {filter: "PROTO TCP AND Status ASSURED", con: assured, want: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr, err := ParseFilter(tc.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			m, err := NewMatcher(Conntrack, nil, expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := m.Match(tc.con); got != tc.want {
+				t.Fatalf("unexpected result %t", got)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := map[string]struct {
+		filter string
+		offset int
+		token  string
+	}{
+		"empty":            {filter: "  ", offset: 2},
+		"unknown field":    {filter: "proto tcp and orig.dest 10.0.0.1", offset: 14, token: "orig.dest"},
+		"missing value":    {filter: "proto and mark 1", offset: 6, token: "and"},
+		"missing at end":   {filter: "mark ==", offset: 7},
+		"invalid value":    {filter: "orig.dport 70000", offset: 11, token: "70000"},
+		"unknown name":     {filter: "proto tcpp", offset: 6, token: "tcpp"},
+		"invalid address":  {filter: "orig.src 10.0.0.256", offset: 9, token: "10.0.0.256"},
+		"invalid cidr":     {filter: "orig.src in 10.0.0.0/33", offset: 12, token: "10.0.0.0/33"},
+		"unterminated":     {filter: `helper "ftp`, offset: 7, token: `"ftp`},
+		"missing paren":    {filter: "(proto tcp or proto udp", offset: 23},
+		"unexpected char":  {filter: "mark = 1", offset: 5, token: "="},
+		"trailing":         {filter: "proto tcp udp", offset: 10, token: "udp"},
+		"empty range":      {filter: "orig.dport in 80-22", offset: 16, token: "-"},
+		"unclosed set":     {filter: "orig.dport in {80 443}", offset: 18, token: "443"},
+		"mask on address":  {filter: "orig.src & 0xff 10.0.0.1", offset: 9, token: "&"},
+		"compare on ip":    {filter: "orig.src > 10.0.0.1", offset: 9, token: ">"},
+		"missing operand":  {filter: "proto tcp and", offset: 13},
+		"operator as term": {filter: "== 1", offset: 0, token: "=="},
+		"unknown event":    {filter: "event created", offset: 6, token: "created"},
+		"event set":        {filter: "event in {new update}", offset: 14, token: "update"},
+		"msg flags":        {filter: "msg.flags dump", offset: 10, token: "dump"},
+		"sample rate":      {filter: "sample tuple and proto tcp", offset: 13, token: "and"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseFilter(tc.filter)
+			if !errors.Is(err, ErrFilterSyntax) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var serr *FilterSyntaxError
+			if !errors.As(err, &serr) {
+				t.Fatalf("unexpected error type %T", err)
+			}
+			if serr.Offset != tc.offset || serr.Token != tc.token {
+				t.Fatalf("unexpected position %d %q: %v", serr.Offset, serr.Token, err)
+			}
+		})
+	}
+}
+
+func TestFilterAttrs(t *testing.T) {
+	tests := map[string]struct {
+		filter string
+		want   []ConnAttr
+		err    error
+	}{
+		"single": {
+			filter: "orig.dport 22",
+			want:   []ConnAttr{{Type: AttrOrigPortDst, Data: u16(22)}},
+		},
+		"set": {
+			filter: "proto tcp and orig.dport in {22, 80}",
+			want: []ConnAttr{
+				{Type: AttrOrigL4Proto, Data: []byte{6}},
+				{Type: AttrOrigPortDst, Data: u16(22)},
+				{Type: AttrOrigPortDst, Data: u16(80)},
+			},
+		},
+		"negated": {
+			filter: "not mark & 0xff == 1",
+			want:   []ConnAttr{{Type: AttrMark, Data: u32(1), Mask: u32(0xff), Negate: true}},
+		},
+		"negated set": {
+			filter: "not orig.dport in {22, 80}",
+			want: []ConnAttr{
+				{Type: AttrOrigPortDst, Data: u16(22), Negate: true},
+				{Type: AttrOrigPortDst, Data: u16(80), Negate: true},
+			},
+		},
+		"or of types": {filter: "orig.dport 22 or orig.sport 22", err: ErrFilterExprNotAttrs},
+		"type twice":  {filter: "orig.dport 22 and orig.dport 80", err: ErrFilterExprNotAttrs},
+		"compare":     {filter: "orig.dport < 1024", err: ErrFilterExprNotAttrs},
+		"nested":      {filter: "proto tcp and (orig.dport 22 or proto udp)", err: ErrFilterExprNotAttrs},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr, err := ParseFilter(tc.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := FilterAttrs(expr)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("unexpected attributes\nwant: %v\ngot:  %v", tc.want, got)
+			}
+			if _, err := buildFilter(Conntrack, got, nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestMatcherFilter(t *testing.T) {
+	cons := []Con{testCon("10.0.0.1", 22, 0), testCon("10.0.0.2", 80, 0), testCon("10.0.0.3", 22, 1)}
+	expr, err := ParseFilter("orig.dport 22 and not mark 1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m, err := NewMatcher(Conntrack, nil, expr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := m.Filter(cons)
+	if len(got) != 1 || !got[0].Origin.Src.Equal(*cons[0].Origin.Src) {
+		t.Fatalf("unexpected connections: %v", got)
+	}
+}
+
+func TestParseFilterEvents(t *testing.T) {
+	status := uint32(0x4)
+	c := testCon("10.0.0.1", 22, 0)
+	c.Status = &status
+	tests := map[string]struct {
+		filter string
+		want   []EventKind
+	}{
+		"kind":      {filter: "event update", want: []EventKind{EventUpdate}},
+		"kinds":     {filter: "event new|destroy", want: []EventKind{EventNew, EventDestroy}},
+		"set":       {filter: "event in {update, destroy}", want: []EventKind{EventUpdate, EventDestroy}},
+		"not":       {filter: "not event == destroy", want: []EventKind{EventNew, EventUpdate}},
+		"assured":   {filter: "event update and status assured", want: []EventKind{EventUpdate}},
+		"tcp":       {filter: "event destroy and proto udp"},
+		"msg flags": {filter: "msg.flags create|excl", want: []EventKind{EventNew}},
+		"sample":    {filter: "sample 1 and event new", want: []EventKind{EventNew}},
+		"tuple":     {filter: "not sample tuple 0", want: nil},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr, err := ParseFilter(tc.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			m, err := NewMatcher(Conntrack, nil, expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, kind := range []EventKind{EventNew, EventUpdate, EventDestroy} {
+				want := false
+				for _, k := range tc.want {
+					want = want || k == kind
+				}
+				if got := m.MatchEvent(Event{Kind: kind, Table: Conntrack, Con: c}); got != want {
+					t.Errorf("unexpected result %t for %s", got, kind)
+				}
+			}
+		})
+	}
+}
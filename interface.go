@@ -0,0 +1,40 @@
+package conntrack
+
+import "context"
+
+// Interface contains the operations of Nfct. It can be used to replace Nfct,
+// e.g. by conntracktest.Fake in tests of code using this package.
+type Interface interface {
+	Close() error
+
+	Flush(t Table, f Family) error
+	FlushContext(ctx context.Context, t Table, f Family) error
+
+	Dump(t Table, f Family) ([]Con, error)
+	DumpContext(ctx context.Context, t Table, f Family) ([]Con, error)
+
+	Create(t Table, f Family, attributes Con) error
+	CreateContext(ctx context.Context, t Table, f Family, attributes Con) error
+
+	Query(t Table, f Family, filter FilterAttr) ([]Con, error)
+	QueryContext(ctx context.Context, t Table, f Family, filter FilterAttr) ([]Con, error)
+
+	Get(t Table, f Family, match Con) ([]Con, error)
+	GetContext(ctx context.Context, t Table, f Family, match Con) ([]Con, error)
+
+	Update(t Table, f Family, attributes Con) error
+	UpdateContext(ctx context.Context, t Table, f Family, attributes Con) error
+
+	Delete(t Table, f Family, filters Con) error
+	DeleteContext(ctx context.Context, t Table, f Family, filters Con) error
+
+	DumpCPUStats(t Table) ([]CPUStat, error)
+	DumpCPUStatsContext(ctx context.Context, t Table) ([]CPUStat, error)
+
+	Register(ctx context.Context, t Table, group NetlinkGroup, fn HookFunc) error
+	RegisterFiltered(ctx context.Context, t Table, group NetlinkGroup, filter []ConnAttr, fn HookFunc) error
+	RegisterEvents(ctx context.Context, t Table, group NetlinkGroup, filter []ConnAttr, fn EventFunc) error
+	Events(ctx context.Context, opts EventOptions) (<-chan Event, <-chan error)
+}
+
+var _ Interface = (*Nfct)(nil)
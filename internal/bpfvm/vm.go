@@ -0,0 +1,349 @@
+// Package bpfvm interprets classic BPF programs in the same way as the Linux
+// kernel does for socket filters, including the extensions to find netlink
+// attributes, which are not supported by golang.org/x/net/bpf.
+package bpfvm
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/net/bpf"
+)
+
+// maxInstructions is the limit of instructions of the kernel (BPF_MAXINSTS).
+const maxInstructions = 4096
+
+// Errors, that are returned for programs, the kernel would not accept.
+var (
+	ErrEmpty            = errors.New("program is empty")
+	ErrTooLong          = errors.New("program has too many instructions")
+	ErrNoReturn         = errors.New("program does not end with a return instruction")
+	ErrJumpOutOfRange   = errors.New("jump out of range")
+	ErrInvalidOpcode    = errors.New("invalid opcode")
+	ErrDivisionByZero   = errors.New("division by constant zero")
+	ErrInvalidShift     = errors.New("shift by constant of 32 or more")
+	ErrInvalidScratch   = errors.New("invalid index of scratch memory")
+	ErrInvalidExtension = errors.New("unsupported extension")
+)
+
+// VM executes a classic BPF program.
+type VM struct {
+	prog []bpf.RawInstruction
+
+	// Random returns the values for SKF_AD_RANDOM.
+	Random func() uint32
+}
+
+// New checks prog in the same way as the kernel and returns a VM for it.
+func New(prog []bpf.RawInstruction) (*VM, error) {
+	return NewWithLimit(prog, maxInstructions)
+}
+
+// NewWithLimit is like New, but accepts programs with up to limit
+// instructions. If limit is 0, the length of prog is not limited.
+func NewWithLimit(prog []bpf.RawInstruction, limit int) (*VM, error) {
+	if len(prog) == 0 {
+		return nil, ErrEmpty
+	}
+	if limit > 0 && len(prog) > limit {
+		return nil, ErrTooLong
+	}
+	for pc, ins := range prog {
+		if err := check(prog, pc, ins); err != nil {
+			return nil, fmt.Errorf("instruction %d: %w", pc, err)
+		}
+	}
+	if class(prog[len(prog)-1].Op) != unix.BPF_RET {
+		return nil, ErrNoReturn
+	}
+	return &VM{prog: prog, Random: rand.Uint32}, nil
+}
+
+func class(op uint16) uint16     { return op & 0x07 }
+func size(op uint16) uint16      { return op & 0x18 }
+func mode(op uint16) uint16      { return op & 0xe0 }
+func operation(op uint16) uint16 { return op & 0xf0 }
+func source(op uint16) uint16    { return op & 0x08 }
+
+// check validates a single instruction.
+func check(prog []bpf.RawInstruction, pc int, ins bpf.RawInstruction) error {
+	op := ins.Op
+	switch class(op) {
+	case unix.BPF_LD, unix.BPF_LDX:
+		if class(op) == unix.BPF_LDX && size(op) != unix.BPF_W && mode(op) != unix.BPF_MSH {
+			return ErrInvalidOpcode
+		}
+		switch mode(op) {
+		case unix.BPF_IMM, unix.BPF_LEN:
+		case unix.BPF_MEM:
+			if ins.K >= unix.BPF_MEMWORDS {
+				return ErrInvalidScratch
+			}
+		case unix.BPF_ABS:
+			if class(op) != unix.BPF_LD {
+				return ErrInvalidOpcode
+			}
+			if int32(ins.K) < unix.SKF_AD_OFF {
+				return ErrInvalidOpcode
+			}
+			if int32(ins.K) >= unix.SKF_AD_OFF && int32(ins.K) < 0 {
+				switch int32(ins.K) - unix.SKF_AD_OFF {
+				case unix.SKF_AD_NLATTR, unix.SKF_AD_NLATTR_NEST, unix.SKF_AD_ALU_XOR_X,
+					unix.SKF_AD_RANDOM, unix.SKF_AD_CPU:
+				default:
+					return ErrInvalidExtension
+				}
+			}
+		case unix.BPF_IND:
+			if class(op) != unix.BPF_LD {
+				return ErrInvalidOpcode
+			}
+		case unix.BPF_MSH:
+			if class(op) != unix.BPF_LDX || size(op) != unix.BPF_B {
+				return ErrInvalidOpcode
+			}
+		default:
+			return ErrInvalidOpcode
+		}
+	case unix.BPF_ST, unix.BPF_STX:
+		if ins.K >= unix.BPF_MEMWORDS {
+			return ErrInvalidScratch
+		}
+	case unix.BPF_ALU:
+		switch operation(op) {
+		case unix.BPF_DIV, unix.BPF_MOD:
+			if source(op) == unix.BPF_K && ins.K == 0 {
+				return ErrDivisionByZero
+			}
+		case unix.BPF_LSH, unix.BPF_RSH:
+			if source(op) == unix.BPF_K && ins.K >= 32 {
+				return ErrInvalidShift
+			}
+		case unix.BPF_ADD, unix.BPF_SUB, unix.BPF_MUL, unix.BPF_OR, unix.BPF_AND,
+			unix.BPF_NEG, unix.BPF_XOR:
+		default:
+			return ErrInvalidOpcode
+		}
+	case unix.BPF_JMP:
+		switch operation(op) {
+		case unix.BPF_JA:
+			if uint64(pc)+1+uint64(ins.K) >= uint64(len(prog)) {
+				return ErrJumpOutOfRange
+			}
+		case unix.BPF_JEQ, unix.BPF_JGT, unix.BPF_JGE, unix.BPF_JSET:
+			if pc+1+int(ins.Jt) >= len(prog) || pc+1+int(ins.Jf) >= len(prog) {
+				return ErrJumpOutOfRange
+			}
+		default:
+			return ErrInvalidOpcode
+		}
+	case unix.BPF_RET:
+		if rval := op & 0x18; rval != unix.BPF_K && rval != unix.BPF_A {
+			return ErrInvalidOpcode
+		}
+	case unix.BPF_MISC:
+		if op&0xf8 != unix.BPF_TAX && op&0xf8 != unix.BPF_TXA {
+			return ErrInvalidOpcode
+		}
+	}
+	return nil
+}
+
+// Run executes the program on pkt and returns the verdict. A verdict of 0
+// means, that the packet is dropped.
+func (vm *VM) Run(pkt []byte) uint32 {
+	var a, x uint32
+	var mem [unix.BPF_MEMWORDS]uint32
+
+	for pc := 0; pc < len(vm.prog); pc++ {
+		ins := vm.prog[pc]
+		op := ins.Op
+		k := ins.K
+
+		switch class(op) {
+		case unix.BPF_LD:
+			switch mode(op) {
+			case unix.BPF_IMM:
+				a = k
+			case unix.BPF_LEN:
+				a = uint32(len(pkt))
+			case unix.BPF_MEM:
+				a = mem[k]
+			case unix.BPF_ABS:
+				if int32(k) < 0 {
+					a = vm.extension(pkt, int32(k)-unix.SKF_AD_OFF, a, x)
+					continue
+				}
+				v, ok := load(pkt, uint64(k), size(op))
+				if !ok {
+					return 0
+				}
+				a = v
+			case unix.BPF_IND:
+				v, ok := load(pkt, uint64(x)+uint64(k), size(op))
+				if !ok {
+					return 0
+				}
+				a = v
+			}
+		case unix.BPF_LDX:
+			switch mode(op) {
+			case unix.BPF_IMM:
+				x = k
+			case unix.BPF_LEN:
+				x = uint32(len(pkt))
+			case unix.BPF_MEM:
+				x = mem[k]
+			case unix.BPF_MSH:
+				v, ok := load(pkt, uint64(k), unix.BPF_B)
+				if !ok {
+					return 0
+				}
+				x = 4 * (v & 0xf)
+			}
+		case unix.BPF_ST:
+			mem[k] = a
+		case unix.BPF_STX:
+			mem[k] = x
+		case unix.BPF_ALU:
+			operand := k
+			if source(op) == unix.BPF_X {
+				operand = x
+			}
+			switch operation(op) {
+			case unix.BPF_ADD:
+				a += operand
+			case unix.BPF_SUB:
+				a -= operand
+			case unix.BPF_MUL:
+				a *= operand
+			case unix.BPF_DIV:
+				if operand == 0 {
+					return 0
+				}
+				a /= operand
+			case unix.BPF_MOD:
+				if operand == 0 {
+					return 0
+				}
+				a %= operand
+			case unix.BPF_OR:
+				a |= operand
+			case unix.BPF_AND:
+				a &= operand
+			case unix.BPF_LSH:
+				a <<= operand
+			case unix.BPF_RSH:
+				a >>= operand
+			case unix.BPF_NEG:
+				a = -a
+			case unix.BPF_XOR:
+				a ^= operand
+			}
+		case unix.BPF_JMP:
+			operand := k
+			if source(op) == unix.BPF_X {
+				operand = x
+			}
+			var cond bool
+			switch operation(op) {
+			case unix.BPF_JA:
+				pc += int(k)
+				continue
+			case unix.BPF_JEQ:
+				cond = a == operand
+			case unix.BPF_JGT:
+				cond = a > operand
+			case unix.BPF_JGE:
+				cond = a >= operand
+			case unix.BPF_JSET:
+				cond = a&operand != 0
+			}
+			if cond {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_RET:
+			if op&0x18 == unix.BPF_A {
+				return a
+			}
+			return k
+		case unix.BPF_MISC:
+			if op&0xf8 == unix.BPF_TXA {
+				a = x
+			} else {
+				x = a
+			}
+		}
+	}
+	return 0
+}
+
+// load reads a value of size in network byte order from pkt.
+func load(pkt []byte, off uint64, size uint16) (uint32, bool) {
+	var n uint64
+	switch size {
+	case unix.BPF_W:
+		n = 4
+	case unix.BPF_H:
+		n = 2
+	case unix.BPF_B:
+		n = 1
+	}
+	if off+n > uint64(len(pkt)) {
+		return 0, false
+	}
+	var v uint32
+	for _, b := range pkt[off : off+n] {
+		v = v<<8 | uint32(b)
+	}
+	return v, true
+}
+
+// extension returns the result of an ancillary load.
+func (vm *VM) extension(pkt []byte, ext int32, a, x uint32) uint32 {
+	switch ext {
+	case unix.SKF_AD_NLATTR:
+		if len(pkt) < 4 || uint64(a) > uint64(len(pkt)-4) {
+			return 0
+		}
+		return nlaFind(pkt, a, len(pkt), x)
+	case unix.SKF_AD_NLATTR_NEST:
+		if len(pkt) < 4 || uint64(a) > uint64(len(pkt)-4) {
+			return 0
+		}
+		length := int(nlenc.Uint16(pkt[a : a+2]))
+		if length < 4 || length > len(pkt)-int(a) {
+			return 0
+		}
+		return nlaFind(pkt, a+4, int(a)+length, x)
+	case unix.SKF_AD_ALU_XOR_X:
+		return a ^ x
+	case unix.SKF_AD_RANDOM:
+		return vm.Random()
+	}
+	// SKF_AD_CPU
+	return 0
+}
+
+// nlaFind returns the offset of the first attribute with type attrType
+// between off and end of pkt or 0, if there is no such attribute.
+func nlaFind(pkt []byte, off uint32, end int, attrType uint32) uint32 {
+	pos := int(off)
+	for end-pos >= 4 {
+		length := int(nlenc.Uint16(pkt[pos : pos+2]))
+		if length < 4 || length > end-pos {
+			return 0
+		}
+		// NLA_TYPE_MASK removes NLA_F_NESTED and NLA_F_NET_BYTEORDER
+		if uint32(nlenc.Uint16(pkt[pos+2:pos+4])&0x3fff) == attrType {
+			return uint32(pos)
+		}
+		pos += (length + 3) &^ 3
+	}
+	return 0
+}
@@ -0,0 +1,214 @@
+package bpfvm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/net/bpf"
+)
+
+func assemble(t *testing.T, insns []bpf.Instruction) []bpf.RawInstruction {
+	t.Helper()
+	raw, err := bpf.Assemble(insns)
+	if err != nil {
+		t.Fatalf("could not assemble program: %v", err)
+	}
+	return raw
+}
+
+// extension returns the offset of an ancillary load.
+func extension(ext int32) uint32 {
+	off := int32(unix.SKF_AD_OFF)
+	return uint32(off + ext)
+}
+
+// attr returns a netlink attribute in native endianness.
+func attr(typ uint16, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data)+3)
+	nlenc.PutUint16(b[0:2], uint16(4+len(data)))
+	nlenc.PutUint16(b[2:4], typ)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestRun(t *testing.T) {
+	// two attributes, where the second one is nested
+	pkt := append(attr(1, []byte{0xaa}), attr(2|1<<15, append(attr(3, []byte{0x1, 0x2}), attr(4, []byte{0xbe, 0xef})...))...)
+
+	nlattr := extension(unix.SKF_AD_NLATTR)
+	nlattrNest := extension(unix.SKF_AD_NLATTR_NEST)
+
+	tests := map[string]struct {
+		prog []bpf.Instruction
+		want uint32
+	}{
+		"return": {
+			prog: []bpf.Instruction{bpf.RetConstant{Val: 7}},
+			want: 7,
+		},
+		"find attribute": {
+			prog: []bpf.Instruction{
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 0},
+				bpf.LoadConstant{Dst: bpf.RegX, Val: 2},
+				bpf.LoadAbsolute{Off: nlattr, Size: 4},
+				bpf.RetA{},
+			},
+			want: 8,
+		},
+		"missing attribute": {
+			prog: []bpf.Instruction{
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 0},
+				bpf.LoadConstant{Dst: bpf.RegX, Val: 5},
+				bpf.LoadAbsolute{Off: nlattr, Size: 4},
+				bpf.RetA{},
+			},
+			want: 0,
+		},
+		"find nested attribute and load its value": {
+			prog: []bpf.Instruction{
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 0},
+				bpf.LoadConstant{Dst: bpf.RegX, Val: 2},
+				bpf.LoadAbsolute{Off: nlattr, Size: 4},
+				bpf.LoadConstant{Dst: bpf.RegX, Val: 4},
+				bpf.LoadAbsolute{Off: nlattrNest, Size: 4},
+				bpf.TAX{},
+				bpf.LoadIndirect{Off: 4, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xbeef, SkipFalse: 1},
+				bpf.RetConstant{Val: 1},
+				bpf.RetConstant{Val: 0},
+			},
+			want: 1,
+		},
+		"load out of bounds": {
+			prog: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 1000, Size: 4},
+				bpf.RetConstant{Val: 1},
+			},
+			want: 0,
+		},
+		"alu and scratch memory": {
+			prog: []bpf.Instruction{
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 6},
+				bpf.ALUOpConstant{Op: bpf.ALUOpMul, Val: 7},
+				bpf.StoreScratch{Src: bpf.RegA, N: 3},
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 0},
+				bpf.LoadScratch{Dst: bpf.RegA, N: 3},
+				bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 42, SkipTrue: 1},
+				bpf.RetConstant{Val: 0},
+				bpf.RetA{},
+			},
+			want: 42,
+		},
+		"packet length": {
+			prog: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.RetA{},
+			},
+			want: uint32(len(pkt)),
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			vm, err := New(assemble(t, tc.prog))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := vm.Run(pkt); got != tc.want {
+				t.Fatalf("expected %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := map[string]struct {
+		prog []bpf.RawInstruction
+		err  error
+	}{
+		"empty": {
+			err: ErrEmpty,
+		},
+		"no return": {
+			prog: []bpf.RawInstruction{{Op: unix.BPF_LD | unix.BPF_IMM}},
+			err:  ErrNoReturn,
+		},
+		"jump out of range": {
+			prog: []bpf.RawInstruction{
+				{Op: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 5},
+				{Op: unix.BPF_RET | unix.BPF_K},
+			},
+			err: ErrJumpOutOfRange,
+		},
+		"division by zero": {
+			prog: []bpf.RawInstruction{
+				{Op: unix.BPF_ALU | unix.BPF_DIV | unix.BPF_K},
+				{Op: unix.BPF_RET | unix.BPF_K},
+			},
+			err: ErrDivisionByZero,
+		},
+		"shift out of range": {
+			prog: []bpf.RawInstruction{
+				{Op: unix.BPF_ALU | unix.BPF_LSH | unix.BPF_K, K: 32},
+				{Op: unix.BPF_RET | unix.BPF_K},
+			},
+			err: ErrInvalidShift,
+		},
+		"right shift out of range": {
+			prog: []bpf.RawInstruction{
+				{Op: unix.BPF_ALU | unix.BPF_RSH | unix.BPF_K, K: 33},
+				{Op: unix.BPF_RET | unix.BPF_K},
+			},
+			err: ErrInvalidShift,
+		},
+		"shift": {
+			prog: []bpf.RawInstruction{
+				{Op: unix.BPF_ALU | unix.BPF_RSH | unix.BPF_K, K: 31},
+				{Op: unix.BPF_RET | unix.BPF_K},
+			},
+		},
+		"unsupported extension": {
+			prog: []bpf.RawInstruction{
+				{Op: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: extension(4)},
+				{Op: unix.BPF_RET | unix.BPF_K},
+			},
+			err: ErrInvalidExtension,
+		},
+		"scratch memory": {
+			prog: []bpf.RawInstruction{
+				{Op: unix.BPF_ST, K: unix.BPF_MEMWORDS},
+				{Op: unix.BPF_RET | unix.BPF_K},
+			},
+			err: ErrInvalidScratch,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New(tc.prog); !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestNewWithLimit(t *testing.T) {
+	prog := make([]bpf.RawInstruction, maxInstructions+1)
+	for i := range prog {
+		prog[i] = bpf.RawInstruction{Op: unix.BPF_RET | unix.BPF_K}
+	}
+	if _, err := New(prog); !errors.Is(err, ErrTooLong) {
+		t.Fatalf("expected %v, got %v", ErrTooLong, err)
+	}
+	if _, err := NewWithLimit(prog, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewWithLimit(prog, 2); !errors.Is(err, ErrTooLong) {
+		t.Fatalf("expected %v, got %v", ErrTooLong, err)
+	}
+}
@@ -4,6 +4,8 @@
 package unix
 
 import (
+	"syscall"
+
 	linux "golang.org/x/sys/unix"
 )
 
@@ -18,11 +20,28 @@ const (
 	NFNL_SUBSYS_CTNETLINK_TIMEOUT = linux.NFNL_SUBSYS_CTNETLINK_TIMEOUT
 	NETLINK_NETFILTER             = linux.NETLINK_NETFILTER
 
+	// errno values
+	ENOBUFS    = linux.ENOBUFS
+	ENOENT     = linux.ENOENT
+	EEXIST     = linux.EEXIST
+	EPERM      = linux.EPERM
+	EACCES     = linux.EACCES
+	EINVAL     = linux.EINVAL
+	EOPNOTSUPP = linux.EOPNOTSUPP
+	// ENOTSUPP is used internally by the kernel, but might be returned to userspace.
+	ENOTSUPP = syscall.Errno(0x20c)
+
+	// socket options
+	SOL_SOCKET     = linux.SOL_SOCKET
+	SO_RCVBUFFORCE = linux.SO_RCVBUFFORCE
+
 	// Instruction classes
 	BPF_LD   = linux.BPF_LD
 	BPF_LDX  = linux.BPF_LDX
 	BPF_ALU  = linux.BPF_ALU
 	BPF_JMP  = linux.BPF_JMP
+	BPF_ST   = linux.BPF_ST
+	BPF_STX  = linux.BPF_STX
 	BPF_RET  = linux.BPF_RET
 	BPF_MISC = linux.BPF_MISC
 
@@ -33,15 +52,46 @@ const (
 	BPF_IMM = linux.BPF_IMM
 	BPF_ABS = linux.BPF_ABS
 	BPF_IND = linux.BPF_IND
+	BPF_MEM = linux.BPF_MEM
+	BPF_LEN = linux.BPF_LEN
+	BPF_MSH = linux.BPF_MSH
 
 	// alu/jmp fields
-	BPF_ADD = linux.BPF_ADD
-	BPF_AND = linux.BPF_AND
-	BPF_JA  = linux.BPF_JA
-	BPF_JEQ = linux.BPF_JEQ
-	BPF_K   = linux.BPF_K
+	BPF_ADD  = linux.BPF_ADD
+	BPF_SUB  = linux.BPF_SUB
+	BPF_MUL  = linux.BPF_MUL
+	BPF_DIV  = linux.BPF_DIV
+	BPF_OR   = linux.BPF_OR
+	BPF_AND  = linux.BPF_AND
+	BPF_LSH  = linux.BPF_LSH
+	BPF_RSH  = linux.BPF_RSH
+	BPF_NEG  = linux.BPF_NEG
+	BPF_MOD  = linux.BPF_MOD
+	BPF_XOR  = linux.BPF_XOR
+	BPF_JA   = linux.BPF_JA
+	BPF_JEQ  = linux.BPF_JEQ
+	BPF_JGT  = linux.BPF_JGT
+	BPF_JGE  = linux.BPF_JGE
+	BPF_JSET = linux.BPF_JSET
+	BPF_K    = linux.BPF_K
+	BPF_X    = linux.BPF_X
+	BPF_A    = linux.BPF_A
 
 	// include/uapi/linux/filter.h
 	BPF_TAX = linux.BPF_TAX
 	BPF_TXA = linux.BPF_TXA
+
+	BPF_MEMWORDS = 16
+
+	SKF_AD_OFF         = -0x1000
+	SKF_AD_CPU         = 36
+	SKF_AD_NLATTR      = 12
+	SKF_AD_NLATTR_NEST = 16
+	SKF_AD_ALU_XOR_X   = 40
+	SKF_AD_RANDOM      = 56
 )
+
+// SetsockoptInt sets the socket option opt on level of the socket fd.
+func SetsockoptInt(fd, level, opt, value int) error {
+	return linux.SetsockoptInt(fd, level, opt, value)
+}
@@ -3,6 +3,11 @@
 
 package unix
 
+import (
+	"errors"
+	"syscall"
+)
+
 const (
 	AF_UNSPEC                     = 0x0
 	AF_INET                       = 0x2
@@ -13,11 +18,28 @@ const (
 	NFNL_SUBSYS_CTNETLINK_TIMEOUT = 0x8
 	NETLINK_NETFILTER             = 0xc
 
+	// errno values
+	ENOBUFS    = syscall.Errno(0x69)
+	ENOENT     = syscall.Errno(0x2)
+	EEXIST     = syscall.Errno(0x11)
+	EPERM      = syscall.Errno(0x1)
+	EACCES     = syscall.Errno(0xd)
+	EINVAL     = syscall.Errno(0x16)
+	EOPNOTSUPP = syscall.Errno(0x5f)
+	// ENOTSUPP is used internally by the kernel, but might be returned to userspace.
+	ENOTSUPP = syscall.Errno(0x20c)
+
+	// socket options
+	SOL_SOCKET     = 0x1
+	SO_RCVBUFFORCE = 0x21
+
 	// Instruction classes
 	BPF_LD   = 0x00
 	BPF_LDX  = 0x01
 	BPF_ALU  = 0x04
 	BPF_JMP  = 0x05
+	BPF_ST   = 0x02
+	BPF_STX  = 0x03
 	BPF_RET  = 0x06
 	BPF_MISC = 0x07
 
@@ -28,15 +50,46 @@ const (
 	BPF_IMM = 0x00
 	BPF_ABS = 0x20
 	BPF_IND = 0x40
+	BPF_MEM = 0x60
+	BPF_LEN = 0x80
+	BPF_MSH = 0xa0
 
 	// alu/jmp fields
-	BPF_ADD = 0x00
-	BPF_AND = 0x50
-	BPF_JA  = 0x00
-	BPF_JEQ = 0x10
-	BPF_K   = 0x00
+	BPF_ADD  = 0x00
+	BPF_SUB  = 0x10
+	BPF_MUL  = 0x20
+	BPF_DIV  = 0x30
+	BPF_OR   = 0x40
+	BPF_AND  = 0x50
+	BPF_LSH  = 0x60
+	BPF_RSH  = 0x70
+	BPF_NEG  = 0x80
+	BPF_MOD  = 0x90
+	BPF_XOR  = 0xa0
+	BPF_JA   = 0x00
+	BPF_JEQ  = 0x10
+	BPF_JGT  = 0x20
+	BPF_JGE  = 0x30
+	BPF_JSET = 0x40
+	BPF_K    = 0x00
+	BPF_X    = 0x08
+	BPF_A    = 0x10
 
 	// include/uapi/linux/filter.h
 	BPF_TAX = 0x00
 	BPF_TXA = 0x80
+
+	BPF_MEMWORDS = 16
+
+	SKF_AD_OFF         = -0x1000
+	SKF_AD_CPU         = 36
+	SKF_AD_NLATTR      = 12
+	SKF_AD_NLATTR_NEST = 16
+	SKF_AD_ALU_XOR_X   = 40
+	SKF_AD_RANDOM      = 56
 )
+
+// SetsockoptInt is not supported on this platform.
+func SetsockoptInt(fd, level, opt, value int) error {
+	return errors.New("setsockopt is not supported on this platform")
+}
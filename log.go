@@ -0,0 +1,103 @@
+package conntrack
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// LeveledLogger logs messages of different severity with structured fields,
+// that are passed as alternating keys and values. *slog.Logger implements
+// LeveledLogger.
+//
+// Debug is used for details of the processing, e.g. attributes, that are not
+// supported by this package. Info and Warn report recoverable problems, Error
+// reports failures, that can not be returned to the caller.
+type LeveledLogger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// stdLogger passes messages to a *log.Logger. Messages of the debug level are
+// discarded, unless debug reports, that they are enabled.
+type stdLogger struct {
+	logger *log.Logger
+	debug  func() bool
+}
+
+// newStdLogger returns a LeveledLogger for logger, that discards messages of
+// the debug level. If logger is nil, all messages are discarded.
+func newStdLogger(logger *log.Logger) stdLogger {
+	if logger == nil {
+		logger = log.New(new(devNull), "", 0)
+	}
+	return stdLogger{logger: logger}
+}
+
+func (l stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	if l.debug == nil || !l.debug() {
+		return
+	}
+	l.print("DEBUG", msg, keysAndValues)
+}
+
+func (l stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.print("INFO", msg, keysAndValues)
+}
+
+func (l stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.print("WARN", msg, keysAndValues)
+}
+
+func (l stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.print("ERROR", msg, keysAndValues)
+}
+
+func (l stdLogger) print(level, msg string, keysAndValues []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 == len(keysAndValues) {
+			fmt.Fprintf(&b, " %v", keysAndValues[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	l.logger.Print(b.String())
+}
+
+// fieldLogger adds fields to all messages.
+type fieldLogger struct {
+	logger LeveledLogger
+	fields []interface{}
+}
+
+// withFields returns a LeveledLogger, that adds keysAndValues to all messages
+// of logger.
+func withFields(logger LeveledLogger, keysAndValues ...interface{}) LeveledLogger {
+	return fieldLogger{logger: logger, fields: keysAndValues}
+}
+
+func (l fieldLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.logger.Debug(msg, l.append(keysAndValues)...)
+}
+
+func (l fieldLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.logger.Info(msg, l.append(keysAndValues)...)
+}
+
+func (l fieldLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.logger.Warn(msg, l.append(keysAndValues)...)
+}
+
+func (l fieldLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.logger.Error(msg, l.append(keysAndValues)...)
+}
+
+func (l fieldLogger) append(keysAndValues []interface{}) []interface{} {
+	return append(l.fields[:len(l.fields):len(l.fields)], keysAndValues...)
+}
@@ -0,0 +1,15 @@
+//go:build go1.21
+// +build go1.21
+
+package conntrack
+
+import "log/slog"
+
+// NewSlogLogger returns a LeveledLogger, that passes all messages to logger.
+// If logger is nil, slog.Default() is used.
+func NewSlogLogger(logger *slog.Logger) LeveledLogger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger
+}
@@ -0,0 +1,43 @@
+//go:build go1.21
+// +build go1.21
+
+package conntrack
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	msg := netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(Conntrack<<8 | ipctnlMsgCtNew)},
+		// nfgenmsg and an unknown attribute of type 99
+		Data: []byte{0x2, 0x0, 0x0, 0x0, 0x8, 0x0, 0x63, 0x0, 0x1, 0x2, 0x3, 0x4},
+	}
+	var c Con
+	if err := parseConnectionMsg(logger, &c, msg, int(Conntrack), ipctnlMsgCtNew); err != nil {
+		t.Fatalf("could not parse message: %v", err)
+	}
+	for _, want := range []string{"level=DEBUG", `msg="unknown attribute"`, "table=1", "message=IPCTNL_MSG_CT_NEW", "type=99"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("%q is missing in %q", want, buf.String())
+		}
+	}
+
+	// Parse noise is filtered by the level of the handler.
+	buf.Reset()
+	logger = NewSlogLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+	if err := parseConnectionMsg(logger, &c, msg, int(Conntrack), ipctnlMsgCtNew); err != nil {
+		t.Fatalf("could not parse message: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+}
@@ -0,0 +1,61 @@
+package conntrack
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	debug := false
+	std := newStdLogger(log.New(&buf, "", 0))
+	std.debug = func() bool { return debug }
+	logger := withFields(std, "table", Conntrack)
+
+	tests := []struct {
+		log   func(msg string, keysAndValues ...interface{})
+		args  []interface{}
+		debug bool
+		want  string
+	}{
+		{log: logger.Debug, args: []interface{}{"type", 99}},
+		{log: logger.Debug, args: []interface{}{"type", 99}, debug: true, want: "DEBUG msg table=1 type=99\n"},
+		{log: logger.Info, want: "INFO msg table=1\n"},
+		{log: logger.Warn, args: []interface{}{"odd"}, want: "WARN msg table=1 odd\n"},
+		{log: logger.Error, args: []interface{}{"error", ErrNotFound}, want: "ERROR msg table=1 error=entry not found\n"},
+	}
+	for _, tc := range tests {
+		buf.Reset()
+		debug = tc.debug
+		tc.log("msg", tc.args...)
+		if got := buf.String(); got != tc.want {
+			t.Fatalf("unexpected output %q, expected %q", got, tc.want)
+		}
+	}
+}
+
+func TestDebugLogger(t *testing.T) {
+	var buf bytes.Buffer
+	nfct := &Nfct{}
+	logger := nfct.newDebugLogger(log.New(&buf, "", 0))
+
+	logger.Debug("dropped")
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+
+	// EnableDebug might be called, while messages are logged.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		nfct.EnableDebug()
+	}()
+	logger.Debug("concurrent")
+	<-done
+	buf.Reset()
+	logger.Debug("logged")
+	if got := buf.String(); got != "DEBUG logged\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+}
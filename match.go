@@ -0,0 +1,637 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+
+	"github.com/mdlayher/netlink"
+)
+
+// Matcher evaluates a filter against connections in userspace, for example to
+// filter the results of Dump. It uses the same semantics as the BPF filter of
+// a subscription with the same filter. The family of a connection is derived
+// from its addresses.
+type Matcher struct {
+	table  Table
+	expr   FilterExpr
+	checks map[ConnAttrType]filterCheckStruct
+}
+
+// NewMatcher returns a Matcher for connections of table t. filters and expr
+// are linked by an AND operation in the same way as in EventOptions.
+func NewMatcher(t Table, filters []ConnAttr, expr FilterExpr) (*Matcher, error) {
+	expr, err := combineFilter(filters, expr)
+	if err != nil {
+		return nil, err
+	}
+	// The compiler reports invalid filters in the same way as for subscriptions.
+	if _, err := compileProgram(t, expr); err != nil {
+		return nil, err
+	}
+	return &Matcher{table: t, expr: expr, checks: filterChecks(t)}, nil
+}
+
+// Match returns true, if c matches the filter of m. Clauses on the message,
+// like EventKinds, see c as an entry of a dump.
+func (m *Matcher) Match(c Con) bool {
+	h := netlink.Header{Type: netlink.HeaderType(ipctnlMsgCtNew), Flags: netlink.Multi}
+	return m.eval(m.expr, &c, h)
+}
+
+// MatchEvent returns true, if the message of e matches the filter of m.
+func (m *Matcher) MatchEvent(e Event) bool {
+	// The types of the messages are the same for both subsystems.
+	var h netlink.Header
+	switch e.Kind {
+	case EventNew:
+		h.Type, h.Flags = netlink.HeaderType(ipctnlMsgCtNew), netlink.Create|netlink.Excl
+	case EventUpdate:
+		h.Type = netlink.HeaderType(ipctnlMsgCtNew)
+	case EventDestroy:
+		h.Type = netlink.HeaderType(ipctnlMsgCtDelete)
+	default:
+		h.Type = 0xff
+	}
+	return m.eval(m.expr, &e.Con, h)
+}
+
+// Filter returns the connections of cons, that match the filter of m.
+func (m *Matcher) Filter(cons []Con) []Con {
+	var matching []Con
+	for _, c := range cons {
+		if m.Match(c) {
+			matching = append(matching, c)
+		}
+	}
+	return matching
+}
+
+func (m *Matcher) eval(expr FilterExpr, c *Con, h netlink.Header) bool {
+	switch e := expr.(type) {
+	case andExpr:
+		for _, sub := range e {
+			if !m.eval(sub, c, h) {
+				return false
+			}
+		}
+		return true
+	case orExpr:
+		for _, sub := range e {
+			if m.eval(sub, c, h) {
+				return true
+			}
+		}
+		return false
+	case notExpr:
+		return !m.eval(e.expr, c, h)
+	case ConnAttr:
+		return m.matchAttr(e, c) != e.Negate
+	case Compare:
+		return m.matchCompare(e, c)
+	case msgTypeExpr:
+		return uint8(h.Type) == uint8(e)
+	case MessageFlags:
+		return h.Flags&e.Flags != 0
+	case Sample:
+		return m.sample(e, c)
+	}
+	return false
+}
+
+// sample returns true for one of s.N connections.
+func (m *Matcher) sample(s Sample, c *Con) bool {
+	if s.N <= 1 {
+		return true
+	}
+	if !s.Tuple {
+		return rand.Uint32()%s.N == 0
+	}
+	return m.tupleHash(c)%s.N == 0
+}
+
+// tupleHash returns the hash of the original tuple of c, like it is
+// calculated by the BPF filter of Sample.
+func (m *Matcher) tupleHash(c *Con) uint32 {
+	h := uint32(sampleHashOffset)
+	for _, typ := range sampleTypes {
+		check, ok := m.checks[typ]
+		if !ok {
+			continue
+		}
+		value, ok := m.lookup(c, append(check.nest[:len(check.nest):len(check.nest)], uint32(check.ct)))
+		if !ok || len(value) < check.len {
+			continue
+		}
+		for off := 0; off < check.len; off += 4 {
+			var w uint32
+			switch check.len {
+			case 1:
+				w = uint32(value[0])
+			case 2:
+				w = uint32(binary.BigEndian.Uint16(value))
+			default:
+				w = binary.BigEndian.Uint32(value[off:])
+			}
+			h = (h ^ w) * sampleHashPrime
+		}
+	}
+	return h ^ h>>16
+}
+
+// checkStatus returns false, if none of the bits of status is set in the
+// status of c.
+func (m *Matcher) checkStatus(status uint32, c *Con) bool {
+	if status == 0 {
+		return true
+	}
+	data, ok := m.lookup(c, []uint32{ctaStatus})
+	return ok && len(data) >= 4 && binary.BigEndian.Uint32(data)&status != 0
+}
+
+func (m *Matcher) matchAttr(filter ConnAttr, c *Con) bool {
+	check := m.checks[filter.Type]
+	data := filter.Data
+	if check.str && (len(data) == 0 || data[len(data)-1] != 0) {
+		data = append(data[:len(data):len(data)], 0)
+	}
+	if !m.checkStatus(check.status, c) {
+		return false
+	}
+
+	if check.family {
+		if check.ct != ctaUnspec {
+			if _, ok := m.lookup(c, append(check.nest[:len(check.nest):len(check.nest)], uint32(check.ct))); !ok {
+				return false
+			}
+		}
+		family, ok := m.family(c)
+		return ok && uint8(family) == data[0]
+	}
+
+	value, ok := m.lookup(c, append(check.nest[:len(check.nest):len(check.nest)], uint32(check.ct)))
+	if !ok {
+		return false
+	}
+	if check.variable && len(value) != len(data) {
+		return false
+	}
+	if len(value) < check.off+len(data) {
+		return false
+	}
+	value = value[check.off:]
+	for i := range data {
+		mask := byte(0xff)
+		if len(filter.Mask) != 0 {
+			mask = filter.Mask[i]
+		}
+		if value[i]&mask != data[i]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Matcher) matchCompare(cmp Compare, c *Con) bool {
+	check := m.checks[cmp.Type]
+	if !m.checkStatus(check.status, c) {
+		return false
+	}
+	value, ok := m.lookup(c, append(check.nest[:len(check.nest):len(check.nest)], uint32(check.ct)))
+	if !ok || len(value) < check.off+check.len {
+		return false
+	}
+	var v uint64
+	for _, b := range value[check.off : check.off+check.len] {
+		v = v<<8 | uint64(b)
+	}
+	switch cmp.Op {
+	case CompareEq:
+		return v == cmp.Value
+	case CompareGt:
+		return v > cmp.Value
+	case CompareGe:
+		return v >= cmp.Value
+	case CompareLt:
+		return v < cmp.Value
+	case CompareLe:
+		return v <= cmp.Value
+	case CompareAnySet:
+		return v&cmp.Value != 0
+	}
+	return false
+}
+
+// family returns the family of c, which is derived from its addresses.
+func (m *Matcher) family(c *Con) (Family, bool) {
+	tuple := c.Origin
+	if m.table == Expected && c.Exp != nil && c.Exp.Tuple != nil {
+		tuple = c.Exp.Tuple
+	}
+	for _, ip := range []*net.IP{tupleSrc(tuple), tupleDst(tuple)} {
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			return IPv4, true
+		}
+		return IPv6, true
+	}
+	return 0, false
+}
+
+func tupleSrc(t *IPTuple) *net.IP {
+	if t == nil {
+		return nil
+	}
+	return t.Src
+}
+
+func tupleDst(t *IPTuple) *net.IP {
+	if t == nil {
+		return nil
+	}
+	return t.Dst
+}
+
+// lookup returns the data of the attribute at path, as it is sent by the
+// kernel for c. Attributes, that are not supported by Con, are looked up in
+// c.Unknown. For nests only the existence is reported.
+func (m *Matcher) lookup(c *Con, path []uint32) ([]byte, bool) {
+	var data []byte
+	var ok bool
+	if m.table == Expected {
+		data, ok = expectAttr(c, path)
+	} else {
+		data, ok = conAttr(c, path)
+	}
+	if ok {
+		return data, true
+	}
+	return unknownAttr(c.Unknown, path)
+}
+
+func u8Attr(v *uint8) ([]byte, bool) {
+	if v == nil {
+		return nil, false
+	}
+	return []byte{*v}, true
+}
+
+func u16Attr(v *uint16) ([]byte, bool) {
+	if v == nil {
+		return nil, false
+	}
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, *v)
+	return b, true
+}
+
+func u32Attr(v *uint32) ([]byte, bool) {
+	if v == nil {
+		return nil, false
+	}
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, *v)
+	return b, true
+}
+
+func u64Attr(v *uint64) ([]byte, bool) {
+	if v == nil {
+		return nil, false
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, *v)
+	return b, true
+}
+
+// strAttr returns the data of a string attribute, that is terminated by NUL.
+func strAttr(v *string) ([]byte, bool) {
+	if v == nil {
+		return nil, false
+	}
+	return append([]byte(*v), 0), true
+}
+
+// conAttr returns the data of the attribute at path of a connection.
+func conAttr(c *Con, path []uint32) ([]byte, bool) {
+	switch path[0] {
+	case ctaTupleOrig:
+		return tupleAttr(c.Origin, path[1:])
+	case ctaTupleReply:
+		return tupleAttr(c.Reply, path[1:])
+	case ctaStatus:
+		return u32Attr(c.Status)
+	case ctaTimeout:
+		return u32Attr(c.Timeout)
+	case ctaMark:
+		return u32Attr(c.Mark)
+	case ctaMarkMask:
+		return u32Attr(c.MarkMask)
+	case ctaUse:
+		return u32Attr(c.Use)
+	case ctaID:
+		return u32Attr(c.ID)
+	case ctaZone:
+		return u16Attr(c.Zone)
+	case ctaCountersOrig:
+		return counterAttr(c.CounterOrigin, path[1:])
+	case ctaCountersReply:
+		return counterAttr(c.CounterReply, path[1:])
+	case ctaProtoinfo:
+		return protoInfoAttr(c.ProtoInfo, path[1:])
+	case ctaHelp:
+		if c.Helper == nil {
+			return nil, false
+		}
+		switch {
+		case len(path) == 1:
+			return nil, true
+		case path[1] == ctaHelpName:
+			return strAttr(c.Helper.Name)
+		case path[1] == ctaHelpInfo && c.Helper.Info != nil:
+			return []byte(*c.Helper.Info), true
+		}
+	case ctaSecCtx:
+		if c.SecCtx == nil {
+			return nil, false
+		}
+		switch {
+		case len(path) == 1:
+			return nil, true
+		case path[1] == ctaSecCtxName:
+			return strAttr(c.SecCtx.Name)
+		}
+	case ctaTimestamp:
+		if c.Timestamp == nil {
+			return nil, false
+		}
+		var ts uint64
+		switch {
+		case len(path) == 1:
+			return nil, true
+		case path[1] == ctaTimestampStart && c.Timestamp.Start != nil:
+			ts = uint64(c.Timestamp.Start.UnixNano())
+		case path[1] == ctaTimestampStop && c.Timestamp.Stop != nil:
+			ts = uint64(c.Timestamp.Stop.UnixNano())
+		default:
+			return nil, false
+		}
+		return u64Attr(&ts)
+	}
+	return nil, false
+}
+
+// expectAttr returns the data of the attribute at path of an expectation.
+func expectAttr(c *Con, path []uint32) ([]byte, bool) {
+	if c.Exp == nil {
+		return nil, false
+	}
+	switch path[0] {
+	case ctaExpMaster:
+		// ParseAttributes stores the master tuple in Origin.
+		if c.Exp.Master != nil {
+			return tupleAttr(c.Exp.Master, path[1:])
+		}
+		return tupleAttr(c.Origin, path[1:])
+	case ctaExpTuple:
+		return tupleAttr(c.Exp.Tuple, path[1:])
+	case ctaExpTimeout:
+		return u32Attr(c.Exp.Timeout)
+	case ctaExpID:
+		return u32Attr(c.Exp.ID)
+	case ctaExpZone:
+		return u16Attr(c.Exp.Zone)
+	case ctaExpFlags:
+		return u32Attr(c.Exp.Flags)
+	case ctaExpClass:
+		return u32Attr(c.Exp.Class)
+	case ctaExpHelpName:
+		return strAttr(c.Exp.HelperName)
+	case ctaExpNat:
+		if c.Exp.Nat == nil {
+			return nil, false
+		}
+		switch {
+		case len(path) == 1:
+			return nil, true
+		case path[1] == ctaExpNatDir:
+			return u32Attr(c.Exp.Nat.Dir)
+		}
+	}
+	return nil, false
+}
+
+func tupleAttr(t *IPTuple, path []uint32) ([]byte, bool) {
+	if t == nil {
+		return nil, false
+	}
+	if len(path) == 0 {
+		return nil, true
+	}
+	switch path[0] {
+	case ctaTupleIP:
+		if t.Src == nil && t.Dst == nil {
+			return nil, false
+		}
+		if len(path) == 1 {
+			return nil, true
+		}
+		return ipAttr(t, path[1])
+	case ctaTupleProto:
+		if t.Proto == nil {
+			return nil, false
+		}
+		if len(path) == 1 {
+			return nil, true
+		}
+		return protoAttr(t.Proto, path[1])
+	case ctaTupleZone:
+		return u16Attr(t.Zone)
+	}
+	return nil, false
+}
+
+func ipAttr(t *IPTuple, typ uint32) ([]byte, bool) {
+	var ip *net.IP
+	switch typ {
+	case ctaIPv4Src, ctaIPv6Src:
+		ip = t.Src
+	case ctaIPv4Dst, ctaIPv6Dst:
+		ip = t.Dst
+	}
+	if ip == nil {
+		return nil, false
+	}
+	ip4 := ip.To4()
+	switch typ {
+	case ctaIPv4Src, ctaIPv4Dst:
+		return []byte(ip4), ip4 != nil
+	case ctaIPv6Src, ctaIPv6Dst:
+		return []byte(ip.To16()), ip4 == nil && ip.To16() != nil
+	}
+	return nil, false
+}
+
+func protoAttr(p *ProtoTuple, typ uint32) ([]byte, bool) {
+	switch typ {
+	case ctaProtoNum:
+		return u8Attr(p.Number)
+	case ctaProtoSrcPort:
+		return u16Attr(p.SrcPort)
+	case ctaProtoDstPort:
+		return u16Attr(p.DstPort)
+	case ctaProtoIcmpID:
+		return u16Attr(p.IcmpID)
+	case ctaProtoIcmpType:
+		return u8Attr(p.IcmpType)
+	case ctaProtoIcmpCode:
+		return u8Attr(p.IcmpCode)
+	case ctaProtoIcmpv6ID:
+		return u16Attr(p.Icmpv6ID)
+	case ctaProtoIcmpv6Type:
+		return u8Attr(p.Icmpv6Type)
+	case ctaProtoIcmpv6Code:
+		return u8Attr(p.Icmpv6Code)
+	}
+	return nil, false
+}
+
+func counterAttr(c *Counter, path []uint32) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	if len(path) == 0 {
+		return nil, true
+	}
+	switch path[0] {
+	case ctaCounterPackets:
+		return u64Attr(c.Packets)
+	case ctaCounterBytes:
+		return u64Attr(c.Bytes)
+	}
+	return nil, false
+}
+
+func protoInfoAttr(p *ProtoInfo, path []uint32) ([]byte, bool) {
+	if p == nil {
+		return nil, false
+	}
+	if len(path) == 0 {
+		return nil, true
+	}
+	switch path[0] {
+	case ctaProtoinfoTCP:
+		if p.TCP == nil {
+			return nil, false
+		}
+		if len(path) == 1 {
+			return nil, true
+		}
+		switch path[1] {
+		case ctaProtoinfoTCPState:
+			return u8Attr(p.TCP.State)
+		case ctaProtoinfoTCPWScaleOrig:
+			return u8Attr(p.TCP.WScaleOrig)
+		case ctaProtoinfoTCPWScaleRepl:
+			return u8Attr(p.TCP.WScaleRepl)
+		case ctaProtoinfoTCPFlagsOrig:
+			return tcpFlagsAttr(p.TCP.FlagsOrig)
+		case ctaProtoinfoTCPFlagsRepl:
+			return tcpFlagsAttr(p.TCP.FlagsReply)
+		}
+	case ctaProtoinfoDCCP:
+		if p.DCCP == nil {
+			return nil, false
+		}
+		if len(path) == 1 {
+			return nil, true
+		}
+		switch path[1] {
+		case ctaProtoinfoDCCPState:
+			return u8Attr(p.DCCP.State)
+		case ctaProtoinfoDCCPRole:
+			return u8Attr(p.DCCP.Role)
+		}
+	case ctaProtoinfoSCTP:
+		if p.SCTP == nil {
+			return nil, false
+		}
+		if len(path) == 1 {
+			return nil, true
+		}
+		switch path[1] {
+		case ctaProtoinfoSCTPState:
+			return u8Attr(p.SCTP.State)
+		case ctaProtoinfoSCTPVTagOriginal:
+			return u32Attr(p.SCTP.VTagOriginal)
+		case ctaProtoinfoSCTPVTagReply:
+			return u32Attr(p.SCTP.VTagReply)
+		}
+	}
+	return nil, false
+}
+
+// tcpFlagsAttr returns struct nf_ct_tcp_flags with the flags and the mask.
+func tcpFlagsAttr(f *TCPFlags) ([]byte, bool) {
+	if f == nil || f.Flags == nil || f.Mask == nil {
+		return nil, false
+	}
+	return []byte{*f.Flags, *f.Mask}, true
+}
+
+// unknownAttr returns the data of the attribute at path in attrs. The
+// attribute can be part of the data of an unknown nest as well.
+func unknownAttr(attrs []Attribute, path []uint32) ([]byte, bool) {
+	for _, attr := range attrs {
+		n := len(attr.Path)
+		if n >= len(path) {
+			// The attribute is nested in path.
+			if pathEqual(attr.Path[:len(path)], path) {
+				return nil, true
+			}
+			continue
+		}
+		if !pathEqual(attr.Path, path[:n]) || uint32(attr.Type&nlaTypeMask) != path[n] {
+			continue
+		}
+		if n == len(path)-1 {
+			return attr.Data, true
+		}
+		if data, ok := nestedAttr(attr.Data, path[n+1:]); ok {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+func pathEqual(a []uint16, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if uint32(a[i]) != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nestedAttr returns the data of the attribute at path in the attributes of
+// data.
+func nestedAttr(data []byte, path []uint32) ([]byte, bool) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, false
+	}
+	for ad.Next() {
+		if uint32(ad.Type()) != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return ad.Bytes(), true
+		}
+		return nestedAttr(ad.Bytes(), path[1:])
+	}
+	return nil, false
+}
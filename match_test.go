@@ -0,0 +1,238 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+)
+
+// randomCon returns a connection with a random selection of attributes.
+// Attributes, that are not encoded by nestAttributes, are added as unknown
+// attributes and are decoded into the fields of Con.
+func randomCon(rng *rand.Rand) Con {
+	pick := func(values ...interface{}) interface{} { return values[rng.Intn(len(values))] }
+	maybe := func() bool { return rng.Intn(3) != 0 }
+
+	src := pick("10.0.0.1", "10.0.1.1", "192.0.2.1", "2001:db8::1", "2001:db8::100").(string)
+	c := testCon(src, pick(uint16(22), uint16(80), uint16(443), uint16(8080)).(uint16), pick(uint32(0), uint32(1), uint32(0x101)).(uint32))
+	*c.Origin.Proto.SrcPort = pick(uint16(1000), uint16(1003), uint16(40000)).(uint16)
+	if c.Origin.Src.To4() == nil {
+		dst := net.ParseIP("2001:db8::2")
+		c.Origin.Dst = &dst
+	}
+	if maybe() {
+		rsrc, rdst := *c.Origin.Dst, pick(net.ParseIP("203.0.113.5"), *c.Origin.Src).(net.IP)
+		if c.Origin.Src.To4() == nil {
+			rdst = *c.Origin.Src
+		}
+		rsport, rdport := *c.Origin.Proto.DstPort, pick(uint16(61000), uint16(40000)).(uint16)
+		c.Reply = &IPTuple{Src: &rsrc, Dst: &rdst, Proto: &ProtoTuple{Number: c.Origin.Proto.Number, SrcPort: &rsport, DstPort: &rdport}}
+	}
+	if maybe() {
+		status := pick(uint32(0x8), uint32(ipsSrcNat|0x8), uint32(ipsDstNat)).(uint32)
+		c.Status = &status
+	}
+	if maybe() {
+		timeout := pick(uint32(30), uint32(120), uint32(432000)).(uint32)
+		c.Timeout = &timeout
+	}
+	if maybe() {
+		state, flags, mask := pick(uint8(1), uint8(3)).(uint8), pick(uint8(0x2), uint8(0x12)).(uint8), uint8(0x12)
+		c.ProtoInfo = &ProtoInfo{TCP: &TCPInfo{State: &state, FlagsOrig: &TCPFlags{Flags: &flags, Mask: &mask}}}
+	}
+	if maybe() {
+		name := pick("ftp", "sip").(string)
+		c.Helper = &Helper{Name: &name}
+	}
+	if maybe() {
+		c.Unknown = append(c.Unknown, Attribute{Type: ctaUse, Data: u32(pick(uint32(1), uint32(3)).(uint32))})
+	}
+	if maybe() {
+		c.Unknown = append(c.Unknown,
+			Attribute{Path: []uint16{ctaCountersOrig}, Type: ctaCounterPackets, Data: u64(pick(uint64(10), uint64(1<<32+10)).(uint64))},
+			Attribute{Path: []uint16{ctaCountersOrig}, Type: ctaCounterBytes, Data: u64(1500)})
+	}
+	if maybe() {
+		c.Unknown = append(c.Unknown, Attribute{Type: ctaZone, Data: u16(pick(uint16(0), uint16(7)).(uint16))})
+	}
+	if maybe() {
+		name := pick("system_u:object_r:ssh_t", "system_u:object_r:ftp_t").(string)
+		c.Unknown = append(c.Unknown, Attribute{Path: []uint16{ctaSecCtx}, Type: ctaSecCtxName, Data: append([]byte(name), 0)})
+	}
+	if maybe() {
+		c.Unknown = append(c.Unknown, Attribute{Path: []uint16{ctaTimestamp}, Type: ctaTimestampStart, Data: u64(uint64(time.Unix(1000, 0).UnixNano()))})
+	}
+	if maybe() {
+		c.Unknown = append(c.Unknown, Attribute{Path: []uint16{ctaTupleOrig}, Type: ctaTupleZone, Data: u16(7)})
+	}
+	if maybe() {
+		c.Unknown = append(c.Unknown,
+			Attribute{Path: []uint16{ctaTupleMaster, ctaTupleIP}, Type: ctaIPv4Src, Data: []byte{10, 0, 0, 9}},
+			Attribute{Path: []uint16{ctaTupleMaster, ctaTupleProto}, Type: ctaProtoDstPort, Data: u16(21)})
+	}
+	if maybe() {
+		labels := make([]byte, 16)
+		labels[15] = pick(uint8(1), uint8(4)).(uint8)
+		c.Unknown = append(c.Unknown, Attribute{Type: ctaLables, Data: labels})
+	}
+	return c
+}
+
+// randomExpr returns a random filter expression with attributes, that are
+// likely to be part of the connections of randomCon.
+func randomExpr(rng *rand.Rand, depth int) FilterExpr {
+	if depth > 0 && rng.Intn(2) == 0 {
+		var exprs []FilterExpr
+		for i := rng.Intn(4); i >= 0; i-- {
+			exprs = append(exprs, randomExpr(rng, depth-1))
+		}
+		switch rng.Intn(3) {
+		case 0:
+			return And(exprs...)
+		case 1:
+			return Or(exprs...)
+		default:
+			return Not(exprs[0])
+		}
+	}
+	leaves := []func() FilterExpr{
+		func() FilterExpr {
+			return ConnAttr{Type: AttrOrigIPv4Src, Data: []byte{10, 0, byte(rng.Intn(2)), 1}, Mask: net.CIDRMask(8+8*rng.Intn(4), 32)}
+		},
+		func() FilterExpr {
+			return ConnAttr{Type: AttrOrigIPv6Src, Data: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64+64*rng.Intn(2), 128)}
+		},
+		func() FilterExpr {
+			return ConnAttr{Type: AttrOrigPortDst, Data: u16([]uint16{22, 80, 443}[rng.Intn(3)])}
+		},
+		func() FilterExpr {
+			// large enough for a binary search
+			var ports []FilterExpr
+			for port := 1000 + rng.Intn(4); port < 1020; port += 2 {
+				ports = append(ports, ConnAttr{Type: AttrOrigPortSrc, Data: u16(uint16(port))})
+			}
+			return Or(ports...)
+		},
+		func() FilterExpr { return Range(AttrOrigPortSrc, 1001, uint64(1001+rng.Intn(40000))) },
+		func() FilterExpr {
+			return ConnAttr{Type: AttrMark, Data: u32(1), Mask: u32([]uint32{0xff, 0xf00}[rng.Intn(2)]), Negate: rng.Intn(2) == 0}
+		},
+		func() FilterExpr {
+			return ConnAttr{Type: AttrOrigL3Proto, Data: []byte{uint8([]Family{IPv4, IPv6}[rng.Intn(2)])}}
+		},
+		func() FilterExpr { return ConnAttr{Type: AttrReplL4Proto, Data: []byte{6}} },
+		func() FilterExpr { return ConnAttr{Type: AttrSNatIPv4, Data: []byte{203, 0, 113, 5}} },
+		func() FilterExpr { return ConnAttr{Type: AttrDNatPort, Data: u16(61000)} },
+		func() FilterExpr { return ConnAttr{Type: AttrTCPState, Data: []byte{3}} },
+		func() FilterExpr { return ConnAttr{Type: AttrTCPMaskOrig, Data: []byte{0x12}} },
+		func() FilterExpr { return ConnAttr{Type: AttrTCPFlagsOrig, Data: []byte{0x2}} },
+		func() FilterExpr {
+			return ConnAttr{Type: AttrHelperName, Data: []byte([]string{"ftp", "sip", "ft"}[rng.Intn(3)])}
+		},
+		func() FilterExpr { return ConnAttr{Type: AttrSecCtx, Data: []byte("system_u:object_r:ssh_t")} },
+		func() FilterExpr { return ConnAttr{Type: AttrZone, Data: u16(7)} },
+		func() FilterExpr { return ConnAttr{Type: AttrOrigzone, Data: u16(7)} },
+		func() FilterExpr { return ConnAttr{Type: AttrMasterIPv4Src, Data: []byte{10, 0, 0, 9}} },
+		func() FilterExpr { return ConnAttr{Type: AttrMasterPortDst, Data: u16(21)} },
+		func() FilterExpr { return ConnAttr{Type: AttrMasterL3Proto, Data: []byte{uint8(IPv4)}} },
+		func() FilterExpr {
+			labels := make([]byte, 16)
+			labels[15] = 4
+			return ConnAttr{Type: AttrConnlabels, Data: labels, Mask: labels}
+		},
+		func() FilterExpr {
+			return Compare{Type: AttrTimeout, Op: CompareOp(rng.Intn(int(CompareAnySet) + 1)), Value: []uint64{30, 120, 200}[rng.Intn(3)]}
+		},
+		func() FilterExpr {
+			return Compare{Type: AttrUse, Op: CompareOp(rng.Intn(int(CompareAnySet) + 1)), Value: 2}
+		},
+		func() FilterExpr {
+			return Compare{Type: AttrOrigCounterPackets, Op: CompareOp(rng.Intn(int(CompareAnySet) + 1)), Value: []uint64{10, 1 << 32, 1<<32 + 10}[rng.Intn(3)]}
+		},
+		func() FilterExpr { return Compare{Type: AttrStatus, Op: CompareAnySet, Value: ipsSrcNat | ipsDstNat} },
+		func() FilterExpr {
+			return Compare{Type: AttrTimestampStart, Op: CompareGt, Value: uint64(time.Unix(999, 0).UnixNano())}
+		},
+	}
+	return leaves[rng.Intn(len(leaves))]()
+}
+
+// TestMatchAgreement checks, that Match on decoded connections agrees with the
+// BPF filter, that is run on the encoded messages. The VM of golang.org/x/net/bpf
+// does not support the extensions to find netlink attributes, so the kernel-like
+// VM of internal/bpfvm runs the programs.
+func TestMatchAgreement(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		c := randomCon(rng)
+		expr := randomExpr(rng, 3)
+		pkt := encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, c)
+		var msg netlink.Message
+		if err := msg.UnmarshalBinary(pkt); err != nil {
+			t.Fatalf("could not decode message: %v", err)
+		}
+		var decoded Con
+		if err := parseConnectionMsg(newStdLogger(nil), &decoded, msg, int(Conntrack), ipctnlMsgCtNew); err != nil {
+			t.Fatalf("could not parse message: %v", err)
+		}
+
+		m, err := NewMatcher(Conntrack, nil, expr)
+		if err != nil {
+			t.Fatalf("could not create matcher for %#v: %v", expr, err)
+		}
+		prog, err := compileProgram(Conntrack, expr)
+		if err != nil {
+			t.Fatalf("could not compile %#v: %v", expr, err)
+		}
+		if want, got := runFilter(t, prog, pkt), m.Match(decoded); got != want {
+			t.Fatalf("Match returns %t for %s\nexpression: %s", got, DecodeMessage(msg), fmt.Sprintf("%#v", expr))
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	c := testCon("10.0.0.1", 22, 0x101)
+	tests := map[string]struct {
+		table   Table
+		filters []ConnAttr
+		expr    FilterExpr
+		con     Con
+		want    bool
+		err     error
+	}{
+		"empty":    {con: c, want: true},
+		"filters":  {filters: []ConnAttr{{Type: AttrOrigPortDst, Data: u16(22)}, {Type: AttrOrigPortDst, Data: u16(80)}}, con: c, want: true},
+		"and":      {filters: []ConnAttr{{Type: AttrOrigPortDst, Data: u16(22)}}, expr: ConnAttr{Type: AttrMark, Data: u32(2), Mask: u32(0xff)}, con: c},
+		"negated":  {filters: []ConnAttr{{Type: AttrMark, Data: u32(2), Mask: u32(0xff), Negate: true}}, con: c, want: true},
+		"missing":  {expr: ConnAttr{Type: AttrHelperName, Data: []byte("ftp")}, con: c},
+		"expected": {table: Expected, expr: ConnAttr{Type: AttrMasterPortDst, Data: u16(22)}, con: Con{Origin: c.Origin, Exp: &Exp{}}, want: true},
+		"length":   {expr: ConnAttr{Type: AttrOrigPortDst, Data: u32(22)}, err: ErrFilterAttributeLength},
+		"negate mix": {
+			filters: []ConnAttr{{Type: AttrMark, Data: u32(1)}, {Type: AttrMark, Data: u32(2), Negate: true}},
+			err:     ErrFilterAttributeNegateMix,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			table := tc.table
+			if table == 0 {
+				table = Conntrack
+			}
+			m, err := NewMatcher(table, tc.filters, tc.expr)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if got := m.Match(tc.con); got != tc.want {
+				t.Fatalf("unexpected result %t", got)
+			}
+		})
+	}
+}
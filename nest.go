@@ -2,12 +2,12 @@ package conntrack
 
 import (
 	"encoding/binary"
-	"log"
+	"fmt"
 
 	"github.com/mdlayher/netlink"
 )
 
-func nestAttributes(logger *log.Logger, filters *Con) ([]byte, error) {
+func nestAttributes(logger LeveledLogger, filters *Con) ([]byte, error) {
 	ae := netlink.NewAttributeEncoder()
 
 	if filters.Origin != nil {
@@ -84,7 +84,7 @@ func nestAttributes(logger *log.Logger, filters *Con) ([]byte, error) {
 	return ae.Encode()
 }
 
-func nestExpectedAttributes(logger *log.Logger, ae *netlink.AttributeEncoder, filters *Exp) error {
+func nestExpectedAttributes(logger LeveledLogger, ae *netlink.AttributeEncoder, filters *Exp) error {
 	if filters.Master != nil {
 		data, err := marshalIPTuple(logger, filters.Master)
 		if err != nil {
@@ -150,3 +150,20 @@ func nestExpectedAttributes(logger *log.Logger, ae *netlink.AttributeEncoder, fi
 	}
 	return nil
 }
+
+// checkExpect returns an error, if the expectation c can not be created. The
+// master of an expectation is read from Origin by ParseAttributes, so it is
+// accepted as Exp.Master as well.
+func checkExpect(c *Con) error {
+	switch {
+	case c.Exp == nil:
+		return fmt.Errorf("%w: expectation", ErrAttrMissing)
+	case c.Exp.Master == nil && c.Origin == nil:
+		return fmt.Errorf("%w: master of expectation", ErrAttrMissing)
+	case c.Exp.Tuple == nil:
+		return fmt.Errorf("%w: tuple of expectation", ErrAttrMissing)
+	case c.Exp.Mask == nil:
+		return fmt.Errorf("%w: mask of expectation", ErrAttrMissing)
+	}
+	return nil
+}
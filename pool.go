@@ -0,0 +1,141 @@
+package conntrack
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mdlayher/netlink"
+)
+
+// initPool prepares the synchronization of the socket pool. The caller must hold subMu.
+func (nfct *Nfct) initPool() {
+	if nfct.poolCond == nil {
+		nfct.poolCond = sync.NewCond(&nfct.subMu)
+	}
+}
+
+// poolLimit returns the maximum number of concurrent requests.
+func (nfct *Nfct) poolLimit() int {
+	if nfct.poolSize < 1 {
+		return 1
+	}
+	return nfct.poolSize
+}
+
+// acquireRequestCon returns a socket, that is exclusively used for a single
+// request, until release is called. Con is used as long as it is not used by a
+// subscription. Further sockets are created on demand up to the size of the pool.
+func (nfct *Nfct) acquireRequestCon(ctx context.Context) (*netlink.Conn, func(), error) {
+	nfct.subMu.Lock()
+	defer nfct.subMu.Unlock()
+	nfct.initPool()
+
+	// Wake up waiting goroutines, if ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				nfct.subMu.Lock()
+				nfct.poolCond.Broadcast()
+				nfct.subMu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if nfct.poolInUse < nfct.poolLimit() {
+			if !nfct.conBusy && !nfct.conInUse && !nfct.conAbandoned {
+				nfct.conInUse = true
+				nfct.poolInUse++
+				return nfct.Con, nfct.releaseRequestCon(nfct.Con), nil
+			}
+			if n := len(nfct.idle); n > 0 {
+				con := nfct.idle[n-1]
+				nfct.idle = nfct.idle[:n-1]
+				nfct.poolInUse++
+				return con, nfct.releaseRequestCon(con), nil
+			}
+			if nfct.dial == nil {
+				if nfct.poolInUse == 0 {
+					return nil, nil, ErrNoSocket
+				}
+			} else {
+				nfct.poolInUse++
+				nfct.subMu.Unlock()
+				con, err := nfct.dial()
+				nfct.subMu.Lock()
+				if err != nil {
+					nfct.poolInUse--
+					nfct.poolCond.Signal()
+					return nil, nil, err
+				}
+				return con, nfct.releaseRequestCon(con), nil
+			}
+		}
+		nfct.poolCond.Wait()
+	}
+}
+
+// releaseRequestCon returns a function, that makes con available for further requests.
+func (nfct *Nfct) releaseRequestCon(con *netlink.Conn) func() {
+	return func() {
+		nfct.subMu.Lock()
+		defer nfct.subMu.Unlock()
+
+		nfct.poolInUse--
+		_, abandoned := nfct.abandoned[con]
+		switch {
+		case con == nfct.Con:
+			nfct.conInUse = false
+		case nfct.poolClosed || abandoned:
+			delete(nfct.abandoned, con)
+			if err := con.Close(); err != nil {
+				nfct.logger.Warn("could not close request socket", "error", err)
+			}
+		default:
+			nfct.idle = append(nfct.idle, con)
+		}
+		nfct.poolCond.Broadcast()
+	}
+}
+
+// abandonRequestCon marks con, that a request on it was interrupted. The
+// kernel might still reply to the request and netlink.Conn reports errors of
+// such late replies without checking their sequence. Therefore con is closed
+// once it is released. Con is not closed, but only used for further requests,
+// if no other sockets can be created.
+func (nfct *Nfct) abandonRequestCon(con *netlink.Conn) {
+	nfct.subMu.Lock()
+	defer nfct.subMu.Unlock()
+
+	if con == nfct.Con {
+		nfct.conAbandoned = nfct.dial != nil
+		return
+	}
+	if nfct.abandoned == nil {
+		nfct.abandoned = make(map[*netlink.Conn]struct{})
+	}
+	nfct.abandoned[con] = struct{}{}
+}
+
+// closePool closes all idle sockets of the pool. Sockets, that are still in
+// use, are closed once they are released.
+func (nfct *Nfct) closePool() {
+	nfct.subMu.Lock()
+	idle := nfct.idle
+	nfct.idle = nil
+	nfct.poolClosed = true
+	nfct.subMu.Unlock()
+
+	for _, con := range idle {
+		if err := con.Close(); err != nil {
+			nfct.logger.Warn("could not close request socket", "error", err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+)
+
+func TestPool(t *testing.T) {
+	var active, maxActive, dialed int32
+	handler := func(req netlink.Message) []netlink.Message {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			old := atomic.LoadInt32(&maxActive)
+			if n <= old || atomic.CompareAndSwapInt32(&maxActive, old, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return []netlink.Message{{
+			// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_NEW
+			Header: netlink.Header{Type: netlink.HeaderType(1 << 8), Sequence: req.Header.Sequence},
+			Data:   []byte{0x2, 0x0, 0x0, 0x0, 0x8, 0x0, 0xc, 0x0, 0x0, 0x0, 0x0, 0x1},
+		}}
+	}
+
+	sock := newEventSocket()
+	sock.handler = handler
+	nfct := &Nfct{
+		Con:      netlink.NewConn(sock, 1),
+		logger:   newStdLogger(nil),
+		poolSize: 2,
+		dial: func() (*netlink.Conn, error) {
+			atomic.AddInt32(&dialed, 1)
+			s := newEventSocket()
+			s.handler = handler
+			return netlink.NewConn(s, 2), nil
+		},
+	}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	defer nfct.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cons, err := nfct.Dump(Conntrack, IPv4)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if len(cons) != 1 || cons[0].ID == nil {
+				t.Errorf("unexpected entries: %#v", cons)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if max := atomic.LoadInt32(&maxActive); max > 2 {
+		t.Fatalf("too many concurrent requests: %d", max)
+	}
+	if n := atomic.LoadInt32(&dialed); n > 1 {
+		t.Fatalf("too many sockets created: %d", n)
+	}
+}
+
+func TestPoolReleaseAfterClose(t *testing.T) {
+	sock := newEventSocket()
+	nfct := &Nfct{
+		Con:      netlink.NewConn(newEventSocket(), 1),
+		logger:   newStdLogger(nil),
+		poolSize: 2,
+		dial: func() (*netlink.Conn, error) {
+			return netlink.NewConn(sock, 2), nil
+		},
+	}
+
+	_, releaseCon, err := nfct.acquireRequestCon(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	con, release, err := nfct.acquireRequestCon(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if con == nfct.Con {
+		t.Fatal("expected a dialed socket")
+	}
+
+	if err := nfct.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sock.isClosed() {
+		t.Fatal("socket in use was closed")
+	}
+	release()
+	releaseCon()
+	if !sock.isClosed() {
+		t.Fatal("released socket was not closed")
+	}
+	if len(nfct.idle) != 0 {
+		t.Fatalf("unexpected idle sockets: %d", len(nfct.idle))
+	}
+}
+
+func TestPoolAbandoned(t *testing.T) {
+	// ack returns the acknowledgement of req with errno.
+	ack := func(req netlink.Message, errno int32) []netlink.Message {
+		data := make([]byte, 4+16)
+		nativeEndian.PutUint32(data, uint32(-errno))
+		return []netlink.Message{{
+			Header: netlink.Header{Type: netlink.Error, Sequence: req.Header.Sequence},
+			Data:   data,
+		}}
+	}
+
+	var mu sync.Mutex
+	var socks []*eventSocket
+	hang := true
+	mainSock := newEventSocket()
+	nfct := &Nfct{
+		Con:      netlink.NewConn(mainSock, 1),
+		logger:   newStdLogger(nil),
+		poolSize: 1,
+		dial: func() (*netlink.Conn, error) {
+			s := newEventSocket()
+			s.handler = func(req netlink.Message) []netlink.Message {
+				mu.Lock()
+				defer mu.Unlock()
+				if hang {
+					return nil
+				}
+				return ack(req, 0)
+			}
+			mu.Lock()
+			socks = append(socks, s)
+			mu.Unlock()
+			return netlink.NewConn(s, 2), nil
+		},
+	}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	defer nfct.Close()
+
+	interrupt := func() {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := nfct.FlushContext(ctx, Conntrack, IPv4); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// The kernel does not reply in time to the request on Con. The late
+	// error reply must not be returned for the following request.
+	interrupt()
+	mainSock.msgs <- ack(netlink.Message{}, 1)
+
+	// The request on the dialed socket is interrupted as well.
+	interrupt()
+	mu.Lock()
+	hang = false
+	if len(socks) != 1 || !socks[0].isClosed() {
+		mu.Unlock()
+		t.Fatal("socket of interrupted request was not closed")
+	}
+	mu.Unlock()
+
+	if err := nfct.Flush(Conntrack, IPv4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(socks) != 2 || socks[1].isClosed() {
+		t.Fatalf("unexpected sockets: %d", len(socks))
+	}
+}
@@ -0,0 +1,288 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Direction of a recorded netlink message.
+type Direction uint8
+
+// Directions of recorded netlink messages
+const (
+	// DirectionSent marks messages, that were sent to the kernel.
+	DirectionSent Direction = iota
+	// DirectionReceived marks messages, that were received from the kernel.
+	DirectionReceived
+)
+
+func (d Direction) String() string {
+	if d == DirectionSent {
+		return "sent"
+	}
+	return "received"
+}
+
+// Recorder is called with all netlink messages, that are sent or received by
+// Nfct, including events. netlink.Conn does not return NLMSG_DONE and error
+// messages, so they are reconstructed from the other messages.
+type Recorder interface {
+	Record(dir Direction, msgs []netlink.Message) error
+}
+
+// RecordedMessage is a single recorded netlink message.
+type RecordedMessage struct {
+	Time      time.Time
+	Direction Direction
+	Message   netlink.Message
+}
+
+// record passes msgs to the recorder of nfct and logs them, if tracing is
+// enabled.
+func (nfct *Nfct) record(dir Direction, msgs []netlink.Message) {
+	if (nfct.recorder == nil && !nfct.trace) || len(msgs) == 0 {
+		return
+	}
+	if dir == DirectionReceived {
+		// netlink.Conn removes the message, that terminates a multipart message.
+		if last := msgs[len(msgs)-1]; last.Header.Flags&netlink.Multi != 0 && last.Header.Type != netlink.Done {
+			msgs = append(msgs[:len(msgs):len(msgs)], netlink.Message{
+				Header: netlink.Header{
+					Length:   16 + 4,
+					Type:     netlink.Done,
+					Flags:    last.Header.Flags,
+					Sequence: last.Header.Sequence,
+					PID:      last.Header.PID,
+				},
+				Data: make([]byte, 4),
+			})
+		}
+	}
+	if nfct.trace {
+		for _, msg := range msgs {
+			nfct.logger.Debug("trace", "direction", dir, "message", DecodeMessage(msg))
+		}
+	}
+	if nfct.recorder == nil {
+		return
+	}
+	if err := nfct.recorder.Record(dir, msgs); err != nil {
+		nfct.logger.Warn("could not record messages", "error", err)
+	}
+}
+
+// recordError records the NLMSG_ERROR message, that was returned for req, if
+// err was reported by the kernel.
+func (nfct *Nfct) recordError(req netlink.Message, err error) {
+	var e *Error
+	if (nfct.recorder == nil && !nfct.trace) || !errors.As(err, &e) {
+		return
+	}
+	nfct.record(DirectionReceived, []netlink.Message{errorMessage(req, e.Errno)})
+}
+
+// errorMessage returns the NLMSG_ERROR message of the kernel, that rejects req
+// with errno.
+func errorMessage(req netlink.Message, errno syscall.Errno) netlink.Message {
+	data := make([]byte, 4)
+	nlenc.PutInt32(data, -int32(errno))
+	if raw, err := req.MarshalBinary(); err == nil {
+		data = append(data, raw...)
+	}
+	return netlink.Message{
+		Header: netlink.Header{
+			Length:   uint32(16 + len(data)),
+			Type:     netlink.Error,
+			Sequence: req.Header.Sequence,
+			PID:      req.Header.PID,
+		},
+		Data: data,
+	}
+}
+
+// Values of the pcap format
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapMagicNano    = 0xa1b23c4d
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	pcapSnapLen      = 0x40000
+	linktypeNetlink  = 253
+	arphrdNetlink    = 824
+	packetHost       = 0
+	packetOutgoing   = 4
+
+	// header of LINKTYPE_NETLINK in front of each message
+	cookedHeaderLen = 16
+)
+
+// Errors of reading recorded messages.
+var (
+	ErrPcapFormat   = errors.New("not a pcap file")
+	ErrPcapLinktype = errors.New("pcap file does not contain netlink messages")
+)
+
+// PcapWriter writes recorded messages in the pcap format with LINKTYPE_NETLINK,
+// which can be opened by Wireshark. It implements Recorder.
+type PcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var _ Recorder = (*PcapWriter)(nil)
+
+// NewPcapWriter writes the header of a pcap file to w and returns a PcapWriter
+// for the messages.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], pcapVersionMinor)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], linktypeNetlink)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// Record writes each message as a single packet.
+func (pw *PcapWriter) Record(dir Direction, msgs []netlink.Message) error {
+	now := time.Now()
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	for _, msg := range msgs {
+		padded := make([]byte, netlinkAlign(len(msg.Data)))
+		copy(padded, msg.Data)
+		msg.Data = padded
+		msg.Header.Length = uint32(16 + len(padded))
+		data, err := msg.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		pkt := make([]byte, 16+cookedHeaderLen, 16+cookedHeaderLen+len(data))
+		binary.LittleEndian.PutUint32(pkt[0:4], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(pkt[4:8], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(pkt[8:12], uint32(cookedHeaderLen+len(data)))
+		binary.LittleEndian.PutUint32(pkt[12:16], uint32(cookedHeaderLen+len(data)))
+
+		cooked := pkt[16:]
+		pktType := uint16(packetHost)
+		if dir == DirectionSent {
+			pktType = packetOutgoing
+		}
+		binary.BigEndian.PutUint16(cooked[0:2], pktType)
+		binary.BigEndian.PutUint16(cooked[2:4], arphrdNetlink)
+		binary.BigEndian.PutUint16(cooked[14:16], unix.NETLINK_NETFILTER)
+
+		if _, err := pw.w.Write(append(pkt, data...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadPcap returns the netlink messages of a pcap file with LINKTYPE_NETLINK.
+func ReadPcap(r io.Reader) ([]RecordedMessage, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPcapFormat, err)
+	}
+
+	var order binary.ByteOrder
+	var nano bool
+	switch {
+	case binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagic:
+		order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagicNano:
+		order, nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicNano:
+		order, nano = binary.BigEndian, true
+	default:
+		return nil, ErrPcapFormat
+	}
+	if order.Uint32(hdr[20:24]) != linktypeNetlink {
+		return nil, ErrPcapLinktype
+	}
+	// Records are not allowed to exceed the snapshot length of the file. It
+	// is limited to the snapshot length of WritePcap, so that corrupt files do
+	// not cause large allocations.
+	snapLen := order.Uint32(hdr[16:20])
+	if snapLen == 0 || snapLen > pcapSnapLen {
+		snapLen = pcapSnapLen
+	}
+
+	var recorded []RecordedMessage
+	for {
+		pktHdr := make([]byte, 16)
+		if _, err := io.ReadFull(r, pktHdr); err != nil {
+			if errors.Is(err, io.EOF) {
+				return recorded, nil
+			}
+			return nil, fmt.Errorf("%w: %v", ErrPcapFormat, err)
+		}
+		sec, frac := int64(order.Uint32(pktHdr[0:4])), int64(order.Uint32(pktHdr[4:8]))
+		if !nano {
+			frac *= 1000
+		}
+		capLen := order.Uint32(pktHdr[8:12])
+		if capLen > snapLen {
+			return nil, fmt.Errorf("%w: packet length %d exceeds snapshot length %d", ErrPcapFormat, capLen, snapLen)
+		}
+		pkt := make([]byte, capLen)
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPcapFormat, err)
+		}
+		if len(pkt) < cookedHeaderLen {
+			return nil, fmt.Errorf("%w: packet too short", ErrPcapFormat)
+		}
+
+		dir := DirectionReceived
+		if binary.BigEndian.Uint16(pkt[0:2]) == packetOutgoing {
+			dir = DirectionSent
+		}
+		msgs, err := parseMessages(pkt[cookedHeaderLen:])
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			recorded = append(recorded, RecordedMessage{
+				Time:      time.Unix(sec, frac),
+				Direction: dir,
+				Message:   msg,
+			})
+		}
+	}
+}
+
+// parseMessages returns the netlink messages contained in b.
+func parseMessages(b []byte) ([]netlink.Message, error) {
+	var msgs []netlink.Message
+	for len(b) >= 16 {
+		length := int(nlenc.Uint32(b[0:4]))
+		if length < 16 || length > len(b) {
+			return nil, fmt.Errorf("%w: invalid length of netlink message", ErrPcapFormat)
+		}
+		var msg netlink.Message
+		if err := msg.UnmarshalBinary(b[:length]); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+		b = b[length:]
+	}
+	return msgs, nil
+}
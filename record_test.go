@@ -0,0 +1,72 @@
+package conntrack
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+)
+
+func TestPcap(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf)
+	if err != nil {
+		t.Fatalf("could not create pcap writer: %v", err)
+	}
+	req := netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(1<<8 | ipctnlMsgCtGet), Flags: netlink.Request | netlink.Dump, Sequence: 1, PID: 2},
+		Data:   []byte{0x2, 0x0, 0x0, 0x0},
+	}
+	reply := netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(1 << 8), Flags: netlink.Multi, Sequence: 1, PID: 2},
+		Data:   []byte{0x2, 0x0, 0x0, 0x0, 0x8, 0x0, 0xc, 0x0, 0x0, 0x0, 0x0, 0x1},
+	}
+
+	nfct := &Nfct{logger: newStdLogger(nil), recorder: pw}
+	nfct.record(DirectionSent, []netlink.Message{req})
+	nfct.record(DirectionReceived, []netlink.Message{reply})
+
+	recorded, err := ReadPcap(&buf)
+	if err != nil {
+		t.Fatalf("could not read pcap: %v", err)
+	}
+	if len(recorded) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(recorded))
+	}
+	if recorded[0].Direction != DirectionSent || !bytes.Equal(recorded[0].Message.Data, req.Data) {
+		t.Fatalf("unexpected request: %#v", recorded[0])
+	}
+	if recorded[1].Direction != DirectionReceived || !bytes.Equal(recorded[1].Message.Data, reply.Data) {
+		t.Fatalf("unexpected reply: %#v", recorded[1])
+	}
+	// NLMSG_DONE is reconstructed, as netlink.Conn removes it.
+	if done := recorded[2].Message; done.Header.Type != netlink.Done || done.Header.Sequence != 1 {
+		t.Fatalf("unexpected end of multipart message: %#v", done)
+	}
+}
+
+func TestReadPcapFormat(t *testing.T) {
+	if _, err := ReadPcap(bytes.NewReader([]byte("no pcap"))); !errors.Is(err, ErrPcapFormat) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// pcap header with LINKTYPE_ETHERNET
+	hdr := []byte{0xd4, 0xc3, 0xb2, 0xa1, 0x2, 0x0, 0x4, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+		0x0, 0x0, 0x4, 0x0, 0x1, 0x0, 0x0, 0x0}
+	if _, err := ReadPcap(bytes.NewReader(hdr)); !errors.Is(err, ErrPcapLinktype) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// pcap header with LINKTYPE_NETLINK and a snapshot length of 256 bytes
+	hdr = []byte{0xd4, 0xc3, 0xb2, 0xa1, 0x2, 0x0, 0x4, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+		0x0, 0x1, 0x0, 0x0, 0xfd, 0x0, 0x0, 0x0}
+	for _, capLen := range [][]byte{{0x1, 0x1, 0x0, 0x0}, {0xff, 0xff, 0xff, 0xff}} {
+		pkt := append([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}, capLen...)
+		pkt = append(pkt, capLen...)
+		_, err := ReadPcap(bytes.NewReader(append(hdr, pkt...)))
+		if !errors.Is(err, ErrPcapFormat) || !strings.Contains(err.Error(), "snapshot length") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/florianl/go-conntrack/internal/bpfvm"
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Errors of subscriptions
+var (
+	// ErrNoSocket is returned, if no additional socket can be created for a subscription.
+	ErrNoSocket = errors.New("no socket available for subscription")
+	// ErrSubscriptionStopped is returned, if a subscription is changed after it was stopped.
+	ErrSubscriptionStopped = errors.New("subscription is stopped")
+)
+
+// Subscription represents an active registration for events from Netlinkgroups.
+// Every Subscription has its own netlink socket, filter and set of groups.
+// The first Subscription of a Nfct uses Nfct.Con, every further concurrent
+// Subscription transparently uses an additional socket.
+type Subscription struct {
+	// overruns is accessed atomically and therefore the first field for alignment.
+	overruns uint64
+
+	nfct *Nfct
+	con  *netlink.Conn
+	// ownCon is set, if con was created for this subscription
+	ownCon bool
+
+	table  Table
+	groups NetlinkGroup
+	family Family
+
+	// resyncing is set, if resynchronization is enabled.
+	resyncing bool
+	// state contains the known entries, if resynchronization is enabled.
+	state map[string]Con
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// mu protects the following fields.
+	mu  sync.Mutex
+	err error
+	// filter is set, if the BPF filter is too long for the kernel and the
+	// received messages are filtered in userspace.
+	filter *bpfvm.VM
+	// stopped is set, once the filter of con is removed.
+	stopped bool
+	// matcher is set, if resynchronization is enabled and the subscription
+	// has a filter. It checks the dumped entries against the filter.
+	matcher *Matcher
+}
+
+// Stop the subscription. Stop does not wait until the subscription finished.
+func (s *Subscription) Stop() {
+	s.cancel()
+}
+
+// Done returns a channel, that is closed once the subscription finished and
+// its socket was unsubscribed from the groups.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait blocks until the subscription finished and returns the error, that
+// caused the subscription to end.
+func (s *Subscription) Wait() error {
+	<-s.done
+	return s.Err()
+}
+
+// Err returns the error that ended the subscription. It returns nil, if the
+// subscription is still active or was stopped regularly.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Overruns returns how often the kernel reported with ENOBUFS, that the
+// receive buffer of the socket of the subscription overran. The kernel does
+// not report how many events were dropped by an overrun.
+func (s *Subscription) Overruns() uint64 {
+	return atomic.LoadUint64(&s.overruns)
+}
+
+// UpdateFilter replaces the filter of the subscription by filters and expr,
+// like they are passed with EventOptions. The BPF filter of the socket is
+// replaced atomically, so the subscription stays in its groups and no
+// messages are lost. Messages, that are already queued on the socket, were
+// checked by the previous BPF filter. If the new filter can not be compiled,
+// the previous filter is kept.
+func (s *Subscription) UpdateFilter(filters []ConnAttr, expr FilterExpr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return ErrSubscriptionStopped
+	}
+	matcher, err := s.newMatcher(filters, expr)
+	if err != nil {
+		return err
+	}
+	filter, err := s.nfct.attachFilter(s.con, s.table, filters, expr)
+	if err != nil {
+		return err
+	}
+	s.matcher = matcher
+	previous := s.filter
+	s.filter = filter
+	if filter != nil && previous == nil {
+		// The new filter is too long for the kernel. Remove the previous BPF
+		// filter, so all messages are passed to the filter in userspace.
+		return s.nfct.removeFilter(s.con)
+	}
+	return nil
+}
+
+// newMatcher returns the Matcher for the dumped entries of a resynchronization.
+// It returns nil, if resynchronization is disabled or there is no filter.
+func (s *Subscription) newMatcher(filters []ConnAttr, expr FilterExpr) (*Matcher, error) {
+	if !s.resyncing || (len(filters) == 0 && expr == nil) {
+		return nil, nil
+	}
+	return NewMatcher(s.table, filters, expr)
+}
+
+func (s *Subscription) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Subscribe registers your function to receive typed events from the Netlinkgroups
+// specified in opts. BufferSize and Policy of opts are ignored, as events are passed
+// directly to fn. The subscription ends, if ctx is done, Stop is called, fn returns
+// something different than 0 or an unexpected error is received.
+func (nfct *Nfct) Subscribe(ctx context.Context, opts EventOptions, fn EventFunc) (*Subscription, error) {
+	return nfct.subscribe(ctx, opts, fn, nil)
+}
+
+// reportError forwards err to the attached error channel or logs it, if no
+// channel is attached.
+func (nfct *Nfct) reportError(ctx context.Context, err error) {
+	if nfct.errChan == nil {
+		nfct.logger.Error("receiving error", "error", err)
+		return
+	}
+	select {
+	case nfct.errChan <- err:
+	case <-ctx.Done():
+	}
+}
+
+// acquireSubscriptionCon returns the socket for a new subscription.
+func (nfct *Nfct) acquireSubscriptionCon() (*netlink.Conn, bool, error) {
+	nfct.subMu.Lock()
+	defer nfct.subMu.Unlock()
+
+	if !nfct.conBusy && !nfct.conInUse && !nfct.conAbandoned {
+		nfct.conBusy = true
+		return nfct.Con, false, nil
+	}
+	if nfct.dial == nil {
+		return nil, false, ErrNoSocket
+	}
+	con, err := nfct.dial()
+	if err != nil {
+		return nil, false, err
+	}
+	return con, true, nil
+}
+
+func (nfct *Nfct) releaseSubscription(s *Subscription) {
+	nfct.subMu.Lock()
+	defer nfct.subMu.Unlock()
+
+	delete(nfct.subs, s)
+	if s.ownCon {
+		if err := s.con.Close(); err != nil {
+			nfct.logger.Warn("could not close subscription socket", "error", err)
+		}
+		return
+	}
+	// Make Con usable for requests again.
+	if err := s.con.SetReadDeadline(time.Time{}); err != nil {
+		nfct.logger.Warn("could not reset read deadline", "error", err)
+	}
+	nfct.conBusy = false
+	if nfct.poolCond != nil {
+		nfct.poolCond.Broadcast()
+	}
+}
+
+// subscribe joins the groups and processes received messages with fn until ctx is done.
+// Unexpected errors are passed to errFn. If errFn is nil, errors are reported via the
+// attached error channel.
+func (nfct *Nfct) subscribe(ctx context.Context, opts EventOptions, fn EventFunc, errFn func(error)) (*Subscription, error) {
+	con, ownCon, err := nfct.acquireSubscriptionCon()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		nfct:      nfct,
+		con:       con,
+		ownCon:    ownCon,
+		table:     opts.Table,
+		groups:    opts.Groups,
+		family:    opts.Family,
+		resyncing: opts.Resync,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+
+	if errFn == nil {
+		errFn = func(err error) {
+			nfct.reportError(ctx, err)
+		}
+	}
+
+	if err := nfct.manageGroups(con, s.table, uint32(s.groups), true); err != nil {
+		cancel()
+		nfct.releaseSubscription(s)
+		return nil, err
+	}
+	matcher, err := s.newMatcher(opts.Filter, opts.Expr)
+	if err != nil {
+		nfct.cancelSubscription(s)
+		return nil, err
+	}
+	s.matcher = matcher
+	filter, err := nfct.attachFilter(con, s.table, opts.Filter, opts.Expr)
+	if err != nil {
+		nfct.cancelSubscription(s)
+		return nil, err
+	}
+	s.filter = filter
+
+	if opts.Resync {
+		state, err := s.dump()
+		if err != nil {
+			nfct.cancelSubscription(s)
+			return nil, err
+		}
+		s.state = state
+	}
+
+	nfct.subMu.Lock()
+	if nfct.subs == nil {
+		nfct.subs = make(map[*Subscription]struct{})
+	}
+	nfct.subs[s] = struct{}{}
+	nfct.subMu.Unlock()
+
+	received := make(chan struct{})
+
+	go func() {
+		// block until context is done
+		<-ctx.Done()
+		// Set the read deadline to a point in the past to interrupt
+		// possible blocking Receive() calls.
+		con.SetReadDeadline(time.Now().Add(-1 * time.Second))
+
+		s.mu.Lock()
+		s.stopped = true
+		s.mu.Unlock()
+		if err := nfct.removeFilter(con); err != nil {
+			nfct.logger.Warn("could not remove filter", "error", err)
+		}
+		if err := nfct.manageGroups(con, s.table, uint32(s.groups), false); err != nil {
+			nfct.logger.Warn("could not unsubscribe from group", "error", err)
+		}
+		// Make sure no more messages are processed, before reporting the shutdown.
+		<-received
+		nfct.releaseSubscription(s)
+		close(s.done)
+	}()
+
+	go func() {
+		defer close(received)
+		// The subscription ends with this goroutine.
+		defer cancel()
+
+		for {
+			reply, err := con.Receive()
+			if err != nil {
+				if ctx.Err() != nil {
+					// TODO: Here we ignore internal/poll.ErrFileClosing which is expected after
+					//       ctx is done. Maybe improve graceful handling.
+					return
+				}
+				if errors.Is(err, unix.ENOBUFS) {
+					atomic.AddUint64(&s.overruns, 1)
+					nfct.logger.Warn("events were dropped", "error", err)
+					if s.state != nil {
+						if ret := s.resync(fn); ret != 0 {
+							return
+						}
+					}
+					continue
+				}
+				if opError, ok := err.(*netlink.OpError); ok {
+					if opError.Timeout() || opError.Temporary() {
+						continue
+					}
+				}
+				s.setErr(err)
+				errFn(err)
+				return
+			}
+			now := time.Now()
+			nfct.record(DirectionReceived, reply)
+
+			for _, msg := range reply {
+				if !s.accept(msg) {
+					continue
+				}
+				c := Con{}
+				if err := parseConnectionMsg(nfct.logger, &c, msg, (int(msg.Header.Type)&0x300)>>8, int(msg.Header.Type)&0xF); err != nil {
+					if nfct.debugEnabled() {
+						nfct.logger.Error("could not parse received message", "message", DecodeMessage(msg), "error", err)
+					} else {
+						nfct.logger.Error("could not parse received message", "error", err)
+					}
+					continue
+				}
+				event := newEvent(msg, c, now)
+				if nfct.addConntrackInformation {
+					event.Con.Info = &InfoSource{
+						Table:        event.Table,
+						NetlinkGroup: event.Group(),
+					}
+				}
+				if s.state != nil {
+					s.track(event)
+				}
+				if ret := fn(event); ret != 0 {
+					return
+				}
+			}
+		}
+	}()
+	return s, nil
+}
+
+// accept returns true, if msg passes the userspace filter of s.
+func (s *Subscription) accept(msg netlink.Message) bool {
+	s.mu.Lock()
+	filter := s.filter
+	s.mu.Unlock()
+	if filter == nil {
+		return true
+	}
+	return filter.Run(messagePacket(msg)) != bpfVerdictReject
+}
+
+// messagePacket returns msg, like it is checked by a BPF filter of the kernel.
+func messagePacket(msg netlink.Message) []byte {
+	pkt := make([]byte, 16+len(msg.Data))
+	nlenc.PutUint32(pkt[0:4], uint32(len(pkt)))
+	nlenc.PutUint16(pkt[4:6], uint16(msg.Header.Type))
+	nlenc.PutUint16(pkt[6:8], uint16(msg.Header.Flags))
+	nlenc.PutUint32(pkt[8:12], msg.Header.Sequence)
+	nlenc.PutUint32(pkt[12:16], msg.Header.PID)
+	copy(pkt[16:], msg.Data)
+	return pkt
+}
+
+// cancelSubscription undoes the setup of a subscription, that could not be started.
+func (nfct *Nfct) cancelSubscription(s *Subscription) {
+	if err := nfct.manageGroups(s.con, s.table, uint32(s.groups), false); err != nil {
+		nfct.logger.Warn("could not unsubscribe from group", "error", err)
+	}
+	s.cancel()
+	nfct.releaseSubscription(s)
+}
+
+// dumpRetries limits the attempts to get a consistent dump. If all attempts
+// are interrupted, the result of the last one is used.
+const dumpRetries = 3
+
+// dump returns the entries of the table of the subscription, that pass its filter.
+func (s *Subscription) dump() (map[string]Con, error) {
+	var cons []Con
+	var err error
+	for i := 0; i < dumpRetries; i++ {
+		cons, err = s.nfct.Dump(s.table, s.family)
+		if !errors.Is(err, ErrDumpInterrupted) {
+			break
+		}
+	}
+	if err != nil && !errors.Is(err, ErrDumpInterrupted) {
+		return nil, err
+	}
+	s.mu.Lock()
+	matcher := s.matcher
+	s.mu.Unlock()
+
+	state := make(map[string]Con, len(cons))
+	for _, c := range cons {
+		// Entries, that do not pass the filter, are not known from events either.
+		if matcher != nil && !matcher.MatchEvent(Event{Kind: EventNew, Table: s.table, Con: c}) {
+			continue
+		}
+		state[conKey(c)] = c
+	}
+	return state, nil
+}
+
+// track applies event to the known state.
+func (s *Subscription) track(e Event) {
+	key := conKey(e.Con)
+	switch e.Kind {
+	case EventNew, EventUpdate:
+		s.state[key] = e.Con
+	case EventDestroy:
+		delete(s.state, key)
+	}
+}
+
+// resync dumps the table and passes synthetic events for the differences
+// to the known state to fn.
+func (s *Subscription) resync(fn EventFunc) int {
+	state, err := s.dump()
+	if err != nil {
+		s.nfct.logger.Error("could not resynchronize", "error", err)
+		return 0
+	}
+	now := time.Now()
+	emit := func(kind EventKind, c Con) int {
+		e := Event{Kind: kind, Table: s.table, Con: c, Time: now, Synthetic: true}
+		if s.groups&e.Group() == 0 {
+			return 0
+		}
+		if s.nfct.addConntrackInformation {
+			e.Con.Info = &InfoSource{
+				Table:        e.Table,
+				NetlinkGroup: e.Group(),
+			}
+		}
+		return fn(e)
+	}
+
+	old := s.state
+	s.state = state
+	for key, c := range state {
+		if _, ok := old[key]; ok {
+			continue
+		}
+		if ret := emit(EventNew, c); ret != 0 {
+			return ret
+		}
+	}
+	for key, c := range old {
+		if _, ok := state[key]; ok {
+			continue
+		}
+		if ret := emit(EventDestroy, c); ret != 0 {
+			return ret
+		}
+	}
+	return 0
+}
+
+// conKey returns a key, that identifies an entry of a table.
+func conKey(c Con) string {
+	if c.Exp != nil {
+		if c.Exp.ID != nil {
+			return fmt.Sprintf("exp-id:%d", *c.Exp.ID)
+		}
+		return fmt.Sprintf("exp:%s|%s", tupleKey(c.Origin), tupleKey(c.Exp.Tuple))
+	}
+	if c.ID != nil {
+		return fmt.Sprintf("id:%d", *c.ID)
+	}
+	return fmt.Sprintf("tuple:%s|%s", tupleKey(c.Origin), tupleKey(c.Reply))
+}
+
+func tupleKey(t *IPTuple) string {
+	if t == nil {
+		return ""
+	}
+	var b strings.Builder
+	if t.Src != nil {
+		b.WriteString(t.Src.String())
+	}
+	b.WriteString(">")
+	if t.Dst != nil {
+		b.WriteString(t.Dst.String())
+	}
+	if t.Proto != nil {
+		p := t.Proto
+		for _, v := range []*uint16{p.SrcPort, p.DstPort, p.IcmpID, p.Icmpv6ID} {
+			if v != nil {
+				fmt.Fprintf(&b, "/%d", *v)
+			} else {
+				b.WriteString("/-")
+			}
+		}
+		if p.Number != nil {
+			fmt.Fprintf(&b, "/%d", *p.Number)
+		}
+	}
+	if t.Zone != nil {
+		fmt.Fprintf(&b, "@%d", *t.Zone)
+	}
+	return b.String()
+}
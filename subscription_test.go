@@ -0,0 +1,328 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-conntrack/internal/unix"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+func TestSubscriptions(t *testing.T) {
+	ctSock := newEventSocket()
+	expSock := newEventSocket()
+	nfct := &Nfct{
+		Con:    netlink.NewConn(ctSock, 1),
+		logger: newStdLogger(nil),
+		dial: func() (*netlink.Conn, error) {
+			return netlink.NewConn(expSock, 2), nil
+		},
+	}
+
+	// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_NEW
+	ctSock.msgs <- []netlink.Message{{
+		Header: netlink.Header{Type: netlink.HeaderType(1 << 8)},
+		Data:   []byte{0x2, 0x0, 0x0, 0x0},
+	}}
+	// NFNL_SUBSYS_CTNETLINK_EXP<<8|IPCTNL_MSG_EXP_DELETE
+	expSock.msgs <- []netlink.Message{{
+		Header: netlink.Header{Type: netlink.HeaderType(2<<8 | 2)},
+		Data:   []byte{0x2, 0x0, 0x0, 0x0},
+	}}
+
+	ctEvents := make(chan Event, 1)
+	ctSub, err := nfct.Subscribe(context.Background(), EventOptions{Table: Conntrack, Groups: NetlinkCtUpdate}, func(e Event) int {
+		ctEvents <- e
+		return 0
+	})
+	if err != nil {
+		t.Fatalf("could not subscribe to conntrack: %v", err)
+	}
+
+	expSub, err := nfct.Subscribe(context.Background(), EventOptions{Table: Expected, Groups: NetlinkCtExpectedDestroy}, func(e Event) int {
+		if e.Table != Expected || e.Kind != EventDestroy {
+			t.Errorf("unexpected event: %#v", e)
+		}
+		// stop this subscription
+		return 1
+	})
+	if err != nil {
+		t.Fatalf("could not subscribe to expected: %v", err)
+	}
+
+	if err := expSub.Wait(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expSock.joined(6) {
+		t.Fatalf("expected socket did not leave its group")
+	}
+
+	if e := <-ctEvents; e.Table != Conntrack || e.Kind != EventUpdate {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	select {
+	case <-ctSub.Done():
+		t.Fatalf("conntrack subscription ended unexpectedly")
+	default:
+	}
+	if !ctSock.joined(2) {
+		t.Fatalf("conntrack socket is not subscribed")
+	}
+
+	if err := nfct.Close(); err != nil {
+		t.Fatalf("could not close nfct: %v", err)
+	}
+	if err := ctSub.Wait(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ctSock.joined(2) {
+		t.Fatalf("conntrack socket did not leave its group")
+	}
+}
+
+func TestSubscriptionResync(t *testing.T) {
+	// entry returns a dumped conntrack entry with CTA_ID set to id.
+	entry := func(id byte) netlink.Message {
+		return netlink.Message{
+			// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_NEW
+			Header: netlink.Header{Type: netlink.HeaderType(1 << 8)},
+			Data:   []byte{0x2, 0x0, 0x0, 0x0, 0x8, 0x0, 0xc, 0x0, 0x0, 0x0, 0x0, id},
+		}
+	}
+	dumps := [][]netlink.Message{
+		{entry(1), entry(2)},
+		{entry(2), entry(3)},
+	}
+
+	sock := newEventSocket()
+	nfct := &Nfct{
+		Con:    netlink.NewConn(sock, 1),
+		logger: newStdLogger(nil),
+		dial: func() (*netlink.Conn, error) {
+			return nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+				if len(reqs) == 0 {
+					return nil, nil
+				}
+				reply := dumps[0]
+				dumps = dumps[1:]
+				for i := range reply {
+					reply[i].Header.Sequence = reqs[0].Header.Sequence
+					reply[i].Header.PID = reqs[0].Header.PID
+				}
+				return reply, nil
+			}), nil
+		},
+	}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	defer nfct.Close()
+
+	events := make(chan Event, 4)
+	sub, err := nfct.Subscribe(context.Background(), EventOptions{
+		Table:  Conntrack,
+		Groups: NetlinkCtNew | NetlinkCtDestroy,
+		Resync: true,
+	}, func(e Event) int {
+		events <- e
+		return 0
+	})
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	sock.errs <- unix.ENOBUFS
+
+	want := map[uint32]EventKind{1: EventDestroy, 3: EventNew}
+	for i := 0; i < len(want); i++ {
+		e := <-events
+		if !e.Synthetic || e.Con.ID == nil || want[*e.Con.ID] != e.Kind {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	}
+	if overruns := sub.Overruns(); overruns != 1 {
+		t.Fatalf("unexpected number of overruns: %d", overruns)
+	}
+
+	sub.Stop()
+	if err := sub.Wait(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSubscriptionResyncFiltered(t *testing.T) {
+	// entry returns a dumped conntrack entry with CTA_ID and CTA_MARK set.
+	entry := func(id, mark uint32) netlink.Message {
+		data, err := MarshalAttributes(Con{ID: &id, Mark: &mark})
+		if err != nil {
+			t.Fatalf("could not encode entry: %v", err)
+		}
+		return netlink.Message{
+			// NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_NEW
+			Header: netlink.Header{Type: netlink.HeaderType(1 << 8)},
+			Data:   append([]byte{0x2, 0x0, 0x0, 0x0}, data...),
+		}
+	}
+	dumps := [][]netlink.Message{
+		{entry(1, 1), entry(2, 0)},
+		{entry(2, 0), entry(3, 1), entry(4, 0)},
+	}
+
+	sock := newEventSocket()
+	nfct := &Nfct{
+		Con:    netlink.NewConn(sock, 1),
+		logger: newStdLogger(nil),
+		dial: func() (*netlink.Conn, error) {
+			return nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+				if len(reqs) == 0 {
+					return nil, nil
+				}
+				reply := dumps[0]
+				dumps = dumps[1:]
+				for i := range reply {
+					reply[i].Header.Sequence = reqs[0].Header.Sequence
+					reply[i].Header.PID = reqs[0].Header.PID
+				}
+				return reply, nil
+			}), nil
+		},
+	}
+	AdjustWriteTimeout(nfct, func() error { return nil })
+	defer nfct.Close()
+
+	expr, err := ParseFilter("mark 1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events := make(chan Event, 8)
+	sub, err := nfct.Subscribe(context.Background(), EventOptions{
+		Table:  Conntrack,
+		Groups: NetlinkCtNew | NetlinkCtDestroy,
+		Expr:   expr,
+		Resync: true,
+	}, func(e Event) int {
+		events <- e
+		return 0
+	})
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	sock.errs <- unix.ENOBUFS
+
+	want := map[uint32]EventKind{1: EventDestroy, 3: EventNew}
+	for i := 0; i < len(want); i++ {
+		e := <-events
+		if !e.Synthetic || e.Con.ID == nil || want[*e.Con.ID] != e.Kind {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	}
+
+	sub.Stop()
+	if err := sub.Wait(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("unexpected event: %#v", <-events)
+	}
+}
+
+func TestSubscriptionUpdateFilter(t *testing.T) {
+	sock := newEventSocket()
+	sock.filtering = true
+	nfct := &Nfct{
+		Con:    netlink.NewConn(sock, 1),
+		logger: newStdLogger(nil),
+	}
+	defer nfct.Close()
+
+	ports := make(chan uint16, 8)
+	s, err := nfct.Subscribe(context.Background(), EventOptions{
+		Table:  Conntrack,
+		Groups: NetlinkCtNew,
+		Expr:   ConnAttr{Type: AttrOrigPortDst, Data: u16(22)},
+	}, func(e Event) int {
+		ports <- *e.Con.Origin.Proto.DstPort
+		return 0
+	})
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	// expect sends events for the destination ports 22, 80 and 443 and
+	// checks, that only the events for want are received.
+	expect := func(want ...uint16) {
+		t.Helper()
+		for _, port := range []uint16{22, 80, 443} {
+			var msg netlink.Message
+			if err := msg.UnmarshalBinary(encodeMessage(t, Conntrack, ipctnlMsgCtNew, 0, testCon("10.0.0.1", port, 0))); err != nil {
+				t.Fatalf("could not decode message: %v", err)
+			}
+			sock.msgs <- []netlink.Message{msg}
+		}
+		for _, port := range want {
+			select {
+			case got := <-ports:
+				if got != port {
+					t.Fatalf("unexpected event for port %d, want %d", got, port)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("missing event for port %d", port)
+			}
+		}
+		select {
+		case got := <-ports:
+			t.Fatalf("unexpected event for port %d", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	expect(22)
+
+	if err := s.UpdateFilter([]ConnAttr{{Type: AttrOrigPortDst, Data: u16(80)}, {Type: AttrOrigPortDst, Data: u16(443)}}, nil); err != nil {
+		t.Fatalf("could not update filter: %v", err)
+	}
+	expect(80, 443)
+	if !sock.joined(1) {
+		t.Fatal("socket left its group")
+	}
+
+	// A filter, that is too long for the kernel, is applied in userspace.
+	var long []ConnAttr
+	for i := 0; i < 1000; i++ {
+		ip := net.ParseIP(fmt.Sprintf("2001:db8::%x", 0x100+i))
+		long = append(long, ConnAttr{Type: AttrOrigIPv6Src, Data: ip, Mask: net.CIDRMask(128, 128)})
+	}
+	if err := s.UpdateFilter(long, nil); err != nil {
+		t.Fatalf("could not update filter: %v", err)
+	}
+	if sock.attached() {
+		t.Fatal("BPF filter is still attached")
+	}
+	expect()
+
+	if err := s.UpdateFilter(nil, ConnAttr{Type: AttrOrigPortDst, Data: u16(443)}); err != nil {
+		t.Fatalf("could not update filter: %v", err)
+	}
+	if !sock.attached() {
+		t.Fatal("BPF filter is not attached")
+	}
+	expect(443)
+
+	// An invalid filter keeps the previous one.
+	if err := s.UpdateFilter(nil, ConnAttr{Type: AttrOrigPortDst, Data: u32(22)}); !errors.Is(err, ErrFilterAttributeLength) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expect(443)
+
+	s.Stop()
+	if err := s.Wait(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.UpdateFilter(nil, nil); !errors.Is(err, ErrSubscriptionStopped) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -1,11 +1,11 @@
 package conntrack
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/florianl/go-conntrack/internal/unix"
@@ -40,9 +40,15 @@ type Config struct {
 	// Time till a write action times out - only available for Go >= 1.12
 	WriteTimeout time.Duration
 
-	// Interface to log internals.
+	// Interface to log internals. Messages of the debug level are only logged,
+	// if EnableDebug was called or Trace is set, all other messages are logged
+	// regardless of their level. Logger is ignored, if LeveledLogger is set.
 	Logger *log.Logger
 
+	// LeveledLogger logs internals with a level and structured fields, e.g. by
+	// NewSlogLogger.
+	LeveledLogger LeveledLogger
+
 	// DisableNSLockThread disables package netlink's default goroutine thread
 	// locking behavior.
 	//
@@ -64,31 +70,109 @@ type Config struct {
 	// AddConntrackInformation enriches Con and provides additional information of
 	// the Netlink/Conntrack origin.
 	AddConntrackInformation bool
+
+	// SendUnknownAttributes sends the attributes of Con.Unknown in the
+	// requests of Create and Update, e.g. to copy entries without losing
+	// attributes, that are not supported by this package. The kernel might
+	// reject attributes, that can not be set, with EOPNOTSUPP.
+	SendUnknownAttributes bool
+
+	// ReadBuffer sets the size of the receive buffer (SO_RCVBUF) of the netlink
+	// sockets in bytes. High-rate event consumers should increase this value to
+	// reduce the risk of overruns. If not set, the system default is used.
+	ReadBuffer int
+
+	// ForceReadBuffer sets ReadBuffer with SO_RCVBUFFORCE, which overrides the
+	// limit of net.core.rmem_max. This requires CAP_NET_ADMIN.
+	ForceReadBuffer bool
+
+	// NoENOBUFS sets NETLINK_NO_ENOBUFS, so the kernel does not report overruns
+	// of the receive buffer. Dropped events then go unnoticed.
+	NoENOBUFS bool
+
+	// BroadcastError sets NETLINK_BROADCAST_ERROR, so errors on delivering
+	// messages to Netlinkgroups are reported.
+	BroadcastError bool
+
+	// StrictCheck sets NETLINK_GET_STRICT_CHK to enable strict checking of
+	// requests by the kernel.
+	StrictCheck bool
+
+	// ExtendedAcknowledge sets NETLINK_EXT_ACK, so the kernel provides
+	// additional information about failed requests.
+	ExtendedAcknowledge bool
+
+	// PoolSize limits the number of sockets, that are used for concurrent
+	// requests. Additional sockets are created on demand. If not set, concurrent
+	// requests are processed one after another on a single socket.
+	PoolSize int
+
+	// Dial creates the netlink sockets instead of netlink.Dial. It can be used
+	// to connect to a fake kernel, e.g. conntracktest.Kernel. NetNS and
+	// DisableNSLockThread are ignored, if Dial is set.
+	Dial func() (*netlink.Conn, error)
+
+	// Recorder receives all netlink messages, that are sent and received, e.g.
+	// to write them with PcapWriter for later analysis.
+	Recorder Recorder
+
+	// Trace logs all netlink messages, that are sent and received, decoded by
+	// DecodeMessage at the debug level.
+	Trace bool
 }
 
-// Nfct represents a conntrack handler
+// Nfct represents a conntrack handler. It is safe for concurrent use by
+// multiple goroutines.
 type Nfct struct {
 	// Con is the pure representation of a netlink socket
 	Con *netlink.Conn
 
-	logger *log.Logger
+	logger LeveledLogger
 
 	errChan chan error
 
-	debug bool
-
-	setWriteTimeout func() error
-
-	ctx       context.Context
-	ctxCancel context.CancelFunc
-	shutdown  chan struct{}
+	// debug is set by EnableDebug and accessed atomically.
+	debug uint32
+
+	setWriteTimeout func(*netlink.Conn) error
+
+	// dial creates additional sockets, e.g. for concurrent subscriptions.
+	dial func() (*netlink.Conn, error)
+
+	recorder Recorder
+	trace    bool
+
+	subMu sync.Mutex
+	subs  map[*Subscription]struct{}
+	// conBusy is set, if Con is used by a subscription.
+	conBusy bool
+
+	// pool of sockets for concurrent requests, guarded by subMu.
+	poolSize  int
+	poolCond  *sync.Cond
+	poolInUse int
+	// conInUse is set, if Con is used by a request.
+	conInUse bool
+	idle     []*netlink.Conn
+	// poolClosed is set by Close, sockets released afterwards are closed.
+	poolClosed bool
+	// abandoned contains the sockets of interrupted requests, that are closed
+	// once they are released.
+	abandoned map[*netlink.Conn]struct{}
+	// conAbandoned is set, if a request on Con was interrupted and further
+	// sockets can be created. Con is not used for requests and subscriptions
+	// anymore, as late replies to the interrupted request might be received.
+	conAbandoned bool
 
 	addConntrackInformation bool
+	sendUnknownAttributes   bool
 }
 
 // adjust the WriteTimeout (mostly for testing)
 func adjustWriteTimeout(nfct *Nfct, fn func() error) {
-	nfct.setWriteTimeout = fn
+	nfct.setWriteTimeout = func(*netlink.Conn) error {
+		return fn()
+	}
 }
 
 // SecCtx contains additional information about the security context
@@ -232,6 +316,23 @@ type Con struct {
 	Timestamp     *Timestamp
 	SecCtx        *SecCtx
 	Exp           *Exp
+
+	// Unknown contains the attributes, that are not supported by this package.
+	// They are encoded by MarshalAttributes and MarshalExpectAttributes. They
+	// are only sent to the kernel by Create and Update, if
+	// SendUnknownAttributes of Config is set.
+	Unknown []Attribute
+}
+
+// Attribute is a netlink attribute, that is not supported by this package.
+type Attribute struct {
+	// Path contains the types of the attributes, that this attribute is
+	// nested in, starting at the top level.
+	Path []uint16
+	// Type of the attribute including the flags NLA_F_NESTED and
+	// NLA_F_NET_BYTEORDER.
+	Type uint16
+	Data []byte
 }
 
 // InfoSource provides further information from Netlink about a connection.
@@ -410,6 +511,7 @@ var (
 	ErrAttrNotImplemented = errors.New("attribute not implemented")
 	ErrAttrNotExist       = errors.New("type of attribute does not exist")
 	ErrDataLength         = errors.New("incorrect length of provided data")
+	ErrAttrMissing        = errors.New("required attribute is missing")
 )
 
 // ErrUnknownCtTable will be return, if the function can not be performed on this subsystem